@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Helper function to check the ADMIN_TOKEN of an admin request, answering it if the check fails.
+// Admin endpoints are disabled while ADMIN_TOKEN is not set.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		fmt.Printf("[Warning] Admin request for %s from %s rejected, ADMIN_TOKEN is not set\n", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "admin endpoints are disabled", http.StatusForbidden)
+		return false
+	}
+
+	given := r.Header.Get("X-Admin-Token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		fmt.Printf("[Warning] Admin request for %s from %s rejected, invalid token\n", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
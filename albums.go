@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// AlbumTrack is a track of an album or artist, in play order.
+type AlbumTrack struct {
+	MusicItem
+	Position int    `json:"position"`
+	Track    int    `json:"track,omitempty"` // Track number from the tags
+	Source   string `json:"source"`          // "sources", "local" or "cache"
+	PlayURL  string `json:"play_url"`
+}
+
+// Album groups the tracks of the library that share an album title and artist.
+type Album struct {
+	ID         string       `json:"id"`
+	Title      string       `json:"title"`
+	Artist     string       `json:"artist"`
+	ArtistID   string       `json:"artist_id"`
+	Year       int          `json:"year,omitempty"`
+	CoverURL   string       `json:"cover_url"`
+	TrackCount int          `json:"track_count"`
+	Duration   int          `json:"duration"`
+	Tracks     []AlbumTrack `json:"tracks,omitempty"`
+}
+
+// Artist groups the albums and tracks of the library credited to one artist under any of its names.
+type Artist struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Aliases    []string     `json:"aliases"`
+	AlbumCount int          `json:"album_count"`
+	TrackCount int          `json:"track_count"`
+	Albums     []Album      `json:"albums,omitempty"`
+	Tracks     []AlbumTrack `json:"tracks,omitempty"`
+}
+
+// ArtistAliasConfig declares alternative names of an artist in artists.json.
+type ArtistAliasConfig struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+}
+
+// libraryCatalog holds the albums and artists built from the library index.
+type libraryCatalog struct {
+	albums  map[string]*Album
+	artists map[string]*Artist
+}
+
+// Helper function to normalize a name for grouping, ignoring case and repeated spaces
+func normalizeCatalogName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Helper function to derive a stable ID from a grouping key
+func catalogID(kind, key string) string {
+	sum := sha1.Sum([]byte(kind + "\x00" + key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Helper function to split the artist credit of a track into the individual artists
+func splitArtists(artist string) []string {
+	for _, separator := range []string{" feat. ", " ft. ", "、", "/", ";"} {
+		artist = strings.ReplaceAll(artist, separator, "\x00")
+	}
+	var names []string
+	for _, name := range strings.Split(artist, "\x00") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Helper function to read the artist aliases of artists.json, mapping every normalized name to the canonical one
+func loadArtistAliases() map[string]ArtistAliasConfig {
+	aliasesFile := os.Getenv("ARTISTS_FILE")
+	if aliasesFile == "" {
+		aliasesFile = "./artists.json"
+	}
+	aliases := map[string]ArtistAliasConfig{}
+	data, err := os.ReadFile(aliasesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("[Error] Failed to read artists file:", err)
+		}
+		return aliases
+	}
+	var configs []ArtistAliasConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		fmt.Println("[Error] Failed to parse artists file:", err)
+		return aliases
+	}
+	for _, config := range configs {
+		if config.Name == "" {
+			continue
+		}
+		aliases[normalizeCatalogName(config.Name)] = config
+		for _, alias := range config.Aliases {
+			aliases[normalizeCatalogName(alias)] = config
+		}
+	}
+	return aliases
+}
+
+// Helper function to build the served music item of a library entry
+func buildLibraryEntryMusicItem(r *http.Request, entry LibraryEntry) MusicItem {
+	switch entry.Source {
+	case librarySources:
+		return buildSourceMusicItem(r, entry.Item)
+	case libraryCache:
+		musicItem := absoluteMusicItemURLs(r, entry.Item)
+		musicItem.FromCache = true
+		return musicItem
+	}
+	return absoluteMusicItemURLs(r, entry.Item)
+}
+
+// Helper function to build the albums and artists of the library. The same song found in several
+// places is listed once, preferring sources.json over the local folder over the cache.
+func buildLibraryCatalog(r *http.Request) *libraryCatalog {
+	catalog := &libraryCatalog{albums: map[string]*Album{}, artists: map[string]*Artist{}}
+	aliases := loadArtistAliases()
+	spellings := map[string]map[string]bool{} // Artist ID -> names seen in the library
+
+	// Helper function to get the artist record of a name, creating it on first use
+	getArtist := func(name string) *Artist {
+		key := normalizeCatalogName(name)
+		canonical := name
+		if config, ok := aliases[key]; ok {
+			canonical = config.Name
+			key = normalizeCatalogName(config.Name)
+		}
+		id := catalogID("artist", key)
+		artist, ok := catalog.artists[id]
+		if !ok {
+			artist = &Artist{ID: id, Name: canonical}
+			if config, ok := aliases[key]; ok {
+				artist.Aliases = append(artist.Aliases, config.Aliases...)
+			}
+			catalog.artists[id] = artist
+			spellings[id] = map[string]bool{}
+		}
+		if !strings.EqualFold(name, artist.Name) {
+			spellings[id][name] = true
+		}
+		return artist
+	}
+
+	seen := map[string]bool{}
+	for _, source := range []string{librarySources, libraryLocal, libraryCache} {
+		for _, entry := range getLibraryEntries(source) {
+			if entry.Item.Title == "" {
+				continue
+			}
+			songKey := normalizeCatalogName(entry.Item.Title) + "\x00" + normalizeCatalogName(entry.Item.Artist)
+			if seen[songKey] {
+				continue
+			}
+			seen[songKey] = true
+
+			musicItem := buildLibraryEntryMusicItem(r, entry)
+			track := AlbumTrack{MusicItem: musicItem, Track: entry.Track, Source: source}
+			track.PlayURL = buildPlayURL(r, SearchHit{MusicItem: musicItem})
+
+			// Names listed in artists.json are kept whole, so "AC/DC" can be declared as one artist
+			names := []string{strings.TrimSpace(entry.Item.Artist)}
+			if _, ok := aliases[normalizeCatalogName(entry.Item.Artist)]; !ok {
+				names = splitArtists(entry.Item.Artist)
+			}
+			var credited []*Artist
+			for _, name := range names {
+				artist := getArtist(name)
+				artist.Tracks = append(artist.Tracks, track)
+				credited = append(credited, artist)
+			}
+
+			albumTitle := entry.Album
+			setFirst(&albumTitle, entry.Item.Album)
+			if albumTitle == "" || len(credited) == 0 {
+				continue
+			}
+			// Albums are grouped under the first credited artist
+			albumArtist := credited[0]
+			id := catalogID("album", normalizeCatalogName(albumTitle)+"\x00"+albumArtist.ID)
+			album, ok := catalog.albums[id]
+			if !ok {
+				album = &Album{ID: id, Title: albumTitle, Artist: albumArtist.Name, ArtistID: albumArtist.ID}
+				catalog.albums[id] = album
+			}
+			if entry.Year > album.Year {
+				album.Year = entry.Year
+			}
+			album.Tracks = append(album.Tracks, track)
+		}
+	}
+
+	for _, album := range catalog.albums {
+		sortAlbumTracks(album.Tracks)
+		for _, track := range album.Tracks {
+			album.Duration += track.Duration
+			setFirst(&album.CoverURL, track.CoverURL)
+		}
+		album.TrackCount = len(album.Tracks)
+	}
+	for id, artist := range catalog.artists {
+		for name := range spellings[id] {
+			if !containsFold(artist.Aliases, name) {
+				artist.Aliases = append(artist.Aliases, name)
+			}
+		}
+		sort.Strings(artist.Aliases)
+		if artist.Aliases == nil {
+			artist.Aliases = []string{}
+		}
+		sortAlbumTracks(artist.Tracks)
+		artist.TrackCount = len(artist.Tracks)
+	}
+	for _, album := range catalog.sortedAlbums() {
+		artist := catalog.artists[album.ArtistID]
+		artist.Albums = append(artist.Albums, album.summary())
+		artist.AlbumCount++
+	}
+	return catalog
+}
+
+// Helper function to order tracks by track number, then title, numbering their positions
+func sortAlbumTracks(tracks []AlbumTrack) {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		if a.Track != b.Track {
+			// Tracks without a number go last
+			if a.Track == 0 || b.Track == 0 {
+				return b.Track == 0
+			}
+			return a.Track < b.Track
+		}
+		return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+	})
+	for i := range tracks {
+		tracks[i].Position = i + 1
+	}
+}
+
+// Helper function to tell whether a list contains a name, ignoring case
+func containsFold(names []string, name string) bool {
+	for _, other := range names {
+		if strings.EqualFold(other, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to get a copy of an album without its tracks
+func (album *Album) summary() Album {
+	summary := *album
+	summary.Tracks = nil
+	return summary
+}
+
+// Helper function to list the albums ordered by artist, year and title
+func (c *libraryCatalog) sortedAlbums() []*Album {
+	albums := make([]*Album, 0, len(c.albums))
+	for _, album := range c.albums {
+		albums = append(albums, album)
+	}
+	sort.Slice(albums, func(i, j int) bool {
+		a, b := albums[i], albums[j]
+		if !strings.EqualFold(a.Artist, b.Artist) {
+			return strings.ToLower(a.Artist) < strings.ToLower(b.Artist)
+		}
+		if a.Year != b.Year {
+			return a.Year < b.Year
+		}
+		return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+	})
+	return albums
+}
+
+// Helper function to find an artist by ID or by any of its names
+func (c *libraryCatalog) findArtist(idOrName string) (*Artist, bool) {
+	if artist, ok := c.artists[idOrName]; ok {
+		return artist, true
+	}
+	for _, artist := range c.artists {
+		if strings.EqualFold(artist.Name, idOrName) || containsFold(artist.Aliases, idOrName) {
+			return artist, true
+		}
+	}
+	return nil, false
+}
+
+// Helper function to write a JSON response
+func writeCatalogJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(value)
+}
+
+// albumsHandler handles /api/albums?artist=&q=, /api/albums/{id} and /api/albums/{id}/play requests.
+func albumsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "MeowMusicEmbeddedServer")
+	queryParams := r.URL.Query()
+	fmt.Printf("[Web Access] Handling request for %s?%s\n", r.URL.Path, queryParams.Encode())
+	catalog := buildLibraryCatalog(r)
+
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/albums"), "/"), "/")
+	if id == "" {
+		artistFilter := strings.TrimSpace(queryParams.Get("artist"))
+		query := normalizeCatalogName(queryParams.Get("q"))
+		var artist *Artist
+		if artistFilter != "" {
+			var ok bool
+			if artist, ok = catalog.findArtist(artistFilter); !ok {
+				writeCatalogJSON(w, map[string]interface{}{"total": 0, "albums": []Album{}})
+				return
+			}
+		}
+		albums := []Album{}
+		for _, album := range catalog.sortedAlbums() {
+			if artist != nil && album.ArtistID != artist.ID {
+				continue
+			}
+			if query != "" && !strings.Contains(normalizeCatalogName(album.Title), query) {
+				continue
+			}
+			albums = append(albums, album.summary())
+		}
+		writeCatalogJSON(w, map[string]interface{}{"total": len(albums), "albums": albums})
+		return
+	}
+
+	album, ok := catalog.albums[id]
+	if !ok {
+		NotFoundHandler(w, r)
+		return
+	}
+	switch action {
+	case "":
+		writeCatalogJSON(w, album)
+	case "play":
+		// Devices get just the ordered tracks, each playable through /stream_pcm
+		writeCatalogJSON(w, album.Tracks)
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// artistsHandler handles /api/artists?q= and /api/artists/{id} requests.
+func artistsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "MeowMusicEmbeddedServer")
+	queryParams := r.URL.Query()
+	fmt.Printf("[Web Access] Handling request for %s?%s\n", r.URL.Path, queryParams.Encode())
+	catalog := buildLibraryCatalog(r)
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/artists"), "/")
+	if id == "" {
+		query := normalizeCatalogName(queryParams.Get("q"))
+		artists := []Artist{}
+		for _, artist := range catalog.artists {
+			if query != "" && !strings.Contains(normalizeCatalogName(artist.Name), query) {
+				continue
+			}
+			summary := *artist
+			summary.Albums, summary.Tracks = nil, nil
+			artists = append(artists, summary)
+		}
+		sort.Slice(artists, func(i, j int) bool { return strings.ToLower(artists[i].Name) < strings.ToLower(artists[j].Name) })
+		writeCatalogJSON(w, map[string]interface{}{"total": len(artists), "artists": artists})
+		return
+	}
+
+	artist, ok := catalog.findArtist(id)
+	if !ok {
+		NotFoundHandler(w, r)
+		return
+	}
+	writeCatalogJSON(w, artist)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -36,148 +38,25 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Attempt to retrieve music items from sources.json
-	sources := readSources()
+	// Counted for prefetching the songs requested most often
+	recordSongRequest(song, singer)
 
-	var musicItem MusicItem
-	var found bool = false
+	musicItem, found := lookupMusicItem(r, song, singer)
 
-	// Build request scheme
-	var scheme string
-	if r.TLS == nil {
-		scheme = "http"
-	} else {
-		scheme = "https"
-	}
-
-	for _, source := range sources {
-		if source.Title == song {
-			if singer == "" || source.Artist == singer {
-				// Determine the protocol for each URL and build accordingly
-				var audioURL, audioFullURL, m3u8URL, lyricURL, coverURL string
-				if strings.HasPrefix(source.AudioURL, "http://") {
-					audioURL = scheme + "://" + r.Host + "/url/http/" + url.QueryEscape(strings.TrimPrefix(source.AudioURL, "http://"))
-				} else if strings.HasPrefix(source.AudioURL, "https://") {
-					audioURL = scheme + "://" + r.Host + "/url/https/" + url.QueryEscape(strings.TrimPrefix(source.AudioURL, "https://"))
-				} else {
-					audioURL = scheme + "://" + r.Host + "/" + url.QueryEscape(source.AudioURL)
-				}
-				if strings.HasPrefix(source.AudioFullURL, "http://") {
-					audioFullURL = scheme + "://" + r.Host + "/url/http/" + url.QueryEscape(strings.TrimPrefix(source.AudioFullURL, "http://"))
-				} else if strings.HasPrefix(source.AudioFullURL, "https://") {
-					audioFullURL = scheme + "://" + r.Host + "/url/https/" + url.QueryEscape(strings.TrimPrefix(source.AudioFullURL, "https://"))
-				} else {
-					audioFullURL = scheme + "://" + r.Host + "/" + url.QueryEscape(source.AudioFullURL)
-				}
-				if strings.HasPrefix(source.M3U8URL, "http://") {
-					m3u8URL = scheme + "://" + r.Host + "/url/http/" + url.QueryEscape(strings.TrimPrefix(source.M3U8URL, "http://"))
-				} else if strings.HasPrefix(source.M3U8URL, "https://") {
-					m3u8URL = scheme + "://" + r.Host + "/url/https/" + url.QueryEscape(strings.TrimPrefix(source.M3U8URL, "https://"))
-				} else {
-					m3u8URL = scheme + "://" + r.Host + "/" + url.QueryEscape(source.M3U8URL)
-				}
-				if strings.HasPrefix(source.LyricURL, "http://") {
-					lyricURL = scheme + "://" + r.Host + "/url/http/" + url.QueryEscape(strings.TrimPrefix(source.LyricURL, "http://"))
-				} else if strings.HasPrefix(source.LyricURL, "https://") {
-					lyricURL = scheme + "://" + r.Host + "/url/https/" + url.QueryEscape(strings.TrimPrefix(source.LyricURL, "https://"))
-				} else {
-					lyricURL = scheme + "://" + r.Host + "/" + url.QueryEscape(source.LyricURL)
-				}
-				if strings.HasPrefix(source.CoverURL, "http://") {
-					coverURL = scheme + "://" + r.Host + "/url/http/" + url.QueryEscape(strings.TrimPrefix(source.CoverURL, "http://"))
-				} else if strings.HasPrefix(source.CoverURL, "https://") {
-					coverURL = scheme + "://" + r.Host + "/url/https/" + url.QueryEscape(strings.TrimPrefix(source.CoverURL, "https://"))
-				} else {
-					coverURL = scheme + "://" + r.Host + "/" + url.QueryEscape(source.CoverURL)
-				}
-				musicItem = MusicItem{
-					Title:        source.Title,
-					Artist:       source.Artist,
-					AudioURL:     audioURL,
-					AudioFullURL: audioFullURL,
-					M3U8URL:      m3u8URL,
-					LyricURL:     lyricURL,
-					CoverURL:     coverURL,
-					Duration:     source.Duration,
-					FromCache:    false,
-				}
-				found = true
-				break
-			}
-		}
-	}
-
-	// If not found in sources.json, attempt to retrieve from local folder
-	if !found {
-		musicItem = getLocalMusicItem(song, singer)
-		musicItem.FromCache = false
-		if musicItem.Title != "" {
-			if musicItem.AudioURL != "" {
-				musicItem.AudioURL = scheme + "://" + r.Host + musicItem.AudioURL
-			}
-			if musicItem.AudioFullURL != "" {
-				musicItem.AudioFullURL = scheme + "://" + r.Host + musicItem.AudioFullURL
-			}
-			if musicItem.M3U8URL != "" {
-				musicItem.M3U8URL = scheme + "://" + r.Host + musicItem.M3U8URL
-			}
-			if musicItem.LyricURL != "" {
-				musicItem.LyricURL = scheme + "://" + r.Host + musicItem.LyricURL
-			}
-			if musicItem.CoverURL != "" {
-				musicItem.CoverURL = scheme + "://" + r.Host + musicItem.CoverURL
-			}
-			found = true
-		}
+	// On a cache miss, optionally return a job to poll instead of blocking through the fetch
+	if !found && queryParams.Get("async") == "true" {
+		// The job outlives the request, so it must not be cancelled with it
+		job := startFetchJob(context.WithoutCancel(r.Context()), song, singer, queryParams.Get("provider"), queryParams.Get("id"))
+		w.Header().Set("Location", "/api/jobs/"+job.ID)
+		writeJobJSON(w, r, http.StatusAccepted, job)
+		return
 	}
-
-	// If still not found, attempt to retrieve from cache file
 	if !found {
-		fmt.Println("[Info] Reading music from cache.")
-		// Fuzzy matching for singer and song
-		files, err := filepath.Glob("./cache/*.json")
-		if err != nil {
-			fmt.Println("[Error] Error reading cache directory:", err)
+		musicItem, found, err = fetchMusicItem(r, song, singer)
+		if errors.Is(err, ErrQueueFull) {
+			writeQueueFull(w)
 			return
 		}
-		for _, file := range files {
-			if strings.Contains(filepath.Base(file), song) && (singer == "" || strings.Contains(filepath.Base(file), singer)) {
-				musicItem, found = readFromCache(file)
-				if found {
-					if musicItem.AudioURL != "" {
-						musicItem.AudioURL = scheme + "://" + r.Host + musicItem.AudioURL
-					}
-					if musicItem.AudioFullURL != "" {
-						musicItem.AudioFullURL = scheme + "://" + r.Host + musicItem.AudioFullURL
-					}
-					if musicItem.M3U8URL != "" {
-						musicItem.M3U8URL = scheme + "://" + r.Host + musicItem.M3U8URL
-					}
-					if musicItem.LyricURL != "" {
-						musicItem.LyricURL = scheme + "://" + r.Host + musicItem.LyricURL
-					}
-					if musicItem.CoverURL != "" {
-						musicItem.CoverURL = scheme + "://" + r.Host + musicItem.CoverURL
-					}
-					musicItem.FromCache = true
-					break
-				}
-			}
-		}
-	}
-
-	// If still not found, request and cache the music item in a separate goroutine
-	if !found {
-		fmt.Println("[Info] Updating music item cache from API request.")
-		musicItem = requestAndCacheMusic(song, singer)
-		fmt.Println("[Info] Music item cache updated.")
-		musicItem.FromCache = false
-		musicItem.AudioURL = scheme + "://" + r.Host + musicItem.AudioURL
-		musicItem.AudioFullURL = scheme + "://" + r.Host + musicItem.AudioFullURL
-		musicItem.M3U8URL = scheme + "://" + r.Host + musicItem.M3U8URL
-		musicItem.LyricURL = scheme + "://" + r.Host + musicItem.LyricURL
-		musicItem.CoverURL = scheme + "://" + r.Host + musicItem.CoverURL
-		found = true
 	}
 
 	// If still not found, return an empty MusicItem
@@ -190,21 +69,46 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		musicItem.IP = ip
 	}
 
-	if play == "true" {
-		fmt.Println("Play为true, 返回音频文件。")
-		parsedURL, err := url.Parse(musicItem.AudioURL)
+	// Point the audio and playlist at the transcoding profile of the request or device
+	if musicItem.Title != "" && queryParams.Get("format") == "" {
+		profile, err := selectProfile(r)
 		if err != nil {
-			http.Error(w, "解析路径失败：", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		musicItem, err = applyProfile(r, musicItem, profile)
+		if errors.Is(err, ErrQueueFull) {
+			writeQueueFull(w)
+			return
+		}
+		if err != nil {
+			fmt.Println("[Error] Error applying transcoding profile:", err)
+		}
+	}
 
-		decodedPath, err := url.PathUnescape(parsedURL.Path)
+	// If format is set, decode the audio and stream raw PCM or WAV instead of JSON
+	if queryParams.Get("format") != "" {
+		options, err := parsePCMOptions(queryParams)
 		if err != nil {
-			http.Error(w, "路径解码失败：", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if musicItem.Title == "" {
+			NotFoundHandler(w, r)
+			return
+		}
+		streamPCM(w, r, musicItem, options)
+		return
+	}
 
-		localPath := strings.TrimPrefix(decodedPath, "/")
+	if play == "true" {
+		fmt.Println("Play为true, 返回音频文件。")
+		// Only files inside ./files can be downloaded, whatever the music item points at
+		localPath, ok := getLocalPathFromURL(r, musicItem.AudioURL)
+		if !ok {
+			NotFoundHandler(w, r)
+			return
+		}
 
 		fileName := filepath.Base(localPath)
 		if fileName == "music.mp3" && musicItem.Title != "" {
@@ -222,3 +126,130 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(musicItem)
 }
+
+// Helper function to get the scheme of the request
+func getRequestScheme(r *http.Request) string {
+	if r.TLS == nil {
+		return "http"
+	}
+	return "https"
+}
+
+// Helper function to build the served URL of a sources.json link, proxying remote links through /url/
+func buildSourceURL(r *http.Request, link string) string {
+	base := getRequestScheme(r) + "://" + r.Host
+	if strings.HasPrefix(link, "http://") {
+		return base + "/url/http/" + url.QueryEscape(strings.TrimPrefix(link, "http://"))
+	} else if strings.HasPrefix(link, "https://") {
+		return base + "/url/https/" + url.QueryEscape(strings.TrimPrefix(link, "https://"))
+	}
+	return base + "/" + url.QueryEscape(link)
+}
+
+// Helper function to build a music item from a sources.json entry
+func buildSourceMusicItem(r *http.Request, source MusicItem) MusicItem {
+	return MusicItem{
+		Title:        source.Title,
+		Artist:       source.Artist,
+		Album:        source.Album,
+		AudioURL:     buildSourceURL(r, source.AudioURL),
+		AudioFullURL: buildSourceURL(r, source.AudioFullURL),
+		M3U8URL:      buildSourceURL(r, source.M3U8URL),
+		LyricURL:     buildSourceURL(r, source.LyricURL),
+		CoverURL:     buildSourceURL(r, source.CoverURL),
+		Duration:     source.Duration,
+		FromCache:    false,
+	}
+}
+
+// Helper function to turn the server relative URLs of a music item into absolute URLs
+func absoluteMusicItemURLs(r *http.Request, musicItem MusicItem) MusicItem {
+	base := getRequestScheme(r) + "://" + r.Host
+	if musicItem.AudioURL != "" {
+		musicItem.AudioURL = base + musicItem.AudioURL
+	}
+	if musicItem.AudioFullURL != "" {
+		musicItem.AudioFullURL = base + musicItem.AudioFullURL
+	}
+	if musicItem.M3U8URL != "" {
+		musicItem.M3U8URL = base + musicItem.M3U8URL
+	}
+	if musicItem.LyricURL != "" {
+		musicItem.LyricURL = base + musicItem.LyricURL
+	}
+	if musicItem.CoverURL != "" {
+		musicItem.CoverURL = base + musicItem.CoverURL
+	}
+	return musicItem
+}
+
+// Helper function to resolve a music item through the sources.json, local folder, cache and API chain
+func resolveMusicItem(r *http.Request, song, singer string) (MusicItem, bool, error) {
+	musicItem, found := lookupMusicItem(r, song, singer)
+	if found {
+		return musicItem, true, nil
+	}
+	return fetchMusicItem(r, song, singer)
+}
+
+// Helper function to look up a music item in sources.json, the local folder and the cache
+func lookupMusicItem(r *http.Request, song, singer string) (MusicItem, bool) {
+	musicItem, found := lookupLibraryMusicItem(r, song, singer)
+	// Files added behind the watcher's back are picked up for the next request
+	if !found {
+		refreshLibraryAfterMiss()
+	}
+	return musicItem, found
+}
+
+// Helper function to look up a music item in the library index
+func lookupLibraryMusicItem(r *http.Request, song, singer string) (MusicItem, bool) {
+	// Attempt to retrieve music items from sources.json, then the local folder, then the cache files
+	entry, found := findBestLibraryEntry(song, singer)
+	if !found {
+		return MusicItem{}, false
+	}
+	switch entry.Source {
+	case librarySources:
+		return buildSourceMusicItem(r, entry.Item), true
+	case libraryLocal:
+		// Preparing a local track for streaming continues even if this request goes away
+		musicItem := prepareLocalMusicItem(context.WithoutCancel(r.Context()), entry)
+		musicItem.FromCache = false
+		return absoluteMusicItemURLs(r, musicItem), true
+	}
+	// Broken entries are repaired or dropped before they reach a device
+	musicItem, ok := checkCacheEntry(context.WithoutCancel(r.Context()), entry)
+	if !ok {
+		return MusicItem{}, false
+	}
+	getCacheManager().Touch(entry.Name)
+	musicItem.FromCache = true
+	return absoluteMusicItemURLs(r, musicItem), true
+}
+
+// Helper function to request and cache a music item from the upstream providers
+func fetchMusicItem(r *http.Request, song, singer string) (MusicItem, bool, error) {
+	fmt.Println("[Info] Updating music item cache from API request.")
+	queryParams := r.URL.Query()
+	provider, id := queryParams.Get("provider"), queryParams.Get("id")
+	// Concurrent misses for the same query wait for a single fetch
+	// Other requests may share the fetch, so it must not be cancelled with this request
+	ctx := context.WithoutCancel(r.Context())
+	musicItem, err, shared := requestFlights.DoContext(ctx, requestFlightKey(song, singer)+"\x00"+provider+"\x00"+id, func(ctx context.Context) (MusicItem, error) {
+		if provider != "" && id != "" {
+			// A specific upstream version was picked from the search results
+			return requestAndCacheProviderTrack(ctx, provider, id, song, singer, nil)
+		}
+		return requestAndCacheMusic(ctx, song, singer, nil)
+	}, nil)
+	if shared {
+		fmt.Println("[Info] Shared the result of an in-flight fetch.")
+	}
+	if err != nil {
+		return MusicItem{}, false, err
+	}
+	fmt.Println("[Info] Music item cache updated.")
+	musicItem.FromCache = false
+	return absoluteMusicItemURLs(r, musicItem), true, nil
+}
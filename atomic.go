@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempFilePrefix marks files that are still being written and must not be served.
+const tempFilePrefix = ".tmp-"
+
+// orphanTempAge is how old a temporary file or staging directory must be before the startup cleanup
+// removes it, so an import running next to the server keeps its work in progress.
+const orphanTempAge = time.Hour
+
+// atomicFile is written under a temporary name next to its final path and renamed into place once it is
+// complete and synced, so readers and crashes never see a partial file.
+type atomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// Helper function to create a file that only appears at filePath once it is committed
+func createAtomicFile(filePath string, perm os.FileMode) (*atomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(filePath), tempFilePrefix+filepath.Base(filePath)+"-*")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp creates private files, published files must be readable like the others
+	err = file.Chmod(perm)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &atomicFile{File: file, path: filePath}, nil
+}
+
+// Commit syncs the file to disk and moves it to its final path.
+func (f *atomicFile) Commit() error {
+	if f.done {
+		return fmt.Errorf("%s is already committed or aborted", f.path)
+	}
+	f.done = true
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// Abort removes the temporary file, it does nothing after Commit.
+func (f *atomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// Helper function to write a whole file through a temporary file, like os.WriteFile
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	file, err := createAtomicFile(filePath, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// Helper function to sync a directory, so the renames and removals inside it survive a power loss
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Helper function to sync every file and directory below dir before it is published
+func syncTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = file.Sync()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
+
+// Helper function to tell whether a file or directory name is one this server uses for an unfinished write.
+// Only the exact prefixes are matched, a user's "Live.tmp-edit.flac" is not ours to delete.
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix) || strings.HasPrefix(name, stagingPrefix)
+}
+
+// localTempPatterns are the places inside ./files/music where imports, local transcodes and profile
+// outputs write, relative to the music folder. The user's library is never walked.
+var localTempPatterns = []string{"*", "*/*", "*/profiles/*/*", "*/profiles/*/*/*"}
+
+// Helper function to remove the temporary files and staging directories that an earlier run left behind
+// when it crashed or was killed. The cache folders are searched recursively, the local music folder
+// only where this server writes, and the folders of the root-level JSON files only at the top.
+func cleanupTempFiles() {
+	cutoff := time.Now().Add(-orphanTempAge)
+	removed := 0
+	remove := func(path string, info fs.FileInfo) {
+		if info.ModTime().After(cutoff) {
+			return
+		}
+		if err := os.RemoveAll(path); err != nil {
+			fmt.Printf("[Error] Failed to remove temporary file %s: %v\n", path, err)
+			return
+		}
+		fmt.Printf("[Info] Removed temporary file %s left by an interrupted write\n", path)
+		removed++
+	}
+
+	_, proxyConf := getRemoteHTTPClient()
+	musicDir := filepath.Join(filesRoot.dir, "music")
+	for _, dir := range []string{cacheRoot.dir, filesRoot.dir, proxyConf.cacheDir} {
+		if dir == "" {
+			continue
+		}
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || path == dir {
+				return nil
+			}
+			if d.IsDir() && path == musicDir {
+				return filepath.SkipDir
+			}
+			if !isTempName(d.Name()) {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				remove(path, info)
+			}
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+
+	for _, pattern := range localTempPatterns {
+		paths, _ := filepath.Glob(filepath.Join(musicDir, pattern))
+		for _, path := range paths {
+			if !isTempName(filepath.Base(path)) {
+				continue
+			}
+			if info, err := os.Lstat(path); err == nil {
+				remove(path, info)
+			}
+		}
+	}
+
+	topDirs := map[string]bool{".": true}
+	for _, file := range []string{os.Getenv("PLAYLISTS_FILE"), os.Getenv("CACHE_PINS_FILE")} {
+		if file != "" {
+			topDirs[filepath.Dir(file)] = true
+		}
+	}
+	for dir := range topDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isTempName(entry.Name()) {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				remove(filepath.Join(dir, entry.Name()), info)
+			}
+		}
+	}
+	if removed > 0 {
+		fmt.Printf("[Info] Removed %d temporary files left by interrupted writes\n", removed)
+	}
+}
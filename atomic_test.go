@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupTempFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("PROXY_CACHE_DIR", "")
+	old := time.Now().Add(-2 * orphanTempAge)
+
+	create := func(path string, dir bool) {
+		t.Helper()
+		var err error
+		if dir {
+			err = os.MkdirAll(path, 0755)
+		} else {
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err == nil {
+				err = os.WriteFile(path, []byte("data"), 0644)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed := []string{
+		"cache/.tmp-Alice-Song.json-123",
+		"files/cache/music/.staging-456",
+		"files/cache/music/Alice-Song/.tmp-cover.jpg-789",
+		"files/music/.staging-import",
+		"files/music/Bob-Song/.staging-hls",
+		"files/music/Bob-Song/.tmp-music.m3u8-1",
+		"files/music/Bob-Song/profiles/lofi/.staging-1",
+		"files/music/Bob-Song/profiles/lofi/music_full.flac/.tmp-music.m3u8-2",
+		".tmp-playlists.json-2",
+	}
+	kept := []string{
+		"files/music/Live.tmp-edit.flac",
+		"files/music/album.tmp",
+		"files/music/Bob-Song/take.tmp",
+		"files/music/Album/Disc 1/.tmp-notes.txt",
+		"cache/Alice-Song.json",
+		"playlists.json.tmp",
+	}
+	for _, path := range append(append([]string{}, removed...), kept...) {
+		create(path, filepath.Ext(path) == "" || filepath.Base(path) == "album.tmp")
+	}
+	// Recent temporary files may belong to an import running next to the server
+	recent := "files/cache/music/.staging-recent"
+	if err := os.MkdirAll(recent, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanupTempFiles()
+
+	for _, path := range removed {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+	for _, path := range append(kept, recent) {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bundleFormat is the version of the bundle layout written by this server.
+const bundleFormat = 1
+
+// ErrInvalidBundle is returned for bundles that are damaged or do not match their manifest.
+var ErrInvalidBundle = errors.New("invalid bundle")
+
+// maxBundleManifest limits the size of the manifest read from a bundle.
+const maxBundleManifest = 16 * 1024 * 1024
+
+// Helper function to get the limit on the total size of the files unpacked from a bundle, configured by
+// BUNDLE_MAX_UNPACKED_MB. A small gzip upload can unpack to far more than the disk holds, 0 disables the limit.
+func getBundleMaxUnpacked() int64 {
+	return int64(max(getEnvInt("BUNDLE_MAX_UNPACKED_MB", 4096), 0)) * 1024 * 1024
+}
+
+// BundleEntry is a cache entry packed in a bundle, its cache file and media folder.
+type BundleEntry struct {
+	Name   string          `json:"name"`
+	Title  string          `json:"title"`
+	Artist string          `json:"artist"`
+	Pinned bool            `json:"pinned,omitempty"`
+	Files  []CacheArtifact `json:"files"` // Paths inside the bundle, cache/<name>.json and music/<name>/...
+}
+
+// BundleManifest is the manifest.json at the start of a bundle.
+type BundleManifest struct {
+	Format    int           `json:"format"`
+	Server    string        `json:"server"`
+	CreatedAt time.Time     `json:"created_at"`
+	Entries   []BundleEntry `json:"entries"`
+}
+
+// BundleReport lists what a bundle import did with every entry of the manifest.
+type BundleReport struct {
+	Imported []ImportResult `json:"imported"`
+	Skipped  []ImportResult `json:"skipped"`
+	Failed   []ImportResult `json:"failed"`
+}
+
+// Helper function to map a path inside a bundle to the file it is read from or written to
+func getBundleLocalPath(bundlePath string) (string, error) {
+	if strings.HasPrefix(bundlePath, "cache/") {
+		return cacheRoot.Join(strings.TrimPrefix(bundlePath, "cache/"))
+	}
+	return filesRoot.Join("cache/" + bundlePath)
+}
+
+// Helper function to pick the cache entries to export. Queries are cache names or "<artist> - <title>",
+// matched like song requests; without queries every entry is picked.
+func selectBundleEntries(queries []string, pinnedOnly bool) ([]CacheEntry, []string) {
+	all := map[string]CacheEntry{}
+	var ordered []CacheEntry
+	for _, entry := range getCacheManager().Entries() {
+		if entry.HasJSON && entry.HasMedia {
+			all[entry.Name] = entry
+			ordered = append(ordered, entry)
+		}
+	}
+
+	var selected []CacheEntry
+	var missing []string
+	if len(queries) == 0 {
+		selected = ordered
+	}
+	seen := map[string]bool{}
+	for _, query := range queries {
+		name := strings.TrimSuffix(query, ".json")
+		if _, ok := all[name]; !ok {
+			artist, title := splitDisplayName(query)
+			name = ""
+			if found := findLibraryEntries(libraryCache, title, artist, 1); len(found) > 0 {
+				name = strings.TrimSuffix(found[0].Name, ".json")
+			}
+		}
+		entry, ok := all[name]
+		if !ok {
+			missing = append(missing, query)
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			selected = append(selected, entry)
+		}
+	}
+
+	if pinnedOnly {
+		var pinned []CacheEntry
+		for _, entry := range selected {
+			if entry.Pinned {
+				pinned = append(pinned, entry)
+			}
+		}
+		selected = pinned
+	}
+	return selected, missing
+}
+
+// Helper function to list the files of a cache entry with their checksums, refusing broken entries
+func collectBundleEntry(entry CacheEntry) (BundleEntry, error) {
+	result, data := verifyCacheEntry(context.Background(), entry.Name, false)
+	if !result.healthy() {
+		return BundleEntry{}, fmt.Errorf("broken: %s", strings.Join(result.Problems, "; "))
+	}
+	bundleEntry := BundleEntry{Name: entry.Name, Title: data.Title, Artist: data.Artist, Pinned: entry.Pinned}
+	add := func(bundlePath, filePath string) error {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(filePath)
+		if err != nil {
+			return err
+		}
+		bundleEntry.Files = append(bundleEntry.Files, CacheArtifact{File: bundlePath, Size: info.Size(), SHA256: sum})
+		return nil
+	}
+
+	cacheFile, err := cacheRoot.Join(entry.Name + ".json")
+	if err != nil {
+		return BundleEntry{}, err
+	}
+	if err := add("cache/"+entry.Name+".json", cacheFile); err != nil {
+		return BundleEntry{}, err
+	}
+	mediaDir, err := getCacheMediaDir(entry.Name)
+	if err != nil {
+		return BundleEntry{}, err
+	}
+	err = filepath.WalkDir(mediaDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath != mediaDir && isTempName(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(mediaDir, filePath)
+		if err != nil {
+			return err
+		}
+		return add("music/"+entry.Name+"/"+filepath.ToSlash(rel), filePath)
+	})
+	if err != nil {
+		return BundleEntry{}, err
+	}
+	return bundleEntry, nil
+}
+
+// Helper function to write a tar.gz bundle of cache entries, the manifest first
+func writeBundle(w io.Writer, entries []CacheEntry) (BundleManifest, error) {
+	manifest := BundleManifest{Format: bundleFormat, Server: TAG, CreatedAt: time.Now(), Entries: []BundleEntry{}}
+	for _, entry := range entries {
+		bundleEntry, err := collectBundleEntry(entry)
+		if err != nil {
+			fmt.Printf("[Warning] Leaving %s out of the bundle: %v\n", entry.Name, err)
+			continue
+		}
+		manifest.Entries = append(manifest.Entries, bundleEntry)
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	err = tarWriter.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifestData)), ModTime: manifest.CreatedAt})
+	if err == nil {
+		_, err = tarWriter.Write(manifestData)
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	for _, entry := range manifest.Entries {
+		for _, file := range entry.Files {
+			localPath, err := getBundleLocalPath(file.File)
+			if err != nil {
+				return manifest, err
+			}
+			err = writeBundleFile(tarWriter, file, localPath)
+			if err != nil {
+				return manifest, fmt.Errorf("error adding %s: %w", file.File, err)
+			}
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gzipWriter.Close()
+}
+
+// Helper function to add a file to a bundle with the size recorded in the manifest
+func writeBundleFile(tarWriter *tar.Writer, file CacheArtifact, localPath string) error {
+	in, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	err = tarWriter.WriteHeader(&tar.Header{Name: file.File, Mode: 0644, Size: file.Size, ModTime: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	// A file that changed since it was hashed fails here or at the checksum check of the import
+	_, err = io.CopyN(tarWriter, in, file.Size)
+	return err
+}
+
+// Helper function to check that a path from a bundle fits the bundle layout
+func checkBundlePath(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(name, "./"))
+	parts := strings.Split(cleaned, "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || isTempName(part) {
+			return "", fmt.Errorf("invalid path %q", name)
+		}
+	}
+	switch {
+	case cleaned == "manifest.json":
+	case len(parts) == 2 && parts[0] == "cache" && strings.HasSuffix(parts[1], ".json"):
+	case len(parts) >= 3 && parts[0] == "music":
+	default:
+		return "", fmt.Errorf("unexpected path %q", name)
+	}
+	return cleaned, nil
+}
+
+// Helper function to unpack a bundle into a staging directory, returning its manifest and the size and
+// checksum of every file it held. The files together may not be larger than maxSize bytes, 0 for no limit.
+func unpackBundle(r io.Reader, stagingDir string, maxSize int64) (*BundleManifest, map[string]CacheArtifact, error) {
+	reader := bufio.NewReader(r)
+	var source io.Reader = reader
+	// Plain tar files are accepted as well
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gzipReader.Close()
+		source = gzipReader
+	}
+
+	var manifest *BundleManifest
+	received := map[string]CacheArtifact{}
+	var unpacked int64
+	tarReader := tar.NewReader(source)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, nil, fmt.Errorf("unsupported entry %q, only regular files are allowed", header.Name)
+		}
+		name, err := checkBundlePath(header.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := received[name]; ok || (name == "manifest.json" && manifest != nil) {
+			return nil, nil, fmt.Errorf("duplicate entry %q", name)
+		}
+
+		if name == "manifest.json" {
+			manifest = &BundleManifest{}
+			if err := json.NewDecoder(io.LimitReader(tarReader, maxBundleManifest)).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("invalid manifest: %w", err)
+			}
+			continue
+		}
+
+		target := filepath.Join(stagingDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, nil, err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		hash := sha256.New()
+		var body io.Reader = tarReader
+		if maxSize > 0 {
+			// The header size is not trusted, the copy stops one byte past the limit
+			body = io.LimitReader(tarReader, maxSize-unpacked+1)
+		}
+		size, err := io.Copy(io.MultiWriter(out, hash), body)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error unpacking %s: %w", name, err)
+		}
+		unpacked += size
+		if maxSize > 0 && unpacked > maxSize {
+			return nil, nil, fmt.Errorf("the bundle unpacks to more than %d MB", maxSize/1024/1024)
+		}
+		received[name] = CacheArtifact{File: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("the bundle has no manifest.json")
+	}
+	if manifest.Format < 1 || manifest.Format > bundleFormat {
+		return nil, nil, fmt.Errorf("unsupported bundle format %d", manifest.Format)
+	}
+	return manifest, received, nil
+}
+
+// Helper function to check an entry of a bundle manifest against the files that were unpacked
+func checkBundleEntry(entry BundleEntry, received map[string]CacheArtifact) error {
+	if entry.Name == "" || entry.Name != safeFileName(entry.Name) || isTempName(entry.Name) || strings.HasPrefix(entry.Name, ".") {
+		return fmt.Errorf("invalid entry name")
+	}
+	cacheFile := "cache/" + entry.Name + ".json"
+	hasCacheFile, hasMedia := false, false
+	for _, file := range entry.Files {
+		switch {
+		case file.File == cacheFile:
+			hasCacheFile = true
+		case strings.HasPrefix(file.File, "music/"+entry.Name+"/"):
+			hasMedia = true
+		default:
+			return fmt.Errorf("%s does not belong to the entry", file.File)
+		}
+		got, ok := received[file.File]
+		switch {
+		case !ok:
+			return fmt.Errorf("%s is missing from the bundle", file.File)
+		case got.Size != file.Size:
+			return fmt.Errorf("%s has %d bytes, expected %d", file.File, got.Size, file.Size)
+		case got.SHA256 != file.SHA256:
+			return fmt.Errorf("%s does not match its checksum", file.File)
+		}
+	}
+	if !hasCacheFile || !hasMedia {
+		return fmt.Errorf("the entry needs its cache file and media folder")
+	}
+	return nil
+}
+
+// Helper function to move a verified bundle entry into the cache, pointing its links at this server
+func mergeBundleEntry(stagingDir string, entry BundleEntry, overwrite bool) (string, error) {
+	cacheFile, err := cacheRoot.Join(entry.Name + ".json")
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(cacheFile); err == nil && !overwrite {
+		return "already cached", nil
+	}
+	finalDir, err := getCacheMediaDir(entry.Name)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := readCacheFileData(filepath.Join(stagingDir, "cache", entry.Name+".json"))
+	if err != nil {
+		return "", fmt.Errorf("invalid cache file: %w", err)
+	}
+	if safeFileName(data.Artist+"-"+data.Title) != entry.Name {
+		return "", fmt.Errorf("the cache file is for %s - %s, not %s", data.Artist, data.Title, entry.Name)
+	}
+
+	// Links point into this server's cache, whatever host or folder the exporting server used
+	musicItem := data.MusicItem
+	musicItem.FromCache, musicItem.IP = false, ""
+	baseURL := "/files/cache/music/" + url.QueryEscape(entry.Name)
+	for field, file := range getCacheItemFiles(musicItem) {
+		link := baseURL + "/" + file
+		switch field {
+		case "audio_full_url":
+			musicItem.AudioFullURL = link
+		case "audio_url":
+			musicItem.AudioURL = link
+		case "m3u8_url":
+			musicItem.M3U8URL = link
+		case "cover_url":
+			musicItem.CoverURL = link
+		case "lyric_url":
+			musicItem.LyricURL = link
+		}
+	}
+
+	_, err, _ = trackFlights.Do(finalDir, func() (MusicItem, error) {
+		return MusicItem{}, publishStagingDir(filepath.Join(stagingDir, "music", entry.Name), finalDir)
+	})
+	if err != nil {
+		return "", err
+	}
+	var provider, id string
+	if data.Integrity != nil {
+		provider, id = data.Integrity.Provider, data.Integrity.ID
+	}
+	if err := writeCacheFile(musicItem, provider, id); err != nil {
+		os.RemoveAll(finalDir)
+		return "", err
+	}
+
+	// The merged entry must pass the same check as any other before it is kept
+	if result, _ := verifyCacheEntry(context.Background(), entry.Name, false); !result.healthy() {
+		getCacheManager().remove(CacheEntry{Name: entry.Name, HasJSON: true, HasMedia: true})
+		return "", fmt.Errorf("broken after import: %s", strings.Join(result.Problems, "; "))
+	}
+	if entry.Pinned {
+		if err := getCacheManager().Pin(entry.Name, true); err != nil {
+			fmt.Printf("[Error] Failed to pin imported cache entry %s: %v\n", entry.Name, err)
+		}
+	}
+	return "", nil
+}
+
+// Helper function to verify a bundle and merge its entries into the cache and the library index.
+// A bundle that does not match its manifest is rejected as a whole.
+func importBundle(r io.Reader, overwrite bool) (BundleReport, error) {
+	report := BundleReport{Imported: []ImportResult{}, Skipped: []ImportResult{}, Failed: []ImportResult{}}
+	err := os.MkdirAll(cacheRoot.dir, 0755)
+	if err != nil {
+		return report, err
+	}
+	stagingDir, err := createStagingDir(filepath.Join(filesRoot.dir, "cache", "music", "bundle"))
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	manifest, received, err := unpackBundle(r, stagingDir, getBundleMaxUnpacked())
+	if err != nil {
+		return report, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	listed := map[string]bool{}
+	for _, entry := range manifest.Entries {
+		for _, file := range entry.Files {
+			listed[file.File] = true
+		}
+	}
+	for name := range received {
+		if !listed[name] {
+			return report, fmt.Errorf("%w: %s is not in the manifest", ErrInvalidBundle, name)
+		}
+	}
+	fmt.Printf("[Info] Importing bundle of %d entries from %s, created %s\n", len(manifest.Entries), manifest.Server, manifest.CreatedAt.Format(time.RFC3339))
+
+	for _, entry := range manifest.Entries {
+		result := ImportResult{File: entry.Name}
+		if err := checkBundleEntry(entry, received); err != nil {
+			result.Reason = err.Error()
+			report.Failed = append(report.Failed, result)
+			continue
+		}
+		reason, err := mergeBundleEntry(stagingDir, entry, overwrite)
+		switch {
+		case err != nil:
+			result.Reason = err.Error()
+			report.Failed = append(report.Failed, result)
+		case reason != "":
+			result.Reason = reason
+			report.Skipped = append(report.Skipped, result)
+		default:
+			result.Target = "cache/" + entry.Name + ".json"
+			report.Imported = append(report.Imported, result)
+		}
+	}
+	return report, nil
+}
+
+// Helper function to print a bundle import report
+func printBundleReport(report BundleReport) {
+	for _, result := range report.Imported {
+		fmt.Printf("[Info] Imported %s -> %s\n", result.File, result.Target)
+	}
+	for _, result := range report.Skipped {
+		fmt.Printf("[Warning] Skipped %s: %s\n", result.File, result.Reason)
+	}
+	for _, result := range report.Failed {
+		fmt.Printf("[Error] Failed to import %s: %s\n", result.File, result.Reason)
+	}
+	fmt.Printf("[Info] Bundle import finished: %d imported, %d skipped, %d failed\n", len(report.Imported), len(report.Skipped), len(report.Failed))
+}
+
+// Helper function to import a bundle file from the import subcommand, returning the process exit code
+func runBundleImport(file string, overwrite bool) int {
+	in, err := os.Open(file)
+	if err != nil {
+		fmt.Println("[Error] Failed to open bundle:", err)
+		return 1
+	}
+	defer in.Close()
+	report, err := importBundle(in, overwrite)
+	printBundleReport(report)
+	closeLibrary()
+	if err != nil {
+		fmt.Println("[Error] Bundle import failed:", err)
+		return 1
+	}
+	if len(report.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Helper function to run the export subcommand, returning the process exit code
+func runExportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "", "bundle file to write (default meow-cache-<date>.tar.gz)")
+	pinnedOnly := flags.Bool("pinned", false, "only export pinned entries")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s export [-o bundle.tar.gz] [-pinned] [name or \"artist - title\" ...]\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *output == "" {
+		*output = "meow-cache-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	}
+	defer closeLibrary()
+
+	entries, missing := selectBundleEntries(flags.Args(), *pinnedOnly)
+	for _, query := range missing {
+		fmt.Printf("[Warning] No cache entry found for %s\n", query)
+	}
+	if len(entries) == 0 {
+		fmt.Println("[Error] Nothing to export")
+		return 1
+	}
+
+	out, err := createAtomicFile(*output, 0644)
+	if err != nil {
+		fmt.Println("[Error] Failed to create bundle:", err)
+		return 1
+	}
+	defer out.Abort()
+	manifest, err := writeBundle(out, entries)
+	if err == nil {
+		err = out.Commit()
+	}
+	if err != nil {
+		fmt.Println("[Error] Failed to write bundle:", err)
+		return 1
+	}
+	fmt.Printf("[Info] Exported %d cache entries to %s\n", len(manifest.Entries), *output)
+	return 0
+}
+
+// bundleHandler handles the admin bundle endpoints:
+//
+//	GET  /api/admin/bundle?name=&q=&pinned=true  download a bundle of the chosen entries, all by default
+//	POST /api/admin/bundle?overwrite=true        verify an uploaded bundle and merge it into the cache
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "MeowMusicEmbeddedServer")
+	fmt.Printf("[Web Access] Handling request for %s %s\n", r.Method, r.URL.Path)
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		entries, missing := selectBundleEntries(append(query["name"], query["q"]...), query.Get("pinned") == "true")
+		if len(missing) > 0 {
+			http.Error(w, "no cache entry found for "+strings.Join(missing, ", "), http.StatusNotFound)
+			return
+		}
+		if len(entries) == 0 {
+			http.Error(w, "nothing to export", http.StatusNotFound)
+			return
+		}
+		fileName := "meow-cache-" + time.Now().Format("20060102-150405") + ".tar.gz"
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
+		manifest, err := writeBundle(w, entries)
+		if err != nil {
+			// The status is already sent, the broken download fails the checksum check on import
+			fmt.Println("[Error] Failed to write bundle:", err)
+			return
+		}
+		fmt.Printf("[Info] Exported %d cache entries to %s\n", len(manifest.Entries), r.RemoteAddr)
+
+	case http.MethodPost:
+		report, err := importBundle(r.Body, r.URL.Query().Get("overwrite") == "true")
+		printBundleReport(report)
+		if err != nil {
+			fmt.Println("[Error] Bundle import failed:", err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrInvalidBundle) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(report)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBundleFile is an entry of a tar file built by a test.
+type testBundleFile struct {
+	name     string
+	body     string
+	typeflag byte
+	linkname string
+}
+
+// Helper function to build a bundle from tar entries, gzipped unless plain is set
+func buildTestBundle(t *testing.T, files []testBundleFile, plain bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var gzipWriter *gzip.Writer
+	if !plain {
+		gzipWriter = gzip.NewWriter(&buf)
+		out = gzipWriter
+	}
+	tarWriter := tar.NewWriter(out)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.body)), Typeflag: file.typeflag, Linkname: file.linkname}
+		if file.typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(file.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Helper function to describe a file the way a bundle manifest does
+func testArtifact(name, body string) CacheArtifact {
+	sum := sha256.Sum256([]byte(body))
+	return CacheArtifact{File: name, Size: int64(len(body)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// Helper function to build the manifest.json entry of a bundle
+func testManifestFile(t *testing.T, entries ...BundleEntry) testBundleFile {
+	t.Helper()
+	data, err := json.Marshal(BundleManifest{Format: bundleFormat, Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testBundleFile{name: "manifest.json", body: string(data)}
+}
+
+func TestCheckBundlePath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"manifest.json", "manifest.json"},
+		{"./manifest.json", "manifest.json"},
+		{"cache/Alice-Song.json", "cache/Alice-Song.json"},
+		{"music/Alice-Song/music.mp3", "music/Alice-Song/music.mp3"},
+		{"music/Alice-Song/hls/music_000.ts", "music/Alice-Song/hls/music_000.ts"},
+		{"../manifest.json", ""},
+		{"cache/../../etc/passwd", ""},
+		{"music/../../cache/x.json", ""},
+		{"/etc/passwd", ""},
+		{"/cache/Alice-Song.json", ""},
+		{"music/.tmp-123/music.mp3", ""},
+		{"music/Alice-Song/.staging-1/music.mp3", ""},
+		{"cache/.tmp-Alice-Song.json", ""},
+		{"cache/Alice-Song.txt", ""},
+		{"cache/sub/Alice-Song.json", ""},
+		{"music/Alice-Song", ""},
+		{"files/music/Alice-Song/music.mp3", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got, err := checkBundlePath(test.name)
+		if test.want == "" && err == nil {
+			t.Errorf("checkBundlePath(%q) = %q, want an error", test.name, got)
+		}
+		if test.want != "" && (err != nil || got != test.want) {
+			t.Errorf("checkBundlePath(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestUnpackBundle(t *testing.T) {
+	entry := BundleEntry{Name: "Alice-Song", Files: []CacheArtifact{
+		testArtifact("cache/Alice-Song.json", "{}"),
+		testArtifact("music/Alice-Song/music.mp3", "audio"),
+	}}
+	valid := []testBundleFile{
+		testManifestFile(t, entry),
+		{name: "music/", typeflag: tar.TypeDir},
+		{name: "cache/Alice-Song.json", body: "{}"},
+		{name: "music/Alice-Song/music.mp3", body: "audio"},
+	}
+	for _, plain := range []bool{false, true} {
+		stagingDir := t.TempDir()
+		manifest, received, err := unpackBundle(bytes.NewReader(buildTestBundle(t, valid, plain)), stagingDir, 0)
+		if err != nil {
+			t.Fatalf("plain %v: %v", plain, err)
+		}
+		if len(manifest.Entries) != 1 || received["music/Alice-Song/music.mp3"] != entry.Files[1] {
+			t.Errorf("plain %v: got %+v, %+v", plain, manifest, received)
+		}
+		if data, err := os.ReadFile(filepath.Join(stagingDir, "music", "Alice-Song", "music.mp3")); err != nil || string(data) != "audio" {
+			t.Errorf("plain %v: unpacked %q, %v", plain, data, err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		files []testBundleFile
+		want  string
+	}{
+		{"symlink", append(valid[:1:1], testBundleFile{name: "music/Alice-Song/music.mp3", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}), "only regular files"},
+		{"hardlink", append(valid[:1:1], testBundleFile{name: "music/Alice-Song/music.mp3", typeflag: tar.TypeLink, linkname: "../../../etc/passwd"}), "only regular files"},
+		{"parent path", append(valid[:1:1], testBundleFile{name: "../cache/Alice-Song.json", body: "{}"}), "invalid path"},
+		{"absolute path", append(valid[:1:1], testBundleFile{name: "/cache/Alice-Song.json", body: "{}"}), "invalid path"},
+		{"temp path", append(valid[:1:1], testBundleFile{name: "music/.staging-x/music.mp3", body: "audio"}), "invalid path"},
+		{"duplicate file", append(valid, testBundleFile{name: "music/Alice-Song/music.mp3", body: "other"}), "duplicate entry"},
+		{"duplicate file through another spelling", append(valid, testBundleFile{name: "./music/Alice-Song/music.mp3", body: "other"}), "duplicate entry"},
+		{"duplicate manifest", append(valid, testManifestFile(t)), "duplicate entry"},
+		{"no manifest", valid[1:], "no manifest.json"},
+		{"future format", []testBundleFile{{name: "manifest.json", body: `{"format": 99}`}}, "unsupported bundle format"},
+		{"broken manifest", []testBundleFile{{name: "manifest.json", body: `{"format":`}}, "invalid manifest"},
+	}
+	for _, test := range tests {
+		_, _, err := unpackBundle(bytes.NewReader(buildTestBundle(t, test.files, false)), t.TempDir(), 0)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestUnpackBundleSizeLimit(t *testing.T) {
+	// Zeros compress about a thousandfold, like a gzip bomb
+	big := strings.Repeat("\x00", 3*1024*1024)
+	files := []testBundleFile{
+		testManifestFile(t),
+		{name: "music/Alice-Song/music.mp3", body: big[:1024*1024]},
+		{name: "music/Alice-Song/music.flac", body: big},
+	}
+	data := buildTestBundle(t, files, false)
+	if len(data) > 64*1024 {
+		t.Fatalf("the test bundle is %d bytes, not a small upload", len(data))
+	}
+	stagingDir := t.TempDir()
+	_, _, err := unpackBundle(bytes.NewReader(data), stagingDir, 2*1024*1024)
+	if err == nil || !strings.Contains(err.Error(), "more than 2 MB") {
+		t.Fatalf("got %v, want the size limit", err)
+	}
+	// The copy stops right past the limit
+	if info, err := os.Stat(filepath.Join(stagingDir, "music", "Alice-Song", "music.flac")); err != nil {
+		t.Error(err)
+	} else if info.Size() > 1024*1024+1 {
+		t.Errorf("unpacked %d bytes past the limit", info.Size()-1024*1024)
+	}
+	if _, _, err := unpackBundle(bytes.NewReader(data), t.TempDir(), 4*1024*1024); err != nil {
+		t.Errorf("a bundle within the limit failed: %v", err)
+	}
+}
+
+func TestCheckBundleEntry(t *testing.T) {
+	received := map[string]CacheArtifact{}
+	for _, artifact := range []CacheArtifact{
+		testArtifact("cache/Alice-Song.json", "{}"),
+		testArtifact("music/Alice-Song/music.mp3", "audio"),
+		testArtifact("music/Bob-Song/music.mp3", "other"),
+	} {
+		received[artifact.File] = artifact
+	}
+	files := []CacheArtifact{received["cache/Alice-Song.json"], received["music/Alice-Song/music.mp3"]}
+	tests := []struct {
+		name  string
+		entry BundleEntry
+		want  string
+	}{
+		{"valid", BundleEntry{Name: "Alice-Song", Files: files}, ""},
+		{"parent name", BundleEntry{Name: "..", Files: files}, "invalid entry name"},
+		{"path name", BundleEntry{Name: "../Alice-Song", Files: files}, "invalid entry name"},
+		{"temp name", BundleEntry{Name: ".tmp-Alice-Song", Files: files}, "invalid entry name"},
+		{"empty name", BundleEntry{Files: files}, "invalid entry name"},
+		{"checksum mismatch", BundleEntry{Name: "Alice-Song", Files: []CacheArtifact{files[0], {File: files[1].File, Size: files[1].Size, SHA256: testArtifact("", "AUDIO").SHA256}}}, "does not match its checksum"},
+		{"size mismatch", BundleEntry{Name: "Alice-Song", Files: []CacheArtifact{files[0], {File: files[1].File, Size: 99, SHA256: files[1].SHA256}}}, "has 5 bytes, expected 99"},
+		{"missing file", BundleEntry{Name: "Alice-Song", Files: append(files, testArtifact("music/Alice-Song/cover.jpg", "jpg"))}, "missing from the bundle"},
+		{"file of another entry", BundleEntry{Name: "Alice-Song", Files: append(files, received["music/Bob-Song/music.mp3"])}, "does not belong to the entry"},
+		{"no media", BundleEntry{Name: "Alice-Song", Files: files[:1]}, "needs its cache file and media folder"},
+		{"no cache file", BundleEntry{Name: "Alice-Song", Files: files[1:]}, "needs its cache file and media folder"},
+	}
+	for _, test := range tests {
+		err := checkBundleEntry(test.entry, received)
+		if test.want == "" && err != nil || test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestImportBundleRejectsFilesOutsideManifest(t *testing.T) {
+	t.Chdir(t.TempDir())
+	entry := BundleEntry{Name: "Alice-Song", Files: []CacheArtifact{
+		testArtifact("cache/Alice-Song.json", "{}"),
+		testArtifact("music/Alice-Song/music.mp3", "audio"),
+	}}
+	data := buildTestBundle(t, []testBundleFile{
+		testManifestFile(t, entry),
+		{name: "cache/Alice-Song.json", body: "{}"},
+		{name: "music/Alice-Song/music.mp3", body: "audio"},
+		{name: "music/Bob-Song/music.mp3", body: "unlisted"},
+	}, false)
+	report, err := importBundle(bytes.NewReader(data), false)
+	if !errors.Is(err, ErrInvalidBundle) || !strings.Contains(err.Error(), "music/Bob-Song/music.mp3 is not in the manifest") {
+		t.Fatalf("got %v, want the unlisted file rejected", err)
+	}
+	if len(report.Imported) != 0 {
+		t.Errorf("imported %+v from a rejected bundle", report.Imported)
+	}
+	// Nothing of the bundle is left behind
+	for _, dir := range []string{"cache", filepath.Join("files", "cache", "music")} {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 0 {
+			t.Errorf("%s holds %d files after the rejected import", dir, len(entries))
+		}
+	}
+}
+
+func TestBundleHandlerRejectsOversizedUpload(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("ADMIN_TOKEN", "secret")
+	t.Setenv("BUNDLE_MAX_UNPACKED_MB", "1")
+	data := buildTestBundle(t, []testBundleFile{
+		testManifestFile(t),
+		{name: "music/Alice-Song/music.mp3", body: strings.Repeat("\x00", 2*1024*1024)},
+	}, false)
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/bundle", bytes.NewReader(data))
+	req.Header.Set("X-Admin-Token", "secret")
+	rec := httptest.NewRecorder()
+	bundleHandler(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "more than 1 MB") {
+		t.Errorf("got %d %q, want 400 for the size limit", rec.Code, rec.Body.String())
+	}
+}
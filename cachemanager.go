@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// cacheEvictionGrace keeps entries that were just fetched or served out of eviction, so a song is
+// never removed while a device is still downloading it.
+const cacheEvictionGrace = 5 * time.Minute
+
+// cacheConfig holds the cache limits read from CACHE_MAX_SIZE_MB, CACHE_MAX_AGE_HOURS,
+// CACHE_CHECK_INTERVAL and CACHE_PINS_FILE.
+type cacheConfig struct {
+	maxSize  int64         // Bytes, 0 disables the size quota
+	maxAge   time.Duration // Time since the last access, 0 disables expiry
+	interval time.Duration
+	pinsFile string
+}
+
+// CacheEntry is a cached song: the JSON file in ./cache and its media folder in ./files/cache/music.
+type CacheEntry struct {
+	Name       string    `json:"name"` // safeFileName of "<artist>-<title>", shared by the file and the folder
+	Title      string    `json:"title,omitempty"`
+	Artist     string    `json:"artist,omitempty"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+	Pinned     bool      `json:"pinned"`
+	HasJSON    bool      `json:"has_json"`
+	HasMedia   bool      `json:"has_media"`
+}
+
+// cacheManager evicts cache entries by age and size and tracks when they were last served.
+type cacheManager struct {
+	config  cacheConfig
+	mu      sync.Mutex
+	access  map[string]time.Time // Accesses not yet written to the library index
+	pins    map[string]bool
+	evictMu sync.Mutex // Only one eviction pass runs at a time
+	wake    chan struct{}
+}
+
+var (
+	cacheMgr     *cacheManager
+	cacheMgrOnce sync.Once
+)
+
+// Helper function to get the cache manager, loading the pinned entries on first use
+func getCacheManager() *cacheManager {
+	cacheMgrOnce.Do(func() {
+		pinsFile := os.Getenv("CACHE_PINS_FILE")
+		if pinsFile == "" {
+			pinsFile = "./pins.json"
+		}
+		cacheMgr = &cacheManager{
+			config: cacheConfig{
+				maxSize:  int64(getEnvInt("CACHE_MAX_SIZE_MB", 0)) * 1024 * 1024,
+				maxAge:   time.Duration(getEnvInt("CACHE_MAX_AGE_HOURS", 0)) * time.Hour,
+				interval: time.Duration(getEnvInt("CACHE_CHECK_INTERVAL", 10)) * time.Minute,
+				pinsFile: pinsFile,
+			},
+			access: map[string]time.Time{},
+			pins:   map[string]bool{},
+			wake:   make(chan struct{}, 1),
+		}
+		if cacheMgr.config.interval <= 0 {
+			cacheMgr.config.interval = 10 * time.Minute
+		}
+
+		data, err := os.ReadFile(pinsFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Println("[Error] Failed to read cache pins file:", err)
+			}
+			return
+		}
+		var names []string
+		if err := json.Unmarshal(data, &names); err != nil {
+			fmt.Println("[Error] Failed to parse cache pins file:", err)
+			return
+		}
+		for _, name := range names {
+			cacheMgr.pins[name] = true
+		}
+	})
+	return cacheMgr
+}
+
+// Helper function to start the periodic cache eviction, if a size quota or maximum age is configured
+func startCacheManager() {
+	m := getCacheManager()
+	if m.config.maxSize <= 0 && m.config.maxAge <= 0 {
+		return
+	}
+	fmt.Printf("[Info] Cache limits: %d MB, %s since last access, checked every %s\n", m.config.maxSize/1024/1024, m.config.maxAge, m.config.interval)
+	go func() {
+		ticker := time.NewTicker(m.config.interval)
+		defer ticker.Stop()
+		for {
+			m.Evict()
+			select {
+			case <-ticker.C:
+			case <-m.wake:
+			}
+		}
+	}()
+}
+
+// Helper function to write the pending access times on shutdown, before the library index is closed
+func stopCacheManager() {
+	if cacheMgr != nil {
+		cacheMgr.flushAccess()
+	}
+}
+
+// Helper function to ask for an eviction pass after the cache has grown, without waiting for it
+func notifyCacheChanged() {
+	m := getCacheManager()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Helper function to get the cache name of a file served from ./files/cache/music, or "" for other files
+func cacheNameFromFilePath(filePath string) string {
+	rel, err := filepath.Rel(filepath.Join(filesRoot.dir, "cache", "music"), filePath)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	name, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return name
+}
+
+// Touch records that a cache entry was served.
+func (m *cacheManager) Touch(name string) {
+	name = strings.TrimSuffix(name, ".json")
+	if name == "" {
+		return
+	}
+	m.mu.Lock()
+	m.access[name] = time.Now()
+	m.mu.Unlock()
+}
+
+// Helper function to write the pending access times to the library index
+func (m *cacheManager) flushAccess() {
+	lib := getLibrary()
+	if lib == nil {
+		// Without an index the access times only live in memory
+		return
+	}
+	m.mu.Lock()
+	pending := m.access
+	m.access = map[string]time.Time{}
+	m.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	err := lib.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(libraryAccessBucket)
+		for name, accessed := range pending {
+			if err := bucket.Put([]byte(name), []byte(strconv.FormatInt(accessed.UnixNano(), 10))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("[Error] Failed to save cache access times:", err)
+	}
+}
+
+// Helper function to get the recorded access time of every cache entry
+func (m *cacheManager) accessTimes() map[string]time.Time {
+	m.flushAccess()
+	times := map[string]time.Time{}
+	if lib := getLibrary(); lib != nil {
+		lib.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(libraryAccessBucket).ForEach(func(key, value []byte) error {
+				if nanos, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+					times[string(key)] = time.Unix(0, nanos)
+				}
+				return nil
+			})
+		})
+	}
+	m.mu.Lock()
+	for name, accessed := range m.access {
+		times[name] = accessed
+	}
+	m.mu.Unlock()
+	return times
+}
+
+// Helper function to get the total size and newest modification time of the files in a folder
+func measureDir(dir string) (int64, time.Time) {
+	var size int64
+	var newest time.Time
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			size += info.Size()
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return size, newest
+}
+
+// Entries lists the cache entries, least recently used first. Entries never served since they were
+// written count from the time their files were last changed.
+func (m *cacheManager) Entries() []CacheEntry {
+	entries := map[string]*CacheEntry{}
+	modTimes := map[string]time.Time{}
+	get := func(name string) *CacheEntry {
+		entry, ok := entries[name]
+		if !ok {
+			entry = &CacheEntry{Name: name}
+			entries[name] = entry
+		}
+		return entry
+	}
+
+	files, err := filepath.Glob(filepath.Join(cacheRoot.dir, "*.json"))
+	if err != nil {
+		fmt.Println("[Error] Error reading cache directory:", err)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		entry := get(strings.TrimSuffix(filepath.Base(file), ".json"))
+		entry.HasJSON = true
+		entry.Size += info.Size()
+		if info.ModTime().After(modTimes[entry.Name]) {
+			modTimes[entry.Name] = info.ModTime()
+		}
+		if musicItem, ok := readFromCache(file); ok {
+			entry.Title, entry.Artist = musicItem.Title, musicItem.Artist
+		}
+	}
+
+	musicDir := filepath.Join(filesRoot.dir, "cache", "music")
+	dirs, err := os.ReadDir(musicDir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("[Error] Error reading cached music directory:", err)
+	}
+	for _, dir := range dirs {
+		// Folders still being produced are not part of the cache yet
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		entry := get(dir.Name())
+		entry.HasMedia = true
+		size, modTime := measureDir(filepath.Join(musicDir, dir.Name()))
+		entry.Size += size
+		if modTime.After(modTimes[entry.Name]) {
+			modTimes[entry.Name] = modTime
+		}
+	}
+
+	accessed := m.accessTimes()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]CacheEntry, 0, len(entries))
+	for name, entry := range entries {
+		entry.LastAccess = modTimes[name]
+		if accessed[name].After(entry.LastAccess) {
+			entry.LastAccess = accessed[name]
+		}
+		entry.Pinned = m.pins[name]
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].LastAccess.Equal(list[j].LastAccess) {
+			return list[i].LastAccess.Before(list[j].LastAccess)
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Helper function to remove a cache entry. The JSON file goes first, so the cache never points at
+// media that is already gone.
+func (m *cacheManager) remove(entry CacheEntry) error {
+	if entry.HasJSON {
+		cacheFile, err := cacheRoot.Join(entry.Name + ".json")
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(cacheFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if entry.HasMedia {
+		mediaDir, err := filesRoot.Join("cache/music/" + entry.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(mediaDir); err != nil {
+			return err
+		}
+	}
+	if lib := getLibrary(); lib != nil {
+		lib.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(libraryAccessBucket).Delete([]byte(entry.Name))
+		})
+	}
+	m.mu.Lock()
+	delete(m.access, entry.Name)
+	m.mu.Unlock()
+	return nil
+}
+
+// Evict removes the entries not served within the maximum age, then the least recently used ones
+// until the cache fits its size quota. Pinned entries are never removed.
+func (m *cacheManager) Evict() []CacheEntry {
+	m.evictMu.Lock()
+	defer m.evictMu.Unlock()
+	if m.config.maxSize <= 0 && m.config.maxAge <= 0 {
+		return nil
+	}
+
+	entries := m.Entries()
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	now := time.Now()
+	var removed []CacheEntry
+	evict := func(entry CacheEntry, reason string) {
+		if err := m.remove(entry); err != nil {
+			fmt.Printf("[Error] Failed to evict cache entry %s: %v\n", entry.Name, err)
+			return
+		}
+		fmt.Printf("[Info] Evicted cache entry %s (%d KB, last access %s): %s\n", entry.Name, entry.Size/1024, entry.LastAccess.Format(time.RFC3339), reason)
+		total -= entry.Size
+		removed = append(removed, entry)
+	}
+
+	for _, entry := range entries {
+		if entry.Pinned || now.Sub(entry.LastAccess) < cacheEvictionGrace {
+			continue
+		}
+		switch {
+		case !entry.HasMedia && entry.HasJSON:
+			// A cache file whose media is gone can only produce broken links
+			evict(entry, "media folder missing")
+		case m.config.maxAge > 0 && now.Sub(entry.LastAccess) > m.config.maxAge:
+			evict(entry, "expired")
+		case m.config.maxSize > 0 && total > m.config.maxSize:
+			evict(entry, "over size quota")
+		}
+	}
+	if m.config.maxSize > 0 && total > m.config.maxSize {
+		fmt.Printf("[Warning] Cache still uses %.1f MB of its %d MB quota, the rest is pinned or in use\n", float64(total)/1024/1024, m.config.maxSize/1024/1024)
+	}
+
+	if len(removed) > 0 {
+		fmt.Printf("[Info] Evicted %d cache entries, %.1f MB in use\n", len(removed), float64(total)/1024/1024)
+		if lib := getLibrary(); lib != nil {
+			if err := lib.Refresh(); err != nil {
+				fmt.Println("[Error] Failed to refresh library index:", err)
+			}
+		}
+	}
+	return removed
+}
+
+// Helper function to write the pinned entries to the pins file. The caller holds the lock.
+func (m *cacheManager) savePins() error {
+	names := make([]string, 0, len(m.pins))
+	for name := range m.pins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data, err := json.MarshalIndent(names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.config.pinsFile, data, 0644)
+}
+
+// Pin keeps a cache entry from being evicted, or allows it again.
+func (m *cacheManager) Pin(name string, pinned bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pins[name] == pinned {
+		return nil
+	}
+	if pinned {
+		m.pins[name] = true
+	} else {
+		delete(m.pins, name)
+	}
+	return m.savePins()
+}
+
+// cachePinRequest is the body of a pin request, naming the entry directly or by song and singer.
+type cachePinRequest struct {
+	Name   string `json:"name"`
+	Song   string `json:"song"`
+	Singer string `json:"singer"`
+}
+
+// cacheHandler handles the /api/cache endpoints:
+//
+//	GET    /api/cache             usage, limits and entries, least recently used first
+//	POST   /api/cache/pin         pin an entry given by {"name"} or {"song", "singer"} (admin)
+//	DELETE /api/cache/pin/{name}  unpin an entry (admin)
+//	POST   /api/cache/evict       run an eviction pass now (admin)
+//	POST   /api/cache/verify      check every entry now and repair the broken ones (admin)
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "MeowMusicEmbeddedServer")
+	fmt.Printf("[Web Access] Handling request for %s %s\n", r.Method, r.URL.Path)
+	m := getCacheManager()
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/cache"), "/")
+
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		entries := m.Entries()
+		var total int64
+		for _, entry := range entries {
+			total += entry.Size
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"max_size":      m.config.maxSize,
+			"max_age_hours": int(m.config.maxAge / time.Hour),
+			"total_size":    total,
+			"total":         len(entries),
+			"entries":       entries,
+		})
+
+	case path == "pin" && r.Method == http.MethodPost:
+		if !requireAdmin(w, r) {
+			return
+		}
+		var request cachePinRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&request); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := request.Name
+		if name == "" && request.Song != "" {
+			if found := findLibraryEntries(libraryCache, request.Song, request.Singer, 1); len(found) > 0 {
+				name = found[0].Name
+			}
+		}
+		name = strings.TrimSuffix(name, ".json")
+		if name == "" || name != safeFileName(name) {
+			http.Error(w, "cache entry not found", http.StatusNotFound)
+			return
+		}
+		if err := m.Pin(name, true); err != nil {
+			fmt.Println("[Error] Failed to save cache pins:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("[Info] Pinned cache entry %s\n", name)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "pinned": true})
+
+	case strings.HasPrefix(path, "pin/") && r.Method == http.MethodDelete:
+		if !requireAdmin(w, r) {
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "pin/"), ".json")
+		if err := m.Pin(name, false); err != nil {
+			fmt.Println("[Error] Failed to save cache pins:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("[Info] Unpinned cache entry %s\n", name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case path == "evict" && r.Method == http.MethodPost:
+		if !requireAdmin(w, r) {
+			return
+		}
+		removed := m.Evict()
+		if removed == nil {
+			removed = []CacheEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{"evicted": removed})
+
+	case path == "verify" && r.Method == http.MethodPost:
+		if !requireAdmin(w, r) {
+			return
+		}
+		// ?deep=false skips the checksums and decoding, for a quick check of large caches
+		results := verifyCache(r.Context(), r.URL.Query().Get("deep") != "false")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{"broken": results})
+
+	case path == "" || path == "pin" || path == "evict" || path == "verify" || strings.HasPrefix(path, "pin/"):
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		NotFoundHandler(w, r)
+	}
+}
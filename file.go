@@ -1,7 +1,8 @@
 package main
 
 import (
-	"io"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"os"
@@ -9,46 +10,6 @@ import (
 	"strings"
 )
 
-// ListFiles function: Traverse all files in the specified directory and return a slice of the file path
-func ListFiles(dir string) ([]string, error) {
-	var files []string
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			files = append(files, path)
-		}
-		return nil
-	})
-	return files, err
-}
-
-// Get Content function: Read the content of a specified file and return it
-func GetFileContent(filePath string) ([]byte, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	// Get File Size
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, err
-	}
-	fileSize := fileInfo.Size()
-
-	// Read File Content
-	fileContent := make([]byte, fileSize)
-	_, err = file.Read(fileContent)
-	if err != nil {
-		return nil, err
-	}
-
-	return fileContent, nil
-}
-
 // fileHandler function: Handle file requests
 func fileHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", "MeowMusicEmbeddedServer")
@@ -80,133 +41,94 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 		decodedURL = strings.TrimPrefix(decodedURL, "https/")
 		// Correctly concatenate the protocol with the decoded URL
 		decodedURL = protocol + decodedURL
-		// Create a new HTTP request to the decoded URL, without copying headers
-		req, err := http.NewRequest("GET", decodedURL, nil)
-		if err != nil {
-			NotFoundHandler(w, r)
-			return
-		}
-		// Send the request and get the response
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			NotFoundHandler(w, r)
-			return
-		}
-		defer resp.Body.Close()
-		// Read the response body into a byte slice
-		fileContent, err := io.ReadAll(resp.Body)
-		if err != nil {
-			NotFoundHandler(w, r)
-			return
-		}
-		// Set appropriate Content-Type based on file extension
-		ext := filepath.Ext(decodedURL)
-		switch ext {
-		case ".mp3":
-			w.Header().Set("Content-Type", "audio/mpeg")
-		case ".wav":
-			w.Header().Set("Content-Type", "audio/wav")
-		case ".flac":
-			w.Header().Set("Content-Type", "audio/flac")
-		case ".aac":
-			w.Header().Set("Content-Type", "audio/aac")
-		case ".ogg":
-			w.Header().Set("Content-Type", "audio/ogg")
-		case ".m4a":
-			w.Header().Set("Content-Type", "audio/mp4")
-		case ".amr":
-			w.Header().Set("Content-Type", "audio/amr")
-		case ".jpg", ".jpeg":
-			w.Header().Set("Content-Type", "image/jpeg")
-		case ".png":
-			w.Header().Set("Content-Type", "image/png")
-		case ".gif":
-			w.Header().Set("Content-Type", "image/gif")
-		case ".bmp":
-			w.Header().Set("Content-Type", "image/bmp")
-		case ".svg":
-			w.Header().Set("Content-Type", "image/svg+xml")
-		case ".webp":
-			w.Header().Set("Content-Type", "image/webp")
-		case ".txt":
-			w.Header().Set("Content-Type", "text/plain")
-		case ".lrc":
-			w.Header().Set("Content-Type", "text/plain")
-		case ".mrc":
-			w.Header().Set("Content-Type", "text/plain")
-		case ".json":
-			w.Header().Set("Content-Type", "application/json")
-		default:
-			w.Header().Set("Content-Type", "application/octet-stream")
-		}
-		// Write file content to response
-		w.Write(fileContent)
+		// Stream the remote file to the device
+		proxyHandler(w, r, decodedURL)
 		return
 	}
 
-	// Construct the complete file path
-	fullFilePath := filepath.Join("./files", filePath)
+	// Files that are still being produced are never served
+	if isStagingPath(filePath) {
+		NotFoundHandler(w, r)
+		return
+	}
 
-	// Try replacing '+' with ' ' and check if the file exists
-	tempFilePath := strings.ReplaceAll(fullFilePath, "+", " ")
-	if _, err := os.Stat(tempFilePath); err == nil {
-		fullFilePath = tempFilePath
+	// Resolve the file inside ./files, trying the '+'/space variants of the name
+	fullFilePath, err := resolveFilesURLPath(filePath)
+	if errors.Is(err, ErrUnsafePath) {
+		fmt.Printf("[Warning] Rejected unsafe path %s from %s\n", filePath, r.RemoteAddr)
+	}
+	if err != nil {
+		NotFoundHandler(w, r)
+		return
 	}
 
-	// Get file content
-	fileContent, err := GetFileContent(fullFilePath)
+	// Open the file, files are streamed rather than read into memory
+	file, err := os.Open(fullFilePath)
 	if err != nil {
-		// If file not found, try replacing ' ' with '+' and check again
-		tempFilePath = strings.ReplaceAll(fullFilePath, " ", "+")
-		fileContent, err = GetFileContent(tempFilePath)
-		if err != nil {
-			NotFoundHandler(w, r)
-			return
-		}
+		NotFoundHandler(w, r)
+		return
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil || fileInfo.IsDir() {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Serving a cached song counts as a use for the cache eviction
+	if name := cacheNameFromFilePath(fullFilePath); name != "" {
+		getCacheManager().Touch(name)
 	}
 
 	// Set appropriate Content-Type based on file extension
-	ext := filepath.Ext(filePath)
-	switch ext {
+	w.Header().Set("Content-Type", getContentType(filepath.Ext(filePath)))
+	w.Header().Set("ETag", buildFileETag(fileInfo))
+
+	// ServeContent handles Range, If-None-Match, If-Modified-Since and the Content-Length,
+	// Accept-Ranges and Last-Modified headers
+	http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), file)
+}
+
+// Helper function to build an ETag from the size and modification time of a file
+func buildFileETag(fileInfo os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", fileInfo.Size(), fileInfo.ModTime().UnixNano())
+}
+
+// Helper function to get the Content-Type for a file extension
+func getContentType(ext string) string {
+	switch strings.ToLower(ext) {
 	case ".mp3":
-		w.Header().Set("Content-Type", "audio/mpeg")
+		return "audio/mpeg"
 	case ".wav":
-		w.Header().Set("Content-Type", "audio/wav")
+		return "audio/wav"
 	case ".flac":
-		w.Header().Set("Content-Type", "audio/flac")
+		return "audio/flac"
 	case ".aac":
-		w.Header().Set("Content-Type", "audio/aac")
+		return "audio/aac"
 	case ".ogg":
-		w.Header().Set("Content-Type", "audio/ogg")
+		return "audio/ogg"
 	case ".m4a":
-		w.Header().Set("Content-Type", "audio/mp4")
+		return "audio/mp4"
 	case ".amr":
-		w.Header().Set("Content-Type", "audio/amr")
+		return "audio/amr"
 	case ".jpg", ".jpeg":
-		w.Header().Set("Content-Type", "image/jpeg")
+		return "image/jpeg"
 	case ".png":
-		w.Header().Set("Content-Type", "image/png")
+		return "image/png"
 	case ".gif":
-		w.Header().Set("Content-Type", "image/gif")
+		return "image/gif"
 	case ".bmp":
-		w.Header().Set("Content-Type", "image/bmp")
+		return "image/bmp"
 	case ".svg":
-		w.Header().Set("Content-Type", "image/svg+xml")
+		return "image/svg+xml"
 	case ".webp":
-		w.Header().Set("Content-Type", "image/webp")
-	case ".txt":
-		w.Header().Set("Content-Type", "text/plain")
-	case ".lrc":
-		w.Header().Set("Content-Type", "text/plain")
-	case ".mrc":
-		w.Header().Set("Content-Type", "text/plain")
+		return "image/webp"
+	case ".txt", ".lrc", ".mrc":
+		return "text/plain"
 	case ".json":
-		w.Header().Set("Content-Type", "application/json")
+		return "application/json"
 	default:
-		w.Header().Set("Content-Type", "application/octet-stream")
+		return "application/octet-stream"
 	}
-
-	// Write file content to response
-	w.Write(fileContent)
 }
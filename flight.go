@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrFlightPanicked is handed to the callers waiting on a fetch that panicked.
+var ErrFlightPanicked = errors.New("in-flight fetch panicked")
+
+// flightCall is a fetch that is in progress or has completed.
+type flightCall struct {
+	wg        sync.WaitGroup
+	musicItem MusicItem
+	err       error
+	fetch     *sharedFetch
+}
+
+// flightGroup coalesces concurrent fetches of the same key into a single call.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Do runs fn once for all concurrent callers with the same key and hands every caller its result.
+// The returned bool reports whether the result was shared with another caller.
+func (g *flightGroup) Do(key string, fn func() (MusicItem, error)) (MusicItem, error, bool) {
+	// Callers without a context never raise the fetch they join
+	ctx := withPriority(context.Background(), PriorityBackground)
+	return g.DoContext(ctx, key, func(context.Context) (MusicItem, error) {
+		return fn()
+	}, nil)
+}
+
+// DoContext is like Do for fetches that take a context. fn runs with the context of the caller that starts
+// the fetch; an interactive caller joining a background fetch raises it, so a device never waits on a
+// prefetch that is queued behind other jobs or slowed down by PREFETCH_MAX_KBPS. joined, if set, is called
+// before waiting for a fetch that is already in flight.
+func (g *flightGroup) DoContext(ctx context.Context, key string, fn func(ctx context.Context) (MusicItem, error), joined func()) (MusicItem, error, bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		fmt.Printf("[Info] Waiting for in-flight fetch of %s\n", key)
+		if priorityFromContext(ctx) == PriorityInteractive {
+			call.fetch.Raise()
+		}
+		if joined != nil {
+			joined()
+		}
+		call.wg.Wait()
+		return call.musicItem, call.err, true
+	}
+	ctx, fetch := withSharedFetch(ctx)
+	call := &flightCall{fetch: fetch}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	// The waiters are released and the key forgotten even if fn panics, the panic itself carries on up
+	// the stack of this caller (and is recovered per request by net/http)
+	finished := false
+	defer func() {
+		if !finished {
+			call.err = fmt.Errorf("fetch of %s: %w", key, ErrFlightPanicked)
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+	call.musicItem, call.err = fn(ctx)
+	finished = true
+
+	return call.musicItem, call.err, false
+}
+
+// sharedFetch is the work behind a flight, which the callers joining it can raise.
+type sharedFetch struct {
+	once   sync.Once
+	raised chan struct{}
+}
+
+type sharedFetchKey struct{}
+
+// Helper function to attach the shared fetch of a flight to a context. Flights started inside another
+// flight belong to the same work and keep its shared fetch.
+func withSharedFetch(ctx context.Context) (context.Context, *sharedFetch) {
+	if fetch, ok := ctx.Value(sharedFetchKey{}).(*sharedFetch); ok {
+		return ctx, fetch
+	}
+	fetch := &sharedFetch{raised: make(chan struct{})}
+	return context.WithValue(ctx, sharedFetchKey{}, fetch), fetch
+}
+
+// Raise moves the rest of the fetch to the interactive priority and lifts its bandwidth limit.
+func (f *sharedFetch) Raise() {
+	f.once.Do(func() { close(f.raised) })
+}
+
+// Helper function to get the channel that is closed when the fetch of a context is raised, nil outside flights
+func fetchRaised(ctx context.Context) <-chan struct{} {
+	if fetch, ok := ctx.Value(sharedFetchKey{}).(*sharedFetch); ok {
+		return fetch.raised
+	}
+	return nil
+}
+
+// Helper function to check whether the fetch of a context has been raised
+func isFetchRaised(ctx context.Context) bool {
+	select {
+	case <-fetchRaised(ctx):
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	// requestFlights coalesces cache misses for the same song and singer query
+	requestFlights flightGroup
+	// trackFlights coalesces downloads and transcodes into the same cache directory
+	trackFlights flightGroup
+)
+
+// Helper function to build the flight key of a song and singer query
+func requestFlightKey(song, singer string) string {
+	return normalizeMatchText(song) + "\x00" + normalizeMatchText(singer)
+}
+
+// stagingPrefix marks directories that are still being produced and must not be served.
+const stagingPrefix = ".staging-"
+
+// Helper function to create a staging directory next to the final directory
+func createStagingDir(finalDir string) (string, error) {
+	parent := filepath.Dir(finalDir)
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(parent, stagingPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	// MkdirTemp creates private directories, published directories must be readable like the others
+	return dir, os.Chmod(dir, 0755)
+}
+
+// Helper function to move a completed staging directory into place, replacing any previous version
+func publishStagingDir(stagingDir, finalDir string) error {
+	// Everything is on disk before the directory becomes visible
+	err := syncTree(stagingDir)
+	if err != nil {
+		return err
+	}
+	var oldDir string
+	if _, err := os.Stat(finalDir); err == nil {
+		oldDir = stagingDir + "-old"
+		err = os.Rename(finalDir, oldDir)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(stagingDir, finalDir)
+	if err != nil {
+		if oldDir != "" {
+			os.Rename(oldDir, finalDir)
+		}
+		return err
+	}
+	if oldDir != "" {
+		os.RemoveAll(oldDir)
+	}
+	return syncDir(filepath.Dir(finalDir))
+}
+
+// Helper function to check whether a served path points into a staging directory or at a temporary file
+func isStagingPath(path string) bool {
+	for _, part := range strings.FieldsFunc(filepath.ToSlash(path), func(r rune) bool { return r == '/' }) {
+		if strings.HasPrefix(part, stagingPrefix) || strings.HasPrefix(part, tempFilePrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupDo(t *testing.T) {
+	var group flightGroup
+	release := make(chan struct{})
+	calls := 0
+	var wg sync.WaitGroup
+	results := make([]MusicItem, 5)
+	shared := make([]bool, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _, shared[i] = group.Do("key", func() (MusicItem, error) {
+				calls++
+				<-release
+				return MusicItem{Title: "Song"}, nil
+			})
+		}()
+	}
+	// Give every caller the chance to join the flight before it completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn ran %d times", calls)
+	}
+	sharedCount := 0
+	for i := range results {
+		if results[i].Title != "Song" {
+			t.Errorf("caller %d got %+v", i, results[i])
+		}
+		if shared[i] {
+			sharedCount++
+		}
+	}
+	if sharedCount != len(results)-1 {
+		t.Errorf("%d callers shared the result, want %d", sharedCount, len(results)-1)
+	}
+	if len(group.calls) != 0 {
+		t.Errorf("%d calls left behind", len(group.calls))
+	}
+}
+
+func TestFlightGroupDoPanic(t *testing.T) {
+	var group flightGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		group.Do("key", func() (MusicItem, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waiterErr := make(chan error, 1)
+	go func() {
+		_, err, _ := group.Do("key", func() (MusicItem, error) {
+			return MusicItem{}, errors.New("waiter ran its own fetch")
+		})
+		waiterErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if value := <-panicked; value != "boom" {
+		t.Errorf("panic was not passed on to the caller, recovered %v", value)
+	}
+	select {
+	case err := <-waiterErr:
+		if !errors.Is(err, ErrFlightPanicked) {
+			t.Errorf("waiter got %v, want ErrFlightPanicked", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter is still blocked after the fetch panicked")
+	}
+
+	// The key is free again for the next fetch
+	musicItem, err, shared := group.Do("key", func() (MusicItem, error) {
+		return MusicItem{Title: "Retry"}, nil
+	})
+	if err != nil || shared || musicItem.Title != "Retry" {
+		t.Errorf("retry got %+v, %v, shared %v", musicItem, err, shared)
+	}
+}
+
+func TestFlightGroupDoContextJoined(t *testing.T) {
+	var group flightGroup
+	release := make(chan struct{})
+	started := make(chan struct{})
+	leaderJoined := false
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		group.DoContext(context.Background(), "key", func(context.Context) (MusicItem, error) {
+			close(started)
+			<-release
+			return MusicItem{Title: "Song"}, nil
+		}, func() { leaderJoined = true })
+	}()
+	<-started
+
+	joined := make(chan struct{})
+	waiterDone := make(chan MusicItem)
+	go func() {
+		musicItem, _, _ := group.DoContext(context.Background(), "key", func(context.Context) (MusicItem, error) {
+			return MusicItem{}, errors.New("waiter ran its own fetch")
+		}, func() { close(joined) })
+		waiterDone <- musicItem
+	}()
+	select {
+	case <-joined:
+	case <-time.After(5 * time.Second):
+		t.Fatal("joined was not called for the waiter")
+	}
+	close(release)
+	if musicItem := <-waiterDone; musicItem.Title != "Song" {
+		t.Errorf("waiter got %+v", musicItem)
+	}
+	<-done
+	if leaderJoined {
+		t.Error("joined was called for the caller running the fetch")
+	}
+}
+
+func TestFlightGroupInteractiveWaiterRaisesFetch(t *testing.T) {
+	var group flightGroup
+	limiter := &bandwidthLimiter{rate: 1024}
+	leaderCtx := withBandwidthLimit(withPriority(context.Background(), PriorityBackground), limiter)
+	started := make(chan context.Context)
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		group.DoContext(leaderCtx, "key", func(ctx context.Context) (MusicItem, error) {
+			// Flights started inside the fetch belong to it
+			trackFlights.DoContext(ctx, "nested", func(nested context.Context) (MusicItem, error) {
+				started <- nested
+				<-release
+				return MusicItem{}, nil
+			}, nil)
+			return MusicItem{Title: "Song"}, nil
+		}, nil)
+	}()
+	fetchCtx := <-started
+	if priorityFromContext(fetchCtx) != PriorityBackground || bandwidthLimitFromContext(fetchCtx) != limiter {
+		t.Fatal("the fetch does not run with the priority and limit of its caller")
+	}
+
+	// Other background callers leave the fetch alone
+	joined := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	join := func(ctx context.Context) {
+		defer wg.Done()
+		group.DoContext(ctx, "key", func(context.Context) (MusicItem, error) {
+			return MusicItem{}, errors.New("waiter ran its own fetch")
+		}, func() { joined <- struct{}{} })
+	}
+	go join(withPriority(context.Background(), PriorityBackground))
+	<-joined
+	if isFetchRaised(fetchCtx) {
+		t.Error("a background waiter raised the fetch")
+	}
+	go join(context.Background())
+	<-joined
+	if priorityFromContext(fetchCtx) != PriorityInteractive || bandwidthLimitFromContext(fetchCtx) != nil {
+		t.Error("an interactive waiter did not raise the fetch")
+	}
+	close(release)
+	wg.Wait()
+	<-done
+}
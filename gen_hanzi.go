@@ -0,0 +1,89 @@
+//go:build ignore
+
+// This program generates data/pinyin.txt and data/t2s.txt from the ICU transliterators.
+// It needs the uconv tool of ICU and is run with "go generate".
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// hanRanges are the CJK Unified Ideographs blocks covered by the tables
+var hanRanges = [][2]rune{
+	{0x3400, 0x4DBF}, // Extension A
+	{0x4E00, 0x9FFF}, // Basic block
+}
+
+// Helper function to run every character through an ICU transform, one character per line
+func transliterate(chars []rune, transform string) []string {
+	var input bytes.Buffer
+	for _, char := range chars {
+		input.WriteString(string(char) + "\n")
+	}
+	cmd := exec.Command("uconv", "-f", "utf-8", "-t", "utf-8", "-x", transform)
+	cmd.Stdin = &input
+	output, err := cmd.Output()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "uconv failed:", err)
+		os.Exit(1)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(output), "\n"), "\n")
+	if len(lines) != len(chars) {
+		fmt.Fprintf(os.Stderr, "uconv returned %d lines for %d characters\n", len(lines), len(chars))
+		os.Exit(1)
+	}
+	return lines
+}
+
+func main() {
+	var chars []rune
+	for _, r := range hanRanges {
+		for char := r[0]; char <= r[1]; char++ {
+			chars = append(chars, char)
+		}
+	}
+
+	// Pinyin without tones, one line per syllable followed by its characters
+	syllables := map[string][]rune{}
+	for i, reading := range transliterate(chars, "Han-Latin; Latin-ASCII; Lower") {
+		reading = strings.TrimSpace(reading)
+		if reading == "" || strings.IndexFunc(reading, func(r rune) bool { return r < 'a' || r > 'z' }) >= 0 {
+			continue // No reading known
+		}
+		syllables[reading] = append(syllables[reading], chars[i])
+	}
+	names := make([]string, 0, len(syllables))
+	for name := range syllables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pinyin bytes.Buffer
+	pinyin.WriteString("# Generated by gen_hanzi.go from the ICU Han-Latin transliterator, do not edit.\n")
+	for _, name := range names {
+		pinyin.WriteString(name + "\t" + string(syllables[name]) + "\n")
+	}
+
+	// Traditional characters followed by their simplified form, one pair per line
+	var t2s bytes.Buffer
+	t2s.WriteString("# Generated by gen_hanzi.go from the ICU Traditional-Simplified transliterator, do not edit.\n")
+	for i, simplified := range transliterate(chars, "Traditional-Simplified") {
+		if utf8.RuneCountInString(simplified) != 1 || []rune(simplified)[0] == chars[i] {
+			continue
+		}
+		t2s.WriteString(string(chars[i]) + simplified + "\n")
+	}
+
+	os.MkdirAll("data", 0755)
+	for name, data := range map[string][]byte{"data/pinyin.txt": pinyin.Bytes(), "data/t2s.txt": t2s.Bytes()} {
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -2,4 +2,11 @@ module MeowEmbedded-MusicServer
 
 go 1.25.0
 
-require github.com/joho/godotenv v1.5.1
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/joho/godotenv v1.5.1
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/text v0.40.0
+)
+
+require golang.org/x/sys v0.29.0 // indirect
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -12,136 +15,197 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// Helper function to compress and segment audio file
-func compressAndSegmentAudio(inputFile, outputDir string) error {
+// Helper function to compress and segment audio file with the default profile
+func compressAndSegmentAudio(ctx context.Context, inputFile, outputDir string, progress ProgressFunc) error {
 	fmt.Printf("[Info] Compress and segment audio file %s\n", inputFile)
-	// Compress music files
-	outputFile := filepath.Join(outputDir, "music.mp3")
-	cmd := exec.Command("ffmpeg", "-i", inputFile, "-ac", "1", "-ab", "32k", "-ar", "24000", outputFile)
-	err := cmd.Run()
-	if err != nil {
-		return err
+	return transcodeWithProfile(ctx, inputFile, outputDir, getDefaultProfile(), progress)
+}
+
+// Helper function to run ffmpeg and report the percentage of the input duration processed so far
+// The caller must hold a worker of the transcoding pool.
+func runFFmpegWithProgress(ctx context.Context, args []string, duration float64, onProgress func(percent float64)) error {
+	if duration <= 0 {
+		return exec.CommandContext(ctx, "ffmpeg", args...).Run()
 	}
 
-	// Split music files
-	chunkDir := filepath.Join(outputDir, "chunk")
-	err = os.MkdirAll(chunkDir, 0755)
+	// ffmpeg writes key=value progress blocks to stdout, out_time_us is the position in microseconds
+	args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
 	}
-
-	// Using ffmpeg for segmentation
-	segmentedFilePattern := filepath.Join(chunkDir, "%03d.mp3") // e.g. 001.mp3, 002.mp3, ...
-	cmd = exec.Command("ffmpeg", "-i", outputFile, "-ac", "1", "-ab", "32k", "-ar", "16000", "-f", "segment", "-segment_time", "10", segmentedFilePattern)
-	err = cmd.Run()
+	err = cmd.Start()
 	if err != nil {
 		return err
 	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "out_time_us=")
+		if !ok {
+			continue
+		}
+		microseconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		percent := microseconds / 1e6 / duration * 100
+		if percent > 100 {
+			percent = 100
+		}
+		if percent >= 0 {
+			onProgress(percent)
+		}
+	}
+	return cmd.Wait()
+}
 
-	return nil
+// Helper function to download files from URL
+func downloadFile(ctx context.Context, filename string, url string) error {
+	return downloadFileWithProgress(ctx, filename, url, nil)
 }
 
-// Helper function to create M3U8 playlist file
-func createM3U8Playlist(outputDir string) error {
-	fmt.Printf("[Info] Create M3U8 playlist file for %s\n", outputDir)
-	playlistFile := filepath.Join(outputDir, "music.m3u8")
-	file, err := os.Create(playlistFile)
+// Helper function to download files from URL, reporting the percentage downloaded when the size is known.
+// A bandwidth limit attached to the context slows the download down.
+func downloadFileWithProgress(ctx context.Context, filename string, url string, onProgress func(percent float64)) error {
+	fmt.Printf("[Info] Download file %s from URL %s\n", filename, url)
+	client, conf := getRemoteHTTPClient()
+	policy := getURLPolicy()
+	// Stalled downloads are cancelled after the read timeout
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := time.AfterFunc(conf.readTimeout, cancel)
+	defer timer.Stop()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	_, err = file.WriteString("#EXTM3U\n")
+	err = policy.CheckURL(req.URL)
 	if err != nil {
+		fmt.Printf("[Warning] Blocked download of %s: %v\n", url, err)
 		return err
 	}
-	_, err = file.WriteString("#EXT-X-VERSION:3\n")
+	resp, err := client.Do(req)
 	if err != nil {
+		if errors.Is(err, ErrURLForbidden) {
+			fmt.Printf("[Warning] Blocked download of %s: %v\n", url, err)
+		}
 		return err
 	}
-	_, err = file.WriteString("#EXT-X-TARGETDURATION:10\n")
+	defer resp.Body.Close()
+	err = policy.CheckResponse(resp)
 	if err != nil {
+		fmt.Printf("[Warning] Blocked download of %s: %v\n", url, err)
 		return err
 	}
 
-	chunkDir := filepath.Join(outputDir, "chunk")
-	files, err := os.ReadDir(chunkDir)
+	// The file only appears under its name once the whole body has been written
+	out, err := createAtomicFile(filename, 0644)
 	if err != nil {
 		return err
 	}
+	defer out.Abort()
 
-	var chunkFiles []string
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".mp3") {
-			chunkFiles = append(chunkFiles, file.Name())
-		}
+	body := policy.LimitBody(&idleTimeoutReader{r: resp.Body, timer: timer, timeout: conf.readTimeout})
+	if limiter := bandwidthLimitFromContext(ctx); limiter != nil {
+		body = &throttledReader{reader: body, limiter: limiter, ctx: ctx}
 	}
-
-	// Sort by file name
-	for i := 0; i < len(chunkFiles); i++ {
-		for j := i + 1; j < len(chunkFiles); j++ {
-			if chunkFiles[i] > chunkFiles[j] {
-				chunkFiles[i], chunkFiles[j] = chunkFiles[j], chunkFiles[i]
-			}
-		}
+	if onProgress != nil && resp.ContentLength > 0 {
+		body = &progressReader{reader: body, total: resp.ContentLength, onProgress: onProgress}
 	}
-
-	for _, chunkFile := range chunkFiles {
-		_, err = file.WriteString("#EXTINF:10.000\n")
-		if err != nil {
-			return err
-		}
-		url := fmt.Sprintf("%s/cache/music/%s/%s/%s\n", os.Getenv("EMBEDDED_WEBSITE_URL"), filepath.Base(outputDir), "chunk", chunkFile)
-		_, err = file.WriteString(url)
+	written, err := io.Copy(out, body)
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return fmt.Errorf("incomplete download: got %d of %d bytes", written, resp.ContentLength)
 	}
+	return out.Commit()
+}
 
-	return err
+// progressReader reports how much of a body of known size has been read.
+type progressReader struct {
+	reader     io.Reader
+	read       int64
+	total      int64
+	lastReport float64
+	onProgress func(percent float64)
 }
 
-// Helper function to download files from URL
-func downloadFile(filename string, url string) error {
-	fmt.Printf("[Info] Download file %s from URL %s\n", filename, url)
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	pr.read += int64(n)
+	percent := float64(pr.read) / float64(pr.total) * 100
+	// Only report whole percent steps to avoid flooding subscribers
+	if percent-pr.lastReport >= 1 || err == io.EOF {
+		pr.lastReport = percent
+		pr.onProgress(min(percent, 100))
 	}
-	defer resp.Body.Close()
+	return n, err
+}
 
-	out, err := os.Create(filename)
+// Helper function to get duration of obtaining music files through the transcoding pool
+func getMusicDurationContext(ctx context.Context, filePath string) int {
+	fmt.Printf("[Info] Get duration of obtaining music file %s\n", filePath)
+	ctx, release, err := getTranscodePool().Acquire(ctx, true)
 	if err != nil {
-		return err
+		fmt.Println("[Error] Error getting audio duration:", err)
+		return 0
 	}
-	defer out.Close()
+	defer release()
 
-	_, err = io.Copy(out, resp.Body)
-	return err
+	duration, err := probeMusicDuration(ctx, filePath)
+	if err != nil {
+		fmt.Println("[Error] Error getting audio duration:", err)
+		return 0
+	}
+	return int(duration)
 }
 
-// Helper function to get duration of obtaining music files
-func getMusicDuration(filePath string) int {
-	fmt.Printf("[Info] Get duration of obtaining music file %s\n", filePath)
+// Helper function to run ffprobe for the duration in seconds, the caller must hold a worker of the transcoding pool
+func probeMusicDuration(ctx context.Context, filePath string) (float64, error) {
 	// Use ffprobe to get audio duration
-	output, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", filePath).Output()
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", filePath).Output()
 	if err != nil {
-		fmt.Println("[Error] Error getting audio duration:", err)
-		return 0
+		return 0, err
 	}
 
 	duration, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
 	if err != nil {
-		fmt.Println("[Error] Error converting duration to float:", err)
-		return 0
+		return 0, fmt.Errorf("error converting duration to float: %w", err)
 	}
-
-	return int(duration)
+	return duration, nil
 }
 
-// Helper function for identifying file formats
-func getMusicFileExtension(url string) (string, error) {
-	resp, err := http.Head(url)
+// Helper function for identifying file formats, asking the server through the URL policy like the download itself
+func getMusicFileExtension(ctx context.Context, url string) (string, error) {
+	client, conf := getRemoteHTTPClient()
+	policy := getURLPolicy()
+	ctx, cancel := context.WithTimeout(ctx, conf.readTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return "", err
+	}
+	err = policy.CheckURL(req.URL)
 	if err != nil {
+		fmt.Printf("[Warning] Blocked request for %s: %v\n", url, err)
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrURLForbidden) {
+			fmt.Printf("[Warning] Blocked request for %s: %v\n", url, err)
+		}
+		return "", err
+	}
+	resp.Body.Close()
+	err = policy.CheckResponse(resp)
+	if err != nil {
+		fmt.Printf("[Warning] Blocked request for %s: %v\n", url, err)
 		return "", err
 	}
 	// Get file format from Content-Type header
@@ -184,137 +248,221 @@ func getMusicFileExtension(url string) (string, error) {
 	}
 }
 
-// Helper function to obtain music data from local folder
-func getLocalMusicItem(song, singer string) MusicItem {
-	musicDir := "./files/music"
-	fmt.Println("[Info] Reading local folder music.")
-	files, err := os.ReadDir(musicDir)
-	if err != nil {
-		fmt.Println("[Error] Failed to read local music directory:", err)
-		return MusicItem{}
-	}
-
-	for _, file := range files {
-		if file.IsDir() {
-			if singer == "" {
-				if strings.Contains(file.Name(), song) {
-					dirPath := filepath.Join(musicDir, file.Name())
-					// Extract artist and title from the directory name
-					parts := strings.SplitN(file.Name(), "-", 2)
-					if len(parts) != 2 {
-						continue // Skip if the directory name doesn't contain exactly one "-"
-					}
-					artist := parts[0]
-					title := parts[1]
-					musicItem := MusicItem{
-						Title:        title,
-						Artist:       artist,
-						AudioURL:     "",
-						AudioFullURL: "",
-						M3U8URL:      "",
-						LyricURL:     "",
-						CoverURL:     "",
-						Duration:     0,
-					}
-
-					musicFilePath := filepath.Join(dirPath, "music.mp3")
-					if _, err := os.Stat(musicFilePath); err == nil {
-						musicItem.AudioURL = "/music/" + url.QueryEscape(file.Name()) + "/music.mp3"
-						musicItem.Duration = getMusicDuration(musicFilePath)
-					}
-
-					for _, audioFormat := range []string{"music_full.mp3", "music_full.flac", "music_full.wav", "music_full.aac", "music_full.ogg"} {
-						audioFilePath := filepath.Join(dirPath, audioFormat)
-						if _, err := os.Stat(audioFilePath); err == nil {
-							musicItem.AudioFullURL = "/music/" + url.QueryEscape(file.Name()) + "/" + audioFormat
-							break
-						}
-					}
-
-					m3u8FilePath := filepath.Join(dirPath, "music.m3u8")
-					if _, err := os.Stat(m3u8FilePath); err == nil {
-						musicItem.M3U8URL = "/music/" + url.QueryEscape(file.Name()) + "/music.m3u8"
-					}
-
-					lyricFilePath := filepath.Join(dirPath, "lyric.lrc")
-					if _, err := os.Stat(lyricFilePath); err == nil {
-						musicItem.LyricURL = "/music/" + url.QueryEscape(file.Name()) + "/lyric.lrc"
-					}
-
-					coverJpgFilePath := filepath.Join(dirPath, "cover.jpg")
-					if _, err := os.Stat(coverJpgFilePath); err == nil {
-						musicItem.CoverURL = "/music/" + url.QueryEscape(file.Name()) + "/cover.jpg"
-					} else {
-						coverPngFilePath := filepath.Join(dirPath, "cover.png")
-						if _, err := os.Stat(coverPngFilePath); err == nil {
-							musicItem.CoverURL = "/music/" + url.QueryEscape(file.Name()) + "/cover.png"
-						}
-					}
-
-					return musicItem
-				}
-			} else {
-				if strings.Contains(file.Name(), singer) && strings.Contains(file.Name(), song) {
-					dirPath := filepath.Join(musicDir, file.Name())
-					// Extract artist and title from the directory name
-					parts := strings.SplitN(file.Name(), "-", 2)
-					if len(parts) != 2 {
-						continue // Skip if the directory name doesn't contain exactly one "-"
-					}
-					artist := parts[0]
-					title := parts[1]
-					musicItem := MusicItem{
-						Title:        title,
-						Artist:       artist,
-						AudioURL:     "",
-						AudioFullURL: "",
-						M3U8URL:      "",
-						LyricURL:     "",
-						CoverURL:     "",
-						Duration:     0,
-					}
-
-					musicFilePath := filepath.Join(dirPath, "music.mp3")
-					if _, err := os.Stat(musicFilePath); err == nil {
-						musicItem.AudioURL = "/music/" + url.QueryEscape(file.Name()) + "/music.mp3"
-						musicItem.Duration = getMusicDuration(musicFilePath)
-					}
-
-					for _, audioFormat := range []string{"music_full.mp3", "music_full.flac", "music_full.wav", "music_full.aac", "music_full.ogg"} {
-						audioFilePath := filepath.Join(dirPath, audioFormat)
-						if _, err := os.Stat(audioFilePath); err == nil {
-							musicItem.AudioFullURL = "/music/" + url.QueryEscape(file.Name()) + "/" + audioFormat
-							break
-						}
-					}
-
-					m3u8FilePath := filepath.Join(dirPath, "music.m3u8")
-					if _, err := os.Stat(m3u8FilePath); err == nil {
-						musicItem.M3U8URL = "/music/" + url.QueryEscape(file.Name()) + "/music.m3u8"
-					}
-
-					lyricFilePath := filepath.Join(dirPath, "lyric.lrc")
-					if _, err := os.Stat(lyricFilePath); err == nil {
-						musicItem.LyricURL = "/music/" + url.QueryEscape(file.Name()) + "/lyric.lrc"
-					}
-
-					coverJpgFilePath := filepath.Join(dirPath, "cover.jpg")
-					if _, err := os.Stat(coverJpgFilePath); err == nil {
-						musicItem.CoverURL = "/music/" + url.QueryEscape(file.Name()) + "/cover.jpg"
-					} else {
-						coverPngFilePath := filepath.Join(dirPath, "cover.png")
-						if _, err := os.Stat(coverPngFilePath); err == nil {
-							musicItem.CoverURL = "/music/" + url.QueryEscape(file.Name()) + "/cover.png"
-						}
-					}
-
-					return musicItem
-				}
+// localFullAudioFormats are the original quality files a local music folder may hold, in order of preference
+var localFullAudioFormats = []string{"music_full.mp3", "music_full.flac", "music_full.wav", "music_full.aac", "music_full.ogg", "music_full.m4a"}
+
+// Helper function to build a music item from a local music folder
+func buildLocalMusicItem(musicDir, dirName string) (MusicItem, bool) {
+	musicItem, _, ok := buildLocalMusicItemWithTags(context.Background(), musicDir, dirName)
+	return musicItem, ok
+}
+
+// Helper function to build a music item from a local music folder, taking the metadata from the tags of
+// its audio file and falling back to a folder name of the form <artist>-<title>. The context sets the
+// priority of the ffprobe run.
+func buildLocalMusicItemWithTags(ctx context.Context, musicDir, dirName string) (MusicItem, AudioTags, bool) {
+	dirPath := filepath.Join(musicDir, dirName)
+	musicItem := MusicItem{}
+
+	musicFilePath := filepath.Join(dirPath, "music.mp3")
+	if _, err := os.Stat(musicFilePath); err == nil {
+		musicItem.AudioURL = "/music/" + url.QueryEscape(dirName) + "/music.mp3"
+		musicItem.Duration = getMusicDurationContext(ctx, musicFilePath)
+	}
+
+	// The original quality file carries the tags the user put there, music.mp3 may have been produced by us
+	tagsFilePath := ""
+	for _, audioFormat := range localFullAudioFormats {
+		audioFilePath := filepath.Join(dirPath, audioFormat)
+		if _, err := os.Stat(audioFilePath); err == nil {
+			musicItem.AudioFullURL = "/music/" + url.QueryEscape(dirName) + "/" + audioFormat
+			tagsFilePath = audioFilePath
+			break
+		}
+	}
+	if tagsFilePath == "" && musicItem.AudioURL != "" {
+		tagsFilePath = musicFilePath
+	}
+	var tags AudioTags
+	if tagsFilePath != "" {
+		var err error
+		tags, err = readAudioTags(tagsFilePath)
+		if err != nil && !errors.Is(err, ErrNoTags) {
+			fmt.Printf("[Warning] Failed to read tags of %s: %v\n", tagsFilePath, err)
+		}
+	}
+
+	// Extract artist and title from the directory name if the tags have none
+	musicItem.Title, musicItem.Artist, musicItem.Album = tags.Title, tags.Artist, tags.Album
+	if parts := strings.SplitN(dirName, "-", 2); len(parts) == 2 {
+		setFirst(&musicItem.Artist, parts[0])
+		setFirst(&musicItem.Title, parts[1])
+	} else {
+		setFirst(&musicItem.Title, dirName)
+	}
+
+	m3u8FilePath := filepath.Join(dirPath, "music.m3u8")
+	if _, err := os.Stat(m3u8FilePath); err == nil {
+		musicItem.M3U8URL = "/music/" + url.QueryEscape(dirName) + "/music.m3u8"
+	}
+
+	// Embedded lyrics and cover art are written next to the audio file so they can be served like the others
+	lyricFilePath := filepath.Join(dirPath, "lyric.lrc")
+	if _, err := os.Stat(lyricFilePath); os.IsNotExist(err) && tags.Lyrics != "" {
+		writeEmbeddedFile(lyricFilePath, []byte(tags.Lyrics))
+	}
+	if _, err := os.Stat(lyricFilePath); err == nil {
+		musicItem.LyricURL = "/music/" + url.QueryEscape(dirName) + "/lyric.lrc"
+	}
+
+	coverJpgFilePath := filepath.Join(dirPath, "cover.jpg")
+	coverPngFilePath := filepath.Join(dirPath, "cover.png")
+	_, jpgErr := os.Stat(coverJpgFilePath)
+	_, pngErr := os.Stat(coverPngFilePath)
+	if os.IsNotExist(jpgErr) && os.IsNotExist(pngErr) && len(tags.Cover) > 0 {
+		if tags.CoverMIME == "image/png" {
+			pngErr = writeEmbeddedFile(coverPngFilePath, tags.Cover)
+		} else {
+			jpgErr = writeEmbeddedFile(coverJpgFilePath, tags.Cover)
+		}
+	}
+	if jpgErr == nil {
+		musicItem.CoverURL = "/music/" + url.QueryEscape(dirName) + "/cover.jpg"
+	} else if pngErr == nil {
+		musicItem.CoverURL = "/music/" + url.QueryEscape(dirName) + "/cover.png"
+	}
+
+	return musicItem, tags, true
+}
+
+// Helper function to write a file extracted from embedded tags, through a temporary file
+func writeEmbeddedFile(filePath string, data []byte) error {
+	err := writeFileAtomic(filePath, data, 0644)
+	if err != nil {
+		fmt.Printf("[Error] Failed to write %s from embedded tags: %v\n", filePath, err)
+		return err
+	}
+	fmt.Printf("[Info] Extracted %s from embedded tags\n", filePath)
+	return nil
+}
+
+// Helper function to obtain all matching music data from local folder, stopping after limit matches if limit > 0
+func searchLocalMusicItems(song, singer string, limit int) []MusicItem {
+	var musicItems []MusicItem
+	for _, entry := range findLibraryEntries(libraryLocal, song, singer, limit) {
+		musicItems = append(musicItems, entry.Item)
+	}
+	return musicItems
+}
+
+// Helper function to produce the compressed music.mp3, chunks and playlist of a local track the first time it is requested
+func ensureLocalMusicOutputs(ctx context.Context, musicDir, dirName string) error {
+	dirPath := filepath.Join(musicDir, dirName)
+	_, mp3Err := os.Stat(filepath.Join(dirPath, "music.mp3"))
+	if _, err := os.Stat(filepath.Join(dirPath, "music.m3u8")); err == nil && mp3Err == nil {
+		return nil
+	}
+
+	// Transcode from the original quality file, or segment a hand-placed music.mp3
+	var inputFile string
+	for _, audioFormat := range localFullAudioFormats {
+		audioFilePath := filepath.Join(dirPath, audioFormat)
+		if _, err := os.Stat(audioFilePath); err == nil {
+			inputFile = audioFilePath
+			break
+		}
+	}
+	if inputFile == "" && mp3Err == nil {
+		inputFile = filepath.Join(dirPath, "music.mp3")
+	}
+	if inputFile == "" {
+		return fmt.Errorf("no audio file in %s", dirPath)
+	}
+
+	// Concurrent requests for the same track wait for a single transcode
+	_, err, _ := trackFlights.Do(dirPath, func() (MusicItem, error) {
+		fmt.Printf("[Info] Preparing streaming files for local track %s\n", dirName)
+		stagingDir, err := createStagingDir(filepath.Join(dirPath, "music.m3u8"))
+		if err != nil {
+			return MusicItem{}, err
+		}
+		defer os.RemoveAll(stagingDir)
+
+		err = compressAndSegmentAudio(ctx, inputFile, stagingDir, nil)
+		if err != nil {
+			return MusicItem{}, err
+		}
+		err = createM3U8Playlist(ctx, stagingDir)
+		if err != nil {
+			return MusicItem{}, err
+		}
+
+		err = syncTree(stagingDir)
+		if err != nil {
+			return MusicItem{}, err
+		}
+
+		// Move the outputs into the track directory, the playlist last since it marks the track as prepared.
+		// A hand-placed music.mp3 is kept.
+		names := []string{"chunk", "music.m3u8"}
+		if mp3Err != nil {
+			names = []string{"music.mp3", "chunk", "music.m3u8"}
+		}
+		for _, name := range names {
+			err = os.RemoveAll(filepath.Join(dirPath, name))
+			if err != nil {
+				return MusicItem{}, err
+			}
+			err = os.Rename(filepath.Join(stagingDir, name), filepath.Join(dirPath, name))
+			if err != nil {
+				return MusicItem{}, err
 			}
 		}
+		return MusicItem{}, syncDir(dirPath)
+	})
+	return err
+}
+
+// Helper function to obtain the music data of a local folder, preparing its streaming files if they are missing
+func prepareLocalMusicItem(ctx context.Context, entry LibraryEntry) MusicItem {
+	musicDir := "./files/music"
+	err := ensureLocalMusicOutputs(ctx, musicDir, entry.Name)
+	if err != nil {
+		fmt.Println("[Error] Error preparing local track for streaming:", err)
+	}
+	// Pick up the files that were just produced
+	if sameStamps(entry.Files, statLocalMusicDir(musicDir, entry.Name)) {
+		return entry.Item
 	}
+	if lib := getLibrary(); lib != nil {
+		lib.IndexLocalDir(musicDir, entry.Name)
+	}
+	musicItem, _ := buildLocalMusicItem(musicDir, entry.Name)
+	return musicItem
+}
 
-	return MusicItem{} // If no matching folder is found, return an empty MusicItem
+// Helper function to map a URL served by this server to the local file behind it
+func getLocalPathFromURL(r *http.Request, rawURL string) (string, bool) {
+	if rawURL == "" {
+		return "", false
+	}
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || (parsedURL.Host != "" && parsedURL.Host != r.Host) {
+		return "", false
+	}
+	decodedPath, err := url.PathUnescape(parsedURL.Path)
+	if err != nil || strings.HasPrefix(decodedPath, "/url/") {
+		return "", false
+	}
+
+	localPath, err := resolveFilesURLPath(decodedPath)
+	if errors.Is(err, ErrUnsafePath) {
+		fmt.Printf("[Warning] Rejected unsafe path %s\n", decodedPath)
+	}
+	if err != nil {
+		return "", false
+	}
+	return localPath, true
 }
 
 // Helper function to obtain IP address of the client
@@ -338,56 +486,80 @@ func IPhandler(r *http.Request) (string, error) {
 
 // Helper function to read music sources from sources.json file
 func readSources() []MusicItem {
-	data, err := os.ReadFile("./sources.json")
 	fmt.Println("[Info] Reading local sources.json")
+	sources, err := loadSources("./sources.json")
 	if err != nil {
-		fmt.Println("[Error] Failed to read sources.json:", err)
+		fmt.Println("[Error] Failed to load sources.json:", err)
 		return nil
 	}
+	return sources
+}
+
+// Helper function to read and validate a sources file, entries without a title are placeholders and are kept
+func loadSources(filePath string) ([]MusicItem, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
 
 	var sources []MusicItem
 	err = json.Unmarshal(data, &sources)
 	if err != nil {
-		fmt.Println("[Error] Failed to parse sources.json:", err)
-		return nil
+		return nil, fmt.Errorf("failed to parse: %w", err)
 	}
-
-	return sources
+	for i, source := range sources {
+		if source.Title == "" {
+			continue
+		}
+		if source.AudioURL == "" && source.AudioFullURL == "" {
+			return nil, fmt.Errorf("entry %d (%s) has no audio_url or audio_full_url", i+1, source.Title)
+		}
+		if source.Duration < 0 {
+			return nil, fmt.Errorf("entry %d (%s) has a negative duration", i+1, source.Title)
+		}
+	}
+	return sources, nil
 }
 
-// Helper function to request and cache music from API sources
-func requestAndCacheMusic(song, singer string) MusicItem {
+// Helper function to request and cache music from API sources, only a full transcoding queue is returned as an error
+func requestAndCacheMusic(ctx context.Context, song, singer string, progress ProgressFunc) (MusicItem, error) {
 	fmt.Printf("[Info] Requesting and caching music for %s", song)
 	// Create cache directory if it doesn't exist
 	err := os.MkdirAll("./cache", 0755)
 	if err != nil {
 		fmt.Println("[Error] Error creating cache directory:", err)
-		return MusicItem{}
+		return MusicItem{}, nil
 	}
 
-	// Get API_SOURCES and any subsequent environment variables (e.g. API_SOURCES_1, API_SOURCES_2, etc.)
-	var sources []string
-	for i := 0; ; i++ {
-		var key string
-		if i == 0 {
-			key = "API_SOURCES"
-		} else {
-			key = "API_SOURCES_" + strconv.Itoa(i)
+	// Request and cache music from each provider configured by API_SOURCES in turn
+	var musicItem MusicItem
+	var providerName, trackID string
+	for _, name := range getConfiguredProviders() {
+		provider, ok := getProvider(name)
+		if !ok {
+			fmt.Printf("[Warning] Unknown music provider: %s\n", name)
+			continue
 		}
-		source := os.Getenv(key)
-		if source == "" {
-			break
+		fmt.Printf("[Info] Requesting music from source: %s\n", name)
+		tracks, err := provider.Search(ctx, song, singer, 1)
+		if err != nil {
+			fmt.Println("[Error] Error searching music provider:", err)
+			continue
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		musicItem, err = cacheProviderTrack(ctx, provider, tracks[0], progress)
+		if errors.Is(err, ErrQueueFull) {
+			return MusicItem{}, err
+		}
+		if err != nil {
+			fmt.Println("[Error] Error caching music from provider:", err)
+			continue
 		}
-		sources = append(sources, source)
-	}
-
-	// Request and cache music from each source in turn
-	var musicItem MusicItem
-	for _, source := range sources {
-		fmt.Printf("[Info] Requesting music from source: %s\n", source)
-		musicItem = YuafengAPIResponseHandler(strings.TrimSpace(source), song, singer)
 		if musicItem.Title != "" {
 			// If music item is valid, stop searching for sources
+			providerName, trackID = name, tracks[0].ID
 			break
 		}
 	}
@@ -395,26 +567,98 @@ func requestAndCacheMusic(song, singer string) MusicItem {
 	// If no valid music item was found, return an empty MusicItem
 	if musicItem.Title == "" {
 		fmt.Printf("[Warning] No valid music item retrieved.\n")
-		return MusicItem{}
+		return MusicItem{}, nil
 	}
 
-	// Create cache file path based on artist and title
-	cacheFile := fmt.Sprintf("./cache/%s-%s.json", musicItem.Artist, musicItem.Title)
+	err = writeCacheFile(musicItem, providerName, trackID)
+	if err != nil {
+		fmt.Println("[Error] Error writing cache file:", err)
+		return MusicItem{}, nil
+	}
+
+	fmt.Println("[Info] Music request and caching completed successfully.")
+	return musicItem, nil
+}
 
-	// Write cache data to cache file
-	cacheData, err := json.MarshalIndent(musicItem, "", "  ")
+// Helper function to request and cache a specific track picked from a provider's search results
+func requestAndCacheProviderTrack(ctx context.Context, providerName, id, song, singer string, progress ProgressFunc) (MusicItem, error) {
+	fmt.Printf("[Info] Requesting and caching track %s from provider %s\n", id, providerName)
+	provider, ok := getProvider(providerName)
+	if !ok {
+		fmt.Printf("[Warning] Unknown music provider: %s\n", providerName)
+		return MusicItem{}, nil
+	}
+	err := os.MkdirAll("./cache", 0755)
+	if err != nil {
+		fmt.Println("[Error] Error creating cache directory:", err)
+		return MusicItem{}, nil
+	}
+
+	musicItem, err := cacheProviderTrack(ctx, provider, Track{Provider: providerName, ID: id, Title: song, Artist: singer}, progress)
+	if errors.Is(err, ErrQueueFull) {
+		return MusicItem{}, err
+	}
 	if err != nil {
-		fmt.Println("[Error] Error marshalling cache data:", err)
-		return MusicItem{}
+		fmt.Println("[Error] Error caching music from provider:", err)
+		return MusicItem{}, nil
+	}
+	if musicItem.Title == "" {
+		fmt.Printf("[Warning] No valid music item retrieved.\n")
+		return MusicItem{}, nil
 	}
-	err = os.WriteFile(cacheFile, cacheData, 0644)
+
+	err = writeCacheFile(musicItem, providerName, id)
 	if err != nil {
 		fmt.Println("[Error] Error writing cache file:", err)
-		return MusicItem{}
+		return MusicItem{}, nil
+	}
+	return musicItem, nil
+}
+
+// Helper function to write a music item to its cache file, recording the provider track it came from
+// and the checksums of its media files
+func writeCacheFile(musicItem MusicItem, provider, id string) error {
+	// Create cache file path based on artist and title
+	cacheFile, err := cacheRoot.Join(safeFileName(musicItem.Artist+"-"+musicItem.Title) + ".json")
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("[Info] Music request and caching completed successfully.")
-	return musicItem
+	data := cacheFileData{MusicItem: musicItem}
+	mediaDir, err := getCacheMediaDir(safeFileName(musicItem.Artist + "-" + musicItem.Title))
+	if err != nil {
+		return err
+	}
+	data.Integrity, err = buildCacheIntegrity(mediaDir, provider, id)
+	if err != nil {
+		return fmt.Errorf("error recording cache checksums: %w", err)
+	}
+
+	// Write cache data to a temporary file and rename it so readers never see a partial file
+	cacheData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(cacheFile, cacheData, 0644)
+	if err != nil {
+		return err
+	}
+
+	if lib := getLibrary(); lib != nil {
+		lib.IndexCacheFile(cacheFile)
+	}
+	getCacheManager().Touch(filepath.Base(cacheFile))
+	notifyCacheChanged()
+	return nil
+}
+
+// Helper function to obtain all matching music data from cache files, stopping after limit matches if limit > 0
+func searchCachedMusicItems(song, singer string, limit int) []MusicItem {
+	var musicItems []MusicItem
+	for _, entry := range findLibraryEntries(libraryCache, song, singer, limit) {
+		musicItems = append(musicItems, entry.Item)
+	}
+	return musicItems
 }
 
 // Helper function to read music data from cache file
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Helper function to create a VOD M3U8 playlist for the segments in outputDir/chunk
+//
+// Segment links are relative to the playlist, so they resolve against whatever host and
+// path the playlist itself was fetched from.
+func createM3U8Playlist(ctx context.Context, outputDir string) error {
+	fmt.Printf("[Info] Create M3U8 playlist file for %s\n", outputDir)
+	chunkDir := filepath.Join(outputDir, "chunk")
+	files, err := os.ReadDir(chunkDir)
+	if err != nil {
+		return err
+	}
+
+	var chunkFiles []string
+	for _, file := range files {
+		if !file.IsDir() {
+			chunkFiles = append(chunkFiles, file.Name())
+		}
+	}
+	if len(chunkFiles) == 0 {
+		return fmt.Errorf("no segments in %s", chunkDir)
+	}
+	// Sort by file name, segments are numbered with leading zeros
+	sort.Strings(chunkFiles)
+
+	// Probe the real length of every segment
+	ctx, release, err := getTranscodePool().Acquire(ctx, true)
+	if err != nil {
+		return err
+	}
+	durations := make([]float64, len(chunkFiles))
+	for i, chunkFile := range chunkFiles {
+		durations[i], err = probeMusicDuration(ctx, filepath.Join(chunkDir, chunkFile))
+		if err != nil {
+			release()
+			return fmt.Errorf("error probing segment %s: %w", chunkFile, err)
+		}
+	}
+	release()
+
+	playlist := buildM3U8Playlist(chunkFiles, durations)
+	err = validateM3U8Playlist(playlist)
+	if err != nil {
+		return fmt.Errorf("generated playlist is invalid: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(outputDir, "music.m3u8"), playlist, 0644)
+}
+
+// Helper function to build the text of a VOD playlist from segment names and durations in seconds
+func buildM3U8Playlist(chunkFiles []string, durations []float64) []byte {
+	// The target duration is the longest segment rounded up, as written with millisecond precision. RFC 8216
+	// only asks for the rounded duration, rounding up also satisfies players that compare exact durations.
+	targetDuration := 1
+	for _, duration := range durations {
+		if rounded := int(math.Ceil(math.Round(duration*1000) / 1000)); rounded > targetDuration {
+			targetDuration = rounded
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&buf, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i, chunkFile := range chunkFiles {
+		fmt.Fprintf(&buf, "#EXTINF:%.3f,\n", durations[i])
+		buf.WriteString("chunk/" + url.PathEscape(chunkFile) + "\n")
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.Bytes()
+}
+
+// Helper function to check a VOD media playlist against the rules of RFC 8216
+func validateM3U8Playlist(playlist []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	lineNumber := 0
+	targetDuration := -1
+	seenTags := map[string]bool{}
+	pendingDuration := -1.0
+	segments := 0
+	ended := false
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		lineNumber++
+		if lineNumber == 1 {
+			if line != "#EXTM3U" {
+				return fmt.Errorf("line 1: playlist must start with #EXTM3U")
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if ended {
+			return fmt.Errorf("line %d: nothing may follow #EXT-X-ENDLIST", lineNumber)
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			// A URI line must follow the #EXTINF of its segment
+			if pendingDuration < 0 {
+				return fmt.Errorf("line %d: segment URI without #EXTINF", lineNumber)
+			}
+			if targetDuration < 0 {
+				return fmt.Errorf("line %d: #EXT-X-TARGETDURATION must appear before the first segment", lineNumber)
+			}
+			if int(math.Round(pendingDuration)) > targetDuration {
+				return fmt.Errorf("line %d: segment duration %.3f exceeds target duration %d", lineNumber, pendingDuration, targetDuration)
+			}
+			// Segments resolve against wherever the playlist was fetched from
+			if uri, err := url.Parse(line); err != nil || uri.IsAbs() || uri.Host != "" || strings.HasPrefix(line, "/") {
+				return fmt.Errorf("line %d: segment URI %q must be relative", lineNumber, line)
+			}
+			pendingDuration = -1
+			segments++
+			continue
+		}
+		if !strings.HasPrefix(line, "#EXT") {
+			continue // Comment
+		}
+
+		tag, value, _ := strings.Cut(line, ":")
+		switch tag {
+		case "#EXTINF":
+			if pendingDuration >= 0 {
+				return fmt.Errorf("line %d: #EXTINF without a segment URI", lineNumber)
+			}
+			durationText, _, _ := strings.Cut(value, ",")
+			duration, err := strconv.ParseFloat(durationText, 64)
+			if err != nil || duration < 0 {
+				return fmt.Errorf("line %d: invalid #EXTINF duration %q", lineNumber, durationText)
+			}
+			pendingDuration = duration
+		case "#EXT-X-ENDLIST":
+			if pendingDuration >= 0 {
+				return fmt.Errorf("line %d: #EXTINF without a segment URI", lineNumber)
+			}
+			ended = true
+		case "#EXT-X-VERSION", "#EXT-X-TARGETDURATION", "#EXT-X-MEDIA-SEQUENCE", "#EXT-X-PLAYLIST-TYPE":
+			// These tags must appear at most once and before the first segment
+			if seenTags[tag] {
+				return fmt.Errorf("line %d: duplicate %s", lineNumber, tag)
+			}
+			seenTags[tag] = true
+			if segments > 0 || pendingDuration >= 0 {
+				return fmt.Errorf("line %d: %s must appear before the first segment", lineNumber, tag)
+			}
+			number, err := strconv.Atoi(value)
+			switch tag {
+			case "#EXT-X-TARGETDURATION":
+				if err != nil || number < 0 {
+					return fmt.Errorf("line %d: invalid target duration %q", lineNumber, value)
+				}
+				targetDuration = number
+			case "#EXT-X-VERSION", "#EXT-X-MEDIA-SEQUENCE":
+				if err != nil || number < 0 {
+					return fmt.Errorf("line %d: invalid %s value %q", lineNumber, tag, value)
+				}
+			case "#EXT-X-PLAYLIST-TYPE":
+				if value != "VOD" && value != "EVENT" {
+					return fmt.Errorf("line %d: invalid playlist type %q", lineNumber, value)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if targetDuration < 0 {
+		return fmt.Errorf("missing #EXT-X-TARGETDURATION")
+	}
+	if pendingDuration >= 0 {
+		return fmt.Errorf("#EXTINF without a segment URI at end of playlist")
+	}
+	if segments == 0 {
+		return fmt.Errorf("playlist has no segments")
+	}
+	if !ended {
+		return fmt.Errorf("VOD playlist must end with #EXT-X-ENDLIST")
+	}
+	return nil
+}
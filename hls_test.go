@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildM3U8Playlist(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunks    []string
+		durations []float64
+		target    string
+	}{
+		{"whole seconds", []string{"000.mp3", "001.mp3"}, []float64{10, 4}, "#EXT-X-TARGETDURATION:10"},
+		{"just over a second boundary", []string{"000.mp3", "001.mp3"}, []float64{10.026, 3.2}, "#EXT-X-TARGETDURATION:11"},
+		{"below rounding", []string{"000.mp3"}, []float64{9.4}, "#EXT-X-TARGETDURATION:10"},
+		{"sub-millisecond noise", []string{"000.mp3"}, []float64{10.0000004}, "#EXT-X-TARGETDURATION:10"},
+		{"short song", []string{"000.mp3"}, []float64{0.3}, "#EXT-X-TARGETDURATION:1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			playlist := string(buildM3U8Playlist(test.chunks, test.durations))
+			if err := validateM3U8Playlist([]byte(playlist)); err != nil {
+				t.Fatalf("built playlist is invalid: %v\n%s", err, playlist)
+			}
+			if !strings.Contains(playlist, test.target+"\n") {
+				t.Errorf("want %s in\n%s", test.target, playlist)
+			}
+			for _, tag := range []string{"#EXT-X-MEDIA-SEQUENCE:0\n", "#EXT-X-PLAYLIST-TYPE:VOD\n"} {
+				if !strings.Contains(playlist, tag) {
+					t.Errorf("missing %q in\n%s", tag, playlist)
+				}
+			}
+			if !strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n") {
+				t.Errorf("playlist does not end with #EXT-X-ENDLIST:\n%s", playlist)
+			}
+			for _, chunk := range test.chunks {
+				if !strings.Contains(playlist, "\nchunk/"+chunk+"\n") {
+					t.Errorf("missing relative URI for %s in\n%s", chunk, playlist)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildM3U8PlaylistEscapesURIs(t *testing.T) {
+	playlist := string(buildM3U8Playlist([]string{"a b#1.mp3"}, []float64{5}))
+	if !strings.Contains(playlist, "\nchunk/a%20b%231.mp3\n") {
+		t.Errorf("segment name is not escaped:\n%s", playlist)
+	}
+	if err := validateM3U8Playlist([]byte(playlist)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateM3U8Playlist(t *testing.T) {
+	const header = "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n"
+	tests := []struct {
+		name     string
+		playlist string
+		err      string // Part of the expected error, empty for a valid playlist
+	}{
+		{"valid", header + "#EXTINF:10.000,\nchunk/000.mp3\n#EXTINF:4.500,\nchunk/001.mp3\n#EXT-X-ENDLIST\n", ""},
+		{"CRLF line endings", strings.ReplaceAll(header+"#EXTINF:9.5,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", "\n", "\r\n"), ""},
+		{"comment lines", header + "# produced by ffmpeg\n#EXTINF:9.5,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", ""},
+		{"missing header", "#EXT-X-TARGETDURATION:10\n#EXTINF:9,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", "must start with #EXTM3U"},
+		{"missing ENDLIST", header + "#EXTINF:10.000,\nchunk/000.mp3\n", "must end with #EXT-X-ENDLIST"},
+		{"segment after ENDLIST", header + "#EXTINF:10,\nchunk/000.mp3\n#EXT-X-ENDLIST\n#EXTINF:10,\nchunk/001.mp3\n", "nothing may follow"},
+		{"EXTINF before ENDLIST without URI", header + "#EXTINF:10,\n#EXT-X-ENDLIST\n", "without a segment URI"},
+		{"no segments", header + "#EXT-X-ENDLIST\n", "no segments"},
+		{"missing TARGETDURATION", "#EXTM3U\n#EXTINF:4,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", "TARGETDURATION must appear before"},
+		{"segment rounds above TARGETDURATION", header + "#EXTINF:10.500,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", "exceeds target duration"},
+		{"segment rounds to TARGETDURATION", header + "#EXTINF:10.499,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", ""},
+		{"invalid TARGETDURATION", "#EXTM3U\n#EXT-X-TARGETDURATION:ten\n#EXTINF:4,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", "invalid target duration"},
+		{"negative MEDIA-SEQUENCE", strings.Replace(header, "SEQUENCE:0", "SEQUENCE:-1", 1) + "#EXTINF:4,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", "invalid #EXT-X-MEDIA-SEQUENCE"},
+		{"duplicate MEDIA-SEQUENCE", header + "#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:4,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", "duplicate #EXT-X-MEDIA-SEQUENCE"},
+		{"MEDIA-SEQUENCE after first segment", "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:4,\nchunk/000.mp3\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-ENDLIST\n", "before the first segment"},
+		{"invalid playlist type", strings.Replace(header, "VOD", "LIVE", 1) + "#EXTINF:4,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", "invalid playlist type"},
+		{"invalid EXTINF", header + "#EXTINF:abc,\nchunk/000.mp3\n#EXT-X-ENDLIST\n", "invalid #EXTINF duration"},
+		{"URI without EXTINF", header + "chunk/000.mp3\n#EXT-X-ENDLIST\n", "segment URI without #EXTINF"},
+		{"absolute URI", header + "#EXTINF:4,\nhttp://example.com/chunk/000.mp3\n#EXT-X-ENDLIST\n", "must be relative"},
+		{"host relative URI", header + "#EXTINF:4,\n//example.com/chunk/000.mp3\n#EXT-X-ENDLIST\n", "must be relative"},
+		{"root relative URI", header + "#EXTINF:4,\n/files/cache/music/a/chunk/000.mp3\n#EXT-X-ENDLIST\n", "must be relative"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateM3U8Playlist([]byte(test.playlist))
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case test.err != "" && err == nil:
+				t.Errorf("want error containing %q, got none", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Errorf("want error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
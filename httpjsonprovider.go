@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// HTTPJSONProviderConfig describes an HTTP JSON API in providers.json.
+//
+// URL templates may contain {song}, {singer}, {limit} and {id} placeholders,
+// which are query-escaped before substitution. Paths are dot separated keys
+// into the JSON response, with numbers selecting array elements (e.g. "data.list.0").
+type HTTPJSONProviderConfig struct {
+	Name        string            `json:"name"`
+	SearchURL   string            `json:"search_url"`
+	ResultsPath string            `json:"results_path"`
+	ResolveURL  string            `json:"resolve_url"`
+	ResolvePath string            `json:"resolve_path"`
+	LyricURL    string            `json:"lyric_url"`
+	LyricPath   string            `json:"lyric_path"`
+	CoverURL    string            `json:"cover_url"`
+	CoverPath   string            `json:"cover_path"`
+	Headers     map[string]string `json:"headers"`
+	Fields      struct {
+		ID       string `json:"id"`
+		Title    string `json:"title"`
+		Artist   string `json:"artist"`
+		Album    string `json:"album"`
+		Music    string `json:"music"`
+		Cover    string `json:"cover"`
+		Lyric    string `json:"lyric"`
+		Duration string `json:"duration"`
+	} `json:"fields"`
+}
+
+// HTTPJSONProvider is a provider driven entirely by configuration.
+type HTTPJSONProvider struct {
+	config HTTPJSONProviderConfig
+	client *http.Client
+}
+
+// NewHTTPJSONProvider creates a provider from its providers.json entry.
+func NewHTTPJSONProvider(config HTTPJSONProviderConfig, client *http.Client) (*HTTPJSONProvider, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("provider name is empty")
+	}
+	if config.SearchURL == "" {
+		return nil, fmt.Errorf("provider %s has no search_url", config.Name)
+	}
+	if config.Fields.Title == "" {
+		config.Fields.Title = "title"
+	}
+	if config.Fields.Artist == "" {
+		config.Fields.Artist = "artist"
+	}
+	return &HTTPJSONProvider{config: config, client: client}, nil
+}
+
+func (p *HTTPJSONProvider) Name() string {
+	return p.config.Name
+}
+
+// Helper function to fill the placeholders of a URL template
+func expandURLTemplate(template string, values map[string]string) string {
+	for key, value := range values {
+		template = strings.ReplaceAll(template, "{"+key+"}", url.QueryEscape(value))
+	}
+	return template
+}
+
+// Helper function to request a URL and decode the JSON response
+func (p *HTTPJSONProvider) getJSON(ctx context.Context, rawURL string) (any, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range p.config.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching the data from provider %s: %w", p.config.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("provider %s returned status %d", p.config.Name, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the response body from provider %s: %w", p.config.Name, err)
+	}
+	var data any
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling the data from provider %s: %w", p.config.Name, err)
+	}
+	return data, nil
+}
+
+// Helper function to look up a dot separated path in decoded JSON
+func jsonPathLookup(data any, path string) any {
+	if path == "" {
+		return data
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch value := data.(type) {
+		case map[string]any:
+			data = value[key]
+		case []any:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(value) {
+				return nil
+			}
+			data = value[index]
+		default:
+			return nil
+		}
+	}
+	return data
+}
+
+// Helper function to convert a JSON scalar to a string
+func jsonString(data any) string {
+	switch value := data.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return ""
+	}
+}
+
+// Helper function to map a JSON object to a track using the configured fields
+func (p *HTTPJSONProvider) trackFromJSON(data any) Track {
+	fields := p.config.Fields
+	track := Track{
+		Provider: p.config.Name,
+		Title:    jsonString(jsonPathLookup(data, fields.Title)),
+		Artist:   jsonString(jsonPathLookup(data, fields.Artist)),
+	}
+	if fields.ID != "" {
+		track.ID = jsonString(jsonPathLookup(data, fields.ID))
+	}
+	if fields.Album != "" {
+		track.Album = jsonString(jsonPathLookup(data, fields.Album))
+	}
+	if fields.Music != "" {
+		track.MusicURL = jsonString(jsonPathLookup(data, fields.Music))
+	}
+	if fields.Cover != "" {
+		track.CoverURL = jsonString(jsonPathLookup(data, fields.Cover))
+	}
+	if fields.Lyric != "" {
+		track.Lyric = jsonString(jsonPathLookup(data, fields.Lyric))
+	}
+	if fields.Duration != "" {
+		duration, _ := strconv.ParseFloat(jsonString(jsonPathLookup(data, fields.Duration)), 64)
+		track.Duration = int(duration)
+	}
+	return track
+}
+
+func (p *HTTPJSONProvider) Search(ctx context.Context, song, singer string, limit int) ([]Track, error) {
+	fmt.Printf("[Info] Searching provider %s for %s by %s\n", p.config.Name, song, singer)
+	data, err := p.getJSON(ctx, expandURLTemplate(p.config.SearchURL, map[string]string{
+		"song":   song,
+		"singer": singer,
+		"limit":  strconv.Itoa(limit),
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	// A single object is treated as a one element result list
+	results := jsonPathLookup(data, p.config.ResultsPath)
+	var items []any
+	switch value := results.(type) {
+	case []any:
+		items = value
+	case map[string]any:
+		items = []any{value}
+	}
+
+	var tracks []Track
+	for _, item := range items {
+		if limit > 0 && len(tracks) >= limit {
+			break
+		}
+		track := p.trackFromJSON(item)
+		if track.Title == "" {
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+func (p *HTTPJSONProvider) ResolveTrack(ctx context.Context, track Track) (Track, error) {
+	if track.MusicURL != "" || p.config.ResolveURL == "" {
+		return track, nil
+	}
+	data, err := p.getJSON(ctx, expandURLTemplate(p.config.ResolveURL, map[string]string{"id": track.ID}))
+	if err != nil {
+		return Track{}, err
+	}
+	resolved := p.trackFromJSON(jsonPathLookup(data, p.config.ResolvePath))
+	// Keep the search result metadata where the resolve response has none
+	if resolved.ID == "" {
+		resolved.ID = track.ID
+	}
+	if resolved.Title == "" {
+		resolved.Title = track.Title
+	}
+	if resolved.Artist == "" {
+		resolved.Artist = track.Artist
+	}
+	if resolved.Album == "" {
+		resolved.Album = track.Album
+	}
+	if resolved.CoverURL == "" {
+		resolved.CoverURL = track.CoverURL
+	}
+	if resolved.Lyric == "" {
+		resolved.Lyric = track.Lyric
+	}
+	if resolved.Duration == 0 {
+		resolved.Duration = track.Duration
+	}
+	return resolved, nil
+}
+
+func (p *HTTPJSONProvider) FetchLyric(ctx context.Context, track Track) (string, error) {
+	if track.Lyric != "" || p.config.LyricURL == "" {
+		return track.Lyric, nil
+	}
+	data, err := p.getJSON(ctx, expandURLTemplate(p.config.LyricURL, map[string]string{"id": track.ID}))
+	if err != nil {
+		return "", err
+	}
+	return jsonString(jsonPathLookup(data, p.config.LyricPath)), nil
+}
+
+func (p *HTTPJSONProvider) FetchCover(ctx context.Context, track Track) (string, error) {
+	if track.CoverURL != "" || p.config.CoverURL == "" {
+		return track.CoverURL, nil
+	}
+	data, err := p.getJSON(ctx, expandURLTemplate(p.config.CoverURL, map[string]string{"id": track.ID}))
+	if err != nil {
+		return "", err
+	}
+	return jsonString(jsonPathLookup(data, p.config.CoverPath)), nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper function to serve canned JSON responses by request path
+func newJSONProviderServer(t *testing.T, responses map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			http.Error(w, "missing key", http.StatusUnauthorized)
+			return
+		}
+		body, ok := responses[r.URL.Path+"?"+r.URL.RawQuery]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Helper function to create a provider with the field mapping of a typical API
+func newTestJSONProvider(t *testing.T, server *httptest.Server) *HTTPJSONProvider {
+	t.Helper()
+	config := HTTPJSONProviderConfig{
+		Name:        "test",
+		SearchURL:   server.URL + "/search?q={song}&singer={singer}&n={limit}",
+		ResultsPath: "data.list",
+		ResolveURL:  server.URL + "/song?id={id}",
+		ResolvePath: "data",
+		LyricURL:    server.URL + "/lyric?id={id}",
+		LyricPath:   "data.lrc",
+		CoverURL:    server.URL + "/cover?id={id}",
+		CoverPath:   "data.images.0.url",
+		Headers:     map[string]string{"X-Api-Key": "secret"},
+	}
+	config.Fields.ID = "mid"
+	config.Fields.Title = "name"
+	config.Fields.Artist = "singer.0.name"
+	config.Fields.Album = "album.title"
+	config.Fields.Music = "url"
+	config.Fields.Duration = "interval"
+	provider, err := NewHTTPJSONProvider(config, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestNewHTTPJSONProvider(t *testing.T) {
+	if _, err := NewHTTPJSONProvider(HTTPJSONProviderConfig{SearchURL: "http://example.com"}, http.DefaultClient); err == nil {
+		t.Error("provider without a name was accepted")
+	}
+	if _, err := NewHTTPJSONProvider(HTTPJSONProviderConfig{Name: "test"}, http.DefaultClient); err == nil {
+		t.Error("provider without a search URL was accepted")
+	}
+	provider, err := NewHTTPJSONProvider(HTTPJSONProviderConfig{Name: "test", SearchURL: "http://example.com"}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.Name() != "test" || provider.config.Fields.Title != "title" || provider.config.Fields.Artist != "artist" {
+		t.Errorf("unexpected defaults: %+v", provider.config.Fields)
+	}
+}
+
+func TestHTTPJSONProviderSearch(t *testing.T) {
+	server := newJSONProviderServer(t, map[string]string{
+		"/search?q=%E7%A8%BB%E9%A6%99&singer=%E5%91%A8%E6%9D%B0%E4%BC%A6&n=2": `{"data": {"list": [
+			{"mid": 1001, "name": "稻香", "singer": [{"name": "周杰伦"}], "album": {"title": "魔杰座"}, "interval": 223.6},
+			{"mid": "x", "singer": [{"name": "无名"}]},
+			{"mid": "1002", "name": "稻香 (Live)", "singer": [{"name": "周杰伦"}], "url": "http://cdn.example/1002.mp3"},
+			{"mid": "1003", "name": "稻香", "singer": [{"name": "翻唱"}]}
+		]}}`,
+		"/search?q=a+b%26c&singer=&n=5": `{"data": {"list": {"mid": "7", "name": "a b&c", "singer": []}}}`,
+		"/search?q=empty&singer=&n=5":   `{"data": {"list": []}}`,
+		"/search?q=missing&singer=&n=5": `{"data": {}}`,
+		"/search?q=null&singer=&n=5":    `{"data": null}`,
+	})
+	provider := newTestJSONProvider(t, server)
+
+	tracks, err := provider.Search(t.Context(), "稻香", "周杰伦", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Track{
+		{Provider: "test", ID: "1001", Title: "稻香", Artist: "周杰伦", Album: "魔杰座", Duration: 223},
+		{Provider: "test", ID: "1002", Title: "稻香 (Live)", Artist: "周杰伦", MusicURL: "http://cdn.example/1002.mp3"},
+	}
+	if !reflect.DeepEqual(tracks, want) {
+		t.Errorf("got %+v\nwant %+v", tracks, want)
+	}
+
+	// A single object is a one element list, and placeholders are query escaped
+	tracks, err = provider.Search(t.Context(), "a b&c", "", 5)
+	if err != nil || len(tracks) != 1 || tracks[0].ID != "7" || tracks[0].Artist != "" {
+		t.Errorf("single result: got %+v, %v", tracks, err)
+	}
+
+	for _, song := range []string{"empty", "missing", "null"} {
+		tracks, err := provider.Search(t.Context(), song, "", 5)
+		if err != nil || len(tracks) != 0 {
+			t.Errorf("%s results: got %+v, %v", song, tracks, err)
+		}
+	}
+}
+
+func TestHTTPJSONProviderErrors(t *testing.T) {
+	server := newJSONProviderServer(t, map[string]string{
+		"/search?q=broken&singer=&n=5": `{"data": [`,
+		"/search?q=html&singer=&n=5":   `<html>rate limited</html>`,
+		"/song?id=broken":              `not json`,
+		"/lyric?id=broken":             ``,
+	})
+	provider := newTestJSONProvider(t, server)
+
+	for _, song := range []string{"broken", "html", "unknown"} {
+		if tracks, err := provider.Search(t.Context(), song, "", 5); err == nil {
+			t.Errorf("search %s: got %+v without an error", song, tracks)
+		}
+	}
+	if _, err := provider.ResolveTrack(t.Context(), Track{ID: "broken"}); err == nil {
+		t.Error("resolve of an invalid response did not fail")
+	}
+	if _, err := provider.ResolveTrack(t.Context(), Track{ID: "unknown"}); err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("resolve of a missing song: got %v", err)
+	}
+	if _, err := provider.FetchLyric(t.Context(), Track{ID: "broken"}); err == nil {
+		t.Error("empty lyric response did not fail")
+	}
+	if _, err := provider.FetchCover(t.Context(), Track{ID: "unknown"}); err == nil {
+		t.Error("missing cover did not fail")
+	}
+
+	// Requests without the configured headers are refused by the server
+	provider.config.Headers = nil
+	if _, err := provider.Search(t.Context(), "broken", "", 5); err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Errorf("search without headers: got %v", err)
+	}
+}
+
+func TestHTTPJSONProviderResolveTrack(t *testing.T) {
+	server := newJSONProviderServer(t, map[string]string{
+		"/song?id=1001":   `{"data": {"mid": "1001", "url": "http://cdn.example/1001.flac", "interval": "224"}}`,
+		"/song?id=a%2Fb":  `{"data": {"url": "http://cdn.example/ab.mp3", "name": "Renamed"}}`,
+		"/song?id=nourl":  `{"data": {}}`,
+		"/lyric?id=1001":  `{"data": {"lrc": "[00:01.00]还记得你说家是唯一的城堡"}}`,
+		"/lyric?id=none":  `{"data": {}}`,
+		"/cover?id=1001":  `{"data": {"images": [{"url": "http://cdn.example/1001.jpg"}]}}`,
+		"/cover?id=empty": `{"data": {"images": []}}`,
+	})
+	provider := newTestJSONProvider(t, server)
+	searched := Track{Provider: "test", ID: "1001", Title: "稻香", Artist: "周杰伦", Album: "魔杰座", CoverURL: "http://cdn.example/small.jpg", Duration: 223}
+
+	resolved, err := provider.ResolveTrack(t.Context(), searched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := searched
+	want.MusicURL = "http://cdn.example/1001.flac"
+	want.Duration = 224
+	if resolved != want {
+		t.Errorf("got %+v\nwant %+v", resolved, want)
+	}
+
+	// Resolve responses override the search metadata they contain, and the ID is escaped
+	resolved, err = provider.ResolveTrack(t.Context(), Track{ID: "a/b", Title: "Old", Artist: "Someone"})
+	if err != nil || resolved.MusicURL != "http://cdn.example/ab.mp3" || resolved.Title != "Renamed" || resolved.Artist != "Someone" || resolved.ID != "a/b" {
+		t.Errorf("got %+v, %v", resolved, err)
+	}
+	resolved, err = provider.ResolveTrack(t.Context(), Track{ID: "nourl", Title: "Song"})
+	if err != nil || resolved.MusicURL != "" || resolved.Title != "Song" {
+		t.Errorf("empty resolve: got %+v, %v", resolved, err)
+	}
+
+	// Tracks that already have a music URL are not resolved again
+	playable := Track{ID: "unknown", MusicURL: "http://cdn.example/direct.mp3"}
+	if resolved, err := provider.ResolveTrack(t.Context(), playable); err != nil || resolved != playable {
+		t.Errorf("playable track: got %+v, %v", resolved, err)
+	}
+
+	lyric, err := provider.FetchLyric(t.Context(), Track{ID: "1001"})
+	if err != nil || lyric != "[00:01.00]还记得你说家是唯一的城堡" {
+		t.Errorf("lyric: got %q, %v", lyric, err)
+	}
+	if lyric, err := provider.FetchLyric(t.Context(), Track{ID: "none"}); err != nil || lyric != "" {
+		t.Errorf("missing lyric: got %q, %v", lyric, err)
+	}
+	if lyric, err := provider.FetchLyric(t.Context(), Track{ID: "unknown", Lyric: "inline"}); err != nil || lyric != "inline" {
+		t.Errorf("inline lyric: got %q, %v", lyric, err)
+	}
+
+	cover, err := provider.FetchCover(t.Context(), Track{ID: "1001"})
+	if err != nil || cover != "http://cdn.example/1001.jpg" {
+		t.Errorf("cover: got %q, %v", cover, err)
+	}
+	if cover, err := provider.FetchCover(t.Context(), Track{ID: "empty"}); err != nil || cover != "" {
+		t.Errorf("missing cover: got %q, %v", cover, err)
+	}
+	if cover, err := provider.FetchCover(t.Context(), Track{ID: "unknown", CoverURL: "http://cdn.example/known.jpg"}); err != nil || cover != "http://cdn.example/known.jpg" {
+		t.Errorf("known cover: got %q, %v", cover, err)
+	}
+}
+
+func TestHTTPJSONProviderWithoutOptionalURLs(t *testing.T) {
+	provider, err := NewHTTPJSONProvider(HTTPJSONProviderConfig{Name: "minimal", SearchURL: "http://127.0.0.1:1/search"}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	track := Track{ID: "1", Title: "Song"}
+	if resolved, err := provider.ResolveTrack(t.Context(), track); err != nil || resolved != track {
+		t.Errorf("resolve: got %+v, %v", resolved, err)
+	}
+	if lyric, err := provider.FetchLyric(t.Context(), track); err != nil || lyric != "" {
+		t.Errorf("lyric: got %q, %v", lyric, err)
+	}
+	if cover, err := provider.FetchCover(t.Context(), track); err != nil || cover != "" {
+		t.Errorf("cover: got %q, %v", cover, err)
+	}
+}
+
+func TestProvidersStopWithContext(t *testing.T) {
+	// The upstream never answers, only the cancelled request ends the call
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	jsonProvider := newTestJSONProvider(t, server)
+	yuafengProvider := NewYuafengProvider("test", server.URL, server.Client())
+
+	calls := map[string]func(ctx context.Context) error{
+		"json search": func(ctx context.Context) error {
+			_, err := jsonProvider.Search(ctx, "稻香", "", 1)
+			return err
+		},
+		"json resolve": func(ctx context.Context) error {
+			_, err := jsonProvider.ResolveTrack(ctx, Track{ID: "1001"})
+			return err
+		},
+		"json lyric": func(ctx context.Context) error {
+			_, err := jsonProvider.FetchLyric(ctx, Track{ID: "1001"})
+			return err
+		},
+		"json cover": func(ctx context.Context) error {
+			_, err := jsonProvider.FetchCover(ctx, Track{ID: "1001"})
+			return err
+		},
+		"yuafeng search": func(ctx context.Context) error {
+			_, err := yuafengProvider.Search(ctx, "稻香", "", 5)
+			return err
+		},
+		"yuafeng resolve": func(ctx context.Context) error {
+			_, err := yuafengProvider.ResolveTrack(ctx, Track{ID: "稻香#1"})
+			return err
+		},
+	}
+	for name, call := range calls {
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		start := time.Now()
+		err := call(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+			t.Errorf("%s: got %v after %s, want the context error", name, err, time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImportOptions controls how audio files are brought into the library.
+type ImportOptions struct {
+	Source    string `json:"source"`    // Directory to walk
+	Link      bool   `json:"link"`      // Hard-link the originals instead of copying them
+	Transcode bool   `json:"transcode"` // Produce music.mp3, chunks and playlist right away
+}
+
+// ImportResult is the outcome for a single source file.
+type ImportResult struct {
+	File   string `json:"file"`
+	Target string `json:"target,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ImportReport lists what an import did with every audio file it found.
+type ImportReport struct {
+	Imported  []ImportResult `json:"imported"`
+	Skipped   []ImportResult `json:"skipped"`
+	Ambiguous []ImportResult `json:"ambiguous"`
+}
+
+// importExtensions maps the audio extensions that can be imported to their music_full file name.
+var importExtensions = map[string]string{
+	".mp3":  "music_full.mp3",
+	".flac": "music_full.flac",
+	".wav":  "music_full.wav",
+	".aac":  "music_full.aac",
+	".ogg":  "music_full.ogg",
+	".m4a":  "music_full.m4a",
+}
+
+// Helper function to work out the artist and title of a file from its tags or a name like "<artist> - <title>"
+func getImportMetadata(filePath string) (string, string, AudioTags) {
+	tags, _ := readAudioTags(filePath)
+	artist, title := tags.Artist, tags.Title
+	name := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	if parts := strings.SplitN(name, " - ", 2); len(parts) == 2 {
+		setFirst(&artist, parts[0])
+		setFirst(&title, parts[1])
+	}
+	return strings.TrimSpace(artist), strings.TrimSpace(title), tags
+}
+
+// Helper function to copy a file, or hard-link it when asked to and possible
+func copyOrLinkFile(src, dst string, link bool) error {
+	if link {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+		// Hard links do not work across file systems, fall back to copying
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Helper function to find a lyric or cover file next to an audio file
+func findSidecarFile(filePath string, names ...string) string {
+	dir := filepath.Dir(filePath)
+	base := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	for _, name := range names {
+		candidate := filepath.Join(dir, strings.ReplaceAll(name, "{name}", base))
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Helper function to import every audio file below a directory into ./files/music
+func importMusic(ctx context.Context, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{Imported: []ImportResult{}, Skipped: []ImportResult{}, Ambiguous: []ImportResult{}}
+	info, err := os.Stat(options.Source)
+	if err != nil {
+		return report, err
+	}
+	if !info.IsDir() {
+		return report, fmt.Errorf("%s is not a directory", options.Source)
+	}
+
+	var files []string
+	err = filepath.WalkDir(options.Source, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			report.Skipped = append(report.Skipped, ImportResult{File: path, Reason: err.Error()})
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	sort.Strings(files)
+
+	musicDir := filepath.Join(filesRoot.dir, "music")
+	claimed := map[string]string{} // Folder name -> file that claimed it in this import
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		fullName, ok := importExtensions[strings.ToLower(filepath.Ext(file))]
+		if !ok {
+			continue // Covers, lyrics and other files are picked up next to the audio files
+		}
+
+		artist, title, tags := getImportMetadata(file)
+		if title == "" || artist == "" {
+			report.Ambiguous = append(report.Ambiguous, ImportResult{File: file, Reason: "no artist or title in the tags and the file name is not \"<artist> - <title>\""})
+			continue
+		}
+		dirName := safeFileName(artist + "-" + title)
+		if other, ok := claimed[dirName]; ok {
+			report.Ambiguous = append(report.Ambiguous, ImportResult{File: file, Target: dirName, Reason: "same artist and title as " + other})
+			continue
+		}
+		finalDir, err := filesRoot.Join("music/" + dirName)
+		if err != nil {
+			report.Skipped = append(report.Skipped, ImportResult{File: file, Reason: err.Error()})
+			continue
+		}
+		if _, err := os.Stat(finalDir); err == nil {
+			report.Skipped = append(report.Skipped, ImportResult{File: file, Target: dirName, Reason: "already in the library"})
+			continue
+		}
+		claimed[dirName] = file
+
+		err = importMusicFile(file, finalDir, fullName, tags, options.Link)
+		if err != nil {
+			report.Skipped = append(report.Skipped, ImportResult{File: file, Target: dirName, Reason: err.Error()})
+			continue
+		}
+
+		if options.Transcode {
+			err = ensureLocalMusicOutputs(ctx, musicDir, dirName)
+			if err != nil {
+				// The original is in place, streaming files are produced on the first request instead
+				fmt.Printf("[Warning] Imported %s without streaming files: %v\n", dirName, err)
+			}
+		}
+		if lib := getLibrary(); lib != nil {
+			lib.IndexLocalDir(musicDir, dirName)
+		}
+		report.Imported = append(report.Imported, ImportResult{File: file, Target: dirName})
+	}
+	return report, nil
+}
+
+// Helper function to lay out a single track folder in a staging directory and publish it
+func importMusicFile(file, finalDir, fullName string, tags AudioTags, link bool) error {
+	stagingDir, err := createStagingDir(finalDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	err = copyOrLinkFile(file, filepath.Join(stagingDir, fullName), link)
+	if err != nil {
+		return err
+	}
+	// Embedded lyrics and covers are extracted when the folder is indexed, sidecar files are used otherwise
+	if tags.Lyrics == "" {
+		if lyricFile := findSidecarFile(file, "{name}.lrc", "lyric.lrc"); lyricFile != "" {
+			if err := copyOrLinkFile(lyricFile, filepath.Join(stagingDir, "lyric.lrc"), false); err != nil {
+				return err
+			}
+		}
+	}
+	if len(tags.Cover) == 0 {
+		if coverFile := findSidecarFile(file, "{name}.jpg", "{name}.png", "cover.jpg", "cover.png", "folder.jpg", "folder.png"); coverFile != "" {
+			coverName := "cover.jpg"
+			if strings.EqualFold(filepath.Ext(coverFile), ".png") {
+				coverName = "cover.png"
+			}
+			if err := copyOrLinkFile(coverFile, filepath.Join(stagingDir, coverName), false); err != nil {
+				return err
+			}
+		}
+	}
+	return publishStagingDir(stagingDir, finalDir)
+}
+
+// Helper function to print an import report
+func printImportReport(report ImportReport) {
+	for _, result := range report.Imported {
+		fmt.Printf("[Info] Imported %s -> %s\n", result.File, result.Target)
+	}
+	for _, result := range report.Skipped {
+		fmt.Printf("[Warning] Skipped %s: %s\n", result.File, result.Reason)
+	}
+	for _, result := range report.Ambiguous {
+		fmt.Printf("[Warning] Ambiguous %s: %s\n", result.File, result.Reason)
+	}
+	fmt.Printf("[Info] Import finished: %d imported, %d skipped, %d ambiguous\n", len(report.Imported), len(report.Skipped), len(report.Ambiguous))
+}
+
+// Helper function to run the import subcommand, returning the process exit code
+func runImportCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	link := flags.Bool("link", false, "hard-link the original files instead of copying them")
+	noTranscode := flags.Bool("no-transcode", false, "leave compressing and segmenting to the first request")
+	overwrite := flags.Bool("overwrite", false, "replace cache entries that already exist (bundles only)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [-link] [-no-transcode] <directory>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flags.Output(), "       %s import [-overwrite] <bundle.tar.gz>\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	// A file is a bundle made by the export subcommand, a directory holds audio files
+	if info, err := os.Stat(flags.Arg(0)); err == nil && !info.IsDir() {
+		return runBundleImport(flags.Arg(0), *overwrite)
+	}
+
+	options := ImportOptions{Source: flags.Arg(0), Link: *link, Transcode: !*noTranscode}
+	report, err := importMusic(withPriority(context.Background(), PriorityBackground), options)
+	printImportReport(report)
+	closeLibrary()
+	if err != nil {
+		fmt.Println("[Error] Import failed:", err)
+		return 1
+	}
+	return 0
+}
+
+// importRun is an import started through the admin endpoint.
+type importRun struct {
+	ID         string        `json:"id"`
+	Options    ImportOptions `json:"options"`
+	State      string        `json:"state"` // running, done or failed
+	Error      string        `json:"error,omitempty"`
+	Report     *ImportReport `json:"report,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+var (
+	importRunsMu sync.Mutex
+	importRuns   = map[string]*importRun{}
+)
+
+// importHandler handles POST /api/admin/import and GET /api/admin/import/{id}.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "MeowMusicEmbeddedServer")
+	fmt.Printf("[Web Access] Handling request for %s\n", r.URL.Path)
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/import"), "/")
+	if id != "" {
+		importRunsMu.Lock()
+		run, ok := importRuns[id]
+		var snapshot importRun
+		if ok {
+			snapshot = *run
+		}
+		importRunsMu.Unlock()
+		if !ok {
+			http.Error(w, "import not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(snapshot)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	options := ImportOptions{Transcode: true}
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(options.Source); err != nil || !info.IsDir() {
+		http.Error(w, "source must be an existing directory", http.StatusBadRequest)
+		return
+	}
+
+	run := &importRun{ID: newJobID(), Options: options, State: "running", StartedAt: time.Now()}
+	importRunsMu.Lock()
+	importRuns[run.ID] = run
+	importRunsMu.Unlock()
+	fmt.Printf("[Info] Started import %s of %s\n", run.ID, options.Source)
+
+	go func() {
+		report, err := importMusic(withPriority(context.Background(), PriorityBackground), options)
+		printImportReport(report)
+		finished := time.Now()
+		importRunsMu.Lock()
+		defer importRunsMu.Unlock()
+		run.Report = &report
+		run.FinishedAt = &finished
+		run.State = "done"
+		if err != nil {
+			run.State = "failed"
+			run.Error = err.Error()
+		}
+	}()
+
+	w.Header().Set("Location", "/api/admin/import/"+run.ID)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	importRunsMu.Lock()
+	json.NewEncoder(w).Encode(run)
+	importRunsMu.Unlock()
+}
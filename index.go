@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"path/filepath"
 )
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -16,12 +15,12 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Serve index.html in theme directory
-	indexPath := filepath.Join("theme", "index.html")
+	indexPath, err := themeRoot.Resolve("index.html")
 
 	// Check if index.html exists in theme directory
-	if _, err := os.Stat(indexPath); os.IsNotExist(err) {
+	if err != nil {
 		defaultIndexPage(w)
-	} else if err != nil {
+	} else if _, err := os.Stat(indexPath); err != nil {
 		defaultIndexPage(w)
 	} else {
 		http.ServeFile(w, r, indexPath)
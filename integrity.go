@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CacheArtifact is a file of a cache entry with the size and checksum it had when the entry was written.
+type CacheArtifact struct {
+	File   string `json:"file"` // Path inside the media folder, with forward slashes
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// CacheIntegrity records where a cache entry came from and the files it is expected to have.
+type CacheIntegrity struct {
+	Provider  string          `json:"provider,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Artifacts []CacheArtifact `json:"artifacts"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// cacheFileData is the layout of a cache file: the music item with its integrity record.
+// Readers that only want the music item ignore the record.
+type cacheFileData struct {
+	MusicItem
+	Integrity *CacheIntegrity `json:"integrity,omitempty"`
+}
+
+// Cache artifact kinds, deciding how a broken file is repaired
+const (
+	artifactOriginal = "original" // The downloaded music_full file, only a new download replaces it
+	artifactDerived  = "derived"  // music.mp3, the playlist and its chunks, produced again from the original
+	artifactExtra    = "extra"    // Cover and lyrics, dropped when broken
+)
+
+// CacheVerifyResult is the outcome of checking one cache entry.
+type CacheVerifyResult struct {
+	Name     string   `json:"name"`
+	Problems []string `json:"problems,omitempty"`
+	Action   string   `json:"action,omitempty"` // retranscoded, refetched, dropped, removed
+	Error    string   `json:"error,omitempty"`
+
+	refetch     bool
+	retranscode bool
+	dropped     []string // Broken extra files
+}
+
+// Helper function to tell whether a verification found nothing wrong
+func (result CacheVerifyResult) healthy() bool {
+	return len(result.Problems) == 0
+}
+
+// healFlights coalesces repairs of the same cache entry
+var healFlights flightGroup
+
+// Helper function to get the kind of a file in a cache media folder
+func cacheArtifactKind(file string) string {
+	switch {
+	case strings.HasPrefix(file, "music_full"):
+		return artifactOriginal
+	case file == "music.mp3", file == "music.m3u8", strings.HasPrefix(file, "chunk/"):
+		return artifactDerived
+	}
+	return artifactExtra
+}
+
+// Helper function to compute the SHA-256 checksum of a file
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Helper function to record the files of a cache media folder
+func buildCacheIntegrity(mediaDir, provider, id string) (*CacheIntegrity, error) {
+	integrity := &CacheIntegrity{Provider: provider, ID: id, Artifacts: []CacheArtifact{}, CreatedAt: time.Now()}
+	err := filepath.WalkDir(mediaDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(mediaDir, path)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		integrity.Artifacts = append(integrity.Artifacts, CacheArtifact{File: filepath.ToSlash(rel), Size: info.Size(), SHA256: sum})
+		return nil
+	})
+	return integrity, err
+}
+
+// Helper function to read a cache file with its integrity record
+func readCacheFileData(filePath string) (cacheFileData, error) {
+	var data cacheFileData
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return data, err
+	}
+	err = json.Unmarshal(content, &data)
+	return data, err
+}
+
+// Helper function to get the media folder of a cache entry
+func getCacheMediaDir(name string) (string, error) {
+	return filesRoot.Join("cache/music/" + name)
+}
+
+// Helper function to list the files a cached music item links to, by the URL field they come from
+func getCacheItemFiles(musicItem MusicItem) map[string]string {
+	files := map[string]string{}
+	for field, link := range map[string]string{
+		"audio_full_url": musicItem.AudioFullURL,
+		"audio_url":      musicItem.AudioURL,
+		"m3u8_url":       musicItem.M3U8URL,
+		"cover_url":      musicItem.CoverURL,
+		"lyric_url":      musicItem.LyricURL,
+	} {
+		parsed, err := url.Parse(link)
+		if link == "" || err != nil || !strings.HasPrefix(parsed.Path, "/files/cache/music/") {
+			continue
+		}
+		// The folder part is the entry name itself, only the file inside it is kept
+		_, file, ok := strings.Cut(strings.TrimPrefix(parsed.Path, "/files/cache/music/"), "/")
+		if ok && file != "" {
+			files[field] = file
+		}
+	}
+	return files
+}
+
+// Helper function to list the segments a cached playlist refers to
+func getPlaylistSegments(playlistPath string) ([]string, error) {
+	content, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateM3U8Playlist(content); err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if segment, err := url.PathUnescape(line); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	return segments, nil
+}
+
+// Helper function to check that an audio file can be decoded, skipped when ffprobe is not installed
+func checkAudioDecodes(ctx context.Context, filePath string) error {
+	ctx, release, err := getTranscodePool().Acquire(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	duration, err := probeMusicDuration(ctx, filePath)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return fmt.Errorf("no audio")
+	}
+	return nil
+}
+
+// Helper function to check the files of a cache entry. The quick check only looks at which files exist
+// and their sizes, the deep check also compares checksums and decodes the audio.
+func verifyCacheEntry(ctx context.Context, name string, deep bool) (CacheVerifyResult, cacheFileData) {
+	result := CacheVerifyResult{Name: name}
+	broken := map[string]string{}
+	addProblem := func(file, problem string) {
+		if _, ok := broken[file]; !ok {
+			broken[file] = problem
+		}
+	}
+
+	cacheFile, err := cacheRoot.Join(name + ".json")
+	if err != nil {
+		result.Problems = []string{err.Error()}
+		result.refetch = true
+		return result, cacheFileData{}
+	}
+	data, err := readCacheFileData(cacheFile)
+	if err != nil {
+		result.Problems = []string{"cache file unreadable: " + err.Error()}
+		result.refetch = true
+		return result, data
+	}
+	mediaDir, err := getCacheMediaDir(name)
+	if err != nil {
+		result.Problems = []string{err.Error()}
+		result.refetch = true
+		return result, data
+	}
+
+	// Every linked file must exist and hold data
+	linked := getCacheItemFiles(data.MusicItem)
+	for _, file := range linked {
+		info, err := os.Stat(filepath.Join(mediaDir, filepath.FromSlash(file)))
+		switch {
+		case err != nil:
+			addProblem(file, "missing")
+		case info.Size() == 0:
+			addProblem(file, "empty")
+		}
+	}
+	if playlist, ok := linked["m3u8_url"]; ok && broken[playlist] == "" {
+		segments, err := getPlaylistSegments(filepath.Join(mediaDir, filepath.FromSlash(playlist)))
+		if err != nil {
+			addProblem(playlist, "invalid playlist: "+err.Error())
+		}
+		for _, segment := range segments {
+			if info, err := os.Stat(filepath.Join(mediaDir, filepath.FromSlash(segment))); err != nil || info.Size() == 0 {
+				addProblem(segment, "missing")
+			}
+		}
+	}
+
+	// Recorded files must still have the size, and for a deep check the content, they were written with
+	if data.Integrity != nil {
+		for _, artifact := range data.Integrity.Artifacts {
+			filePath := filepath.Join(mediaDir, filepath.FromSlash(artifact.File))
+			info, err := os.Stat(filePath)
+			switch {
+			case err != nil:
+				addProblem(artifact.File, "missing")
+			case info.Size() != artifact.Size:
+				addProblem(artifact.File, fmt.Sprintf("size %d, expected %d", info.Size(), artifact.Size))
+			case deep:
+				if sum, err := hashFile(filePath); err != nil || sum != artifact.SHA256 {
+					addProblem(artifact.File, "checksum mismatch")
+				}
+			}
+		}
+	}
+
+	if deep {
+		for _, field := range []string{"audio_full_url", "audio_url"} {
+			file, ok := linked[field]
+			if !ok || broken[file] != "" {
+				continue
+			}
+			if err := checkAudioDecodes(ctx, filepath.Join(mediaDir, filepath.FromSlash(file))); err != nil {
+				addProblem(file, "undecodable: "+err.Error())
+			}
+		}
+	}
+
+	files := make([]string, 0, len(broken))
+	for file := range broken {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		result.Problems = append(result.Problems, file+": "+broken[file])
+		switch cacheArtifactKind(file) {
+		case artifactOriginal:
+			result.refetch = true
+		case artifactDerived:
+			result.retranscode = true
+		default:
+			result.dropped = append(result.dropped, file)
+		}
+	}
+	// Without the original nothing can be produced again
+	if _, ok := linked["audio_full_url"]; !ok && result.retranscode {
+		result.refetch = true
+	}
+	return result, data
+}
+
+// Helper function to produce music.mp3, the playlist and its chunks of a cache entry again from its original
+func retranscodeCacheEntry(ctx context.Context, name string, data cacheFileData) error {
+	mediaDir, err := getCacheMediaDir(name)
+	if err != nil {
+		return err
+	}
+	original := getCacheItemFiles(data.MusicItem)["audio_full_url"]
+
+	// Joined with fetches of the same track, which use the same directory as key
+	_, err, _ = trackFlights.Do(mediaDir, func() (MusicItem, error) {
+		stagingDir, err := createStagingDir(mediaDir)
+		if err != nil {
+			return MusicItem{}, err
+		}
+		defer os.RemoveAll(stagingDir)
+
+		// The original, cover and lyrics are carried over, hard-linked where possible
+		entries, err := os.ReadDir(mediaDir)
+		if err != nil {
+			return MusicItem{}, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || cacheArtifactKind(entry.Name()) == artifactDerived {
+				continue
+			}
+			err = copyOrLinkFile(filepath.Join(mediaDir, entry.Name()), filepath.Join(stagingDir, entry.Name()), true)
+			if err != nil {
+				return MusicItem{}, err
+			}
+		}
+
+		err = compressAndSegmentAudio(ctx, filepath.Join(stagingDir, filepath.FromSlash(original)), stagingDir, nil)
+		if err != nil {
+			return MusicItem{}, err
+		}
+		err = createM3U8Playlist(ctx, stagingDir)
+		if err != nil {
+			return MusicItem{}, err
+		}
+		return MusicItem{}, publishStagingDir(stagingDir, mediaDir)
+	})
+	return err
+}
+
+// Helper function to download a cache entry again from the provider it came from, or by searching for it
+func refetchCacheEntry(ctx context.Context, name string, data cacheFileData) (MusicItem, error) {
+	if data.Title == "" {
+		return MusicItem{}, fmt.Errorf("the cache file does not name the song")
+	}
+	var musicItem MusicItem
+	var err error
+	if data.Integrity != nil && data.Integrity.Provider != "" && data.Integrity.ID != "" {
+		musicItem, err = requestAndCacheProviderTrack(ctx, data.Integrity.Provider, data.Integrity.ID, data.Title, data.Artist, nil)
+	} else {
+		musicItem, err = requestAndCacheMusic(ctx, data.Title, data.Artist, nil)
+	}
+	if err != nil {
+		return MusicItem{}, err
+	}
+	if musicItem.Title == "" {
+		return MusicItem{}, fmt.Errorf("no provider returned the song")
+	}
+	// A search may return the song under another name, the old entry then goes
+	if newName := safeFileName(musicItem.Artist + "-" + musicItem.Title); newName != name {
+		if err := getCacheManager().remove(CacheEntry{Name: name, HasJSON: true, HasMedia: true}); err != nil {
+			fmt.Printf("[Error] Failed to remove replaced cache entry %s: %v\n", name, err)
+		}
+	}
+	return musicItem, nil
+}
+
+// Helper function to repair a cache entry after verification found problems. Entries that cannot be
+// repaired are removed, so the cache never links to broken files.
+func healCacheEntry(ctx context.Context, result CacheVerifyResult, data cacheFileData) (CacheVerifyResult, MusicItem) {
+	musicItem, err, _ := healFlights.Do(result.Name, func() (MusicItem, error) {
+		if result.refetch {
+			fmt.Printf("[Info] Fetching broken cache entry %s again\n", result.Name)
+			result.Action = "refetched"
+			return refetchCacheEntry(ctx, result.Name, data)
+		}
+
+		musicItem := data.MusicItem
+		if result.retranscode {
+			fmt.Printf("[Info] Transcoding broken cache entry %s again\n", result.Name)
+			result.Action = "retranscoded"
+			if err := retranscodeCacheEntry(ctx, result.Name, data); err != nil {
+				return MusicItem{}, err
+			}
+		}
+		if len(result.dropped) > 0 {
+			if result.Action == "" {
+				result.Action = "dropped"
+			}
+			mediaDir, err := getCacheMediaDir(result.Name)
+			if err != nil {
+				return MusicItem{}, err
+			}
+			for field, file := range getCacheItemFiles(musicItem) {
+				if !containsString(result.dropped, file) {
+					continue
+				}
+				os.Remove(filepath.Join(mediaDir, filepath.FromSlash(file)))
+				switch field {
+				case "cover_url":
+					musicItem.CoverURL = ""
+				case "lyric_url":
+					musicItem.LyricURL = ""
+				}
+			}
+		}
+
+		var provider, id string
+		if data.Integrity != nil {
+			provider, id = data.Integrity.Provider, data.Integrity.ID
+		}
+		return musicItem, writeCacheFile(musicItem, provider, id)
+	})
+	if err == nil {
+		fmt.Printf("[Info] Repaired cache entry %s (%s)\n", result.Name, strings.Join(result.Problems, "; "))
+		return result, musicItem
+	}
+
+	fmt.Printf("[Error] Failed to repair cache entry %s, removing it: %v\n", result.Name, err)
+	result.Action, result.Error = "removed", err.Error()
+	if err := getCacheManager().remove(CacheEntry{Name: result.Name, HasJSON: true, HasMedia: true}); err != nil {
+		fmt.Printf("[Error] Failed to remove broken cache entry %s: %v\n", result.Name, err)
+	}
+	return result, MusicItem{}
+}
+
+// Helper function to check whether a list holds a string
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to check a cache entry before it is served. Derived files and extras are repaired
+// on the spot; an entry whose original is broken is removed, so the lookup goes upstream instead.
+func checkCacheEntry(ctx context.Context, entry LibraryEntry) (MusicItem, bool) {
+	result, data := verifyCacheEntry(ctx, strings.TrimSuffix(entry.Name, ".json"), false)
+	if result.healthy() {
+		return entry.Item, true
+	}
+	fmt.Printf("[Warning] Cache entry %s is broken: %s\n", result.Name, strings.Join(result.Problems, "; "))
+	if result.refetch {
+		// Downloading takes too long to wait for here, the lookup misses and goes upstream instead
+		fmt.Printf("[Warning] Removing cache entry %s, its original is broken\n", result.Name)
+		if err := getCacheManager().remove(CacheEntry{Name: result.Name, HasJSON: true, HasMedia: true}); err != nil {
+			fmt.Printf("[Error] Failed to remove broken cache entry %s: %v\n", result.Name, err)
+		}
+		return MusicItem{}, false
+	}
+	result, musicItem := healCacheEntry(ctx, result, data)
+	if result.Action == "removed" {
+		return MusicItem{}, false
+	}
+	return musicItem, true
+}
+
+// Helper function to check every cache entry, repairing the broken ones in the background priority
+func verifyCache(ctx context.Context, deep bool) []CacheVerifyResult {
+	ctx = withPriority(ctx, PriorityBackground)
+	files, err := filepath.Glob(filepath.Join(cacheRoot.dir, "*.json"))
+	if err != nil {
+		fmt.Println("[Error] Error reading cache directory:", err)
+	}
+	results := []CacheVerifyResult{}
+	checked := 0
+	for _, file := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		checked++
+		result, data := verifyCacheEntry(ctx, strings.TrimSuffix(filepath.Base(file), ".json"), deep)
+		if result.healthy() {
+			continue
+		}
+		fmt.Printf("[Warning] Cache entry %s is broken: %s\n", result.Name, strings.Join(result.Problems, "; "))
+		result, _ = healCacheEntry(ctx, result, data)
+		results = append(results, result)
+	}
+	fmt.Printf("[Info] Verified %d cache entries, %d repaired or removed\n", checked, len(results))
+	if len(results) > 0 {
+		if lib := getLibrary(); lib != nil {
+			if err := lib.Refresh(); err != nil {
+				fmt.Println("[Error] Failed to refresh library index:", err)
+			}
+		}
+	}
+	return results
+}
+
+// Helper function to start the periodic deep verification of the cache, every CACHE_VERIFY_INTERVAL hours
+func startCacheVerifier() {
+	interval := time.Duration(getEnvInt("CACHE_VERIFY_INTERVAL", 24)) * time.Hour
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		// The first sweep waits for the library index to settle after startup
+		timer := time.NewTimer(time.Minute)
+		defer timer.Stop()
+		for range timer.C {
+			verifyCache(context.Background(), true)
+			timer.Reset(interval)
+		}
+	}()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Helper function to write a complete cache entry for Alice - Song into the cache of the working directory,
+// returning its media folder
+func writeTestCacheEntry(t *testing.T, provider, id string) string {
+	t.Helper()
+	mediaDir := filepath.Join("files", "cache", "music", "Alice-Song")
+	files := map[string]string{
+		"music_full.flac":    "original audio",
+		"music.mp3":          "transcoded audio",
+		"music.m3u8":         "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:10.000,\nchunk/music_000.ts\n#EXT-X-ENDLIST\n",
+		"chunk/music_000.ts": "segment",
+		"cover.jpg":          "cover image",
+		"lyric.lrc":          "[00:00.00]lyric",
+	}
+	for file, content := range files {
+		filePath := filepath.Join(mediaDir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll("cache", 0755); err != nil {
+		t.Fatal(err)
+	}
+	baseURL := "/files/cache/music/Alice-Song"
+	musicItem := MusicItem{
+		Title:        "Song",
+		Artist:       "Alice",
+		AudioFullURL: baseURL + "/music_full.flac",
+		AudioURL:     baseURL + "/music.mp3",
+		M3U8URL:      baseURL + "/music.m3u8",
+		CoverURL:     baseURL + "/cover.jpg",
+		LyricURL:     baseURL + "/lyric.lrc",
+	}
+	if err := writeCacheFile(musicItem, provider, id); err != nil {
+		t.Fatal(err)
+	}
+	return mediaDir
+}
+
+func TestVerifyCacheEntry(t *testing.T) {
+	_, ffprobeErr := exec.LookPath("ffprobe")
+	tests := []struct {
+		name        string
+		damage      func(t *testing.T, mediaDir string)
+		deep        bool
+		problem     string // Part of the expected problems, empty for a healthy entry
+		refetch     bool
+		retranscode bool
+		dropped     []string
+	}{
+		{name: "healthy", damage: func(*testing.T, string) {}},
+		{name: "healthy deep", damage: func(*testing.T, string) {}, deep: true},
+		{
+			name:    "missing cache file",
+			damage:  func(t *testing.T, _ string) { removeTestFile(t, filepath.Join("cache", "Alice-Song.json")) },
+			problem: "cache file unreadable",
+			refetch: true,
+		},
+		{
+			name:    "missing original",
+			damage:  func(t *testing.T, mediaDir string) { removeTestFile(t, filepath.Join(mediaDir, "music_full.flac")) },
+			problem: "music_full.flac: missing",
+			refetch: true,
+		},
+		{
+			name: "truncated original",
+			damage: func(t *testing.T, mediaDir string) {
+				writeTestFile(t, filepath.Join(mediaDir, "music_full.flac"), "orig")
+			},
+			problem: "music_full.flac: size 4, expected 14",
+			refetch: true,
+		},
+		{
+			name:        "empty transcode",
+			damage:      func(t *testing.T, mediaDir string) { writeTestFile(t, filepath.Join(mediaDir, "music.mp3"), "") },
+			problem:     "music.mp3: empty",
+			retranscode: true,
+		},
+		{
+			name:        "truncated transcode",
+			damage:      func(t *testing.T, mediaDir string) { writeTestFile(t, filepath.Join(mediaDir, "music.mp3"), "trans") },
+			problem:     "music.mp3: size 5, expected 16",
+			retranscode: true,
+		},
+		{
+			name: "missing segment",
+			damage: func(t *testing.T, mediaDir string) {
+				removeTestFile(t, filepath.Join(mediaDir, "chunk", "music_000.ts"))
+			},
+			problem:     "chunk/music_000.ts: missing",
+			retranscode: true,
+		},
+		{
+			name: "invalid playlist",
+			damage: func(t *testing.T, mediaDir string) {
+				writeTestFile(t, filepath.Join(mediaDir, "music.m3u8"), "chunk/music_000.ts\n")
+			},
+			problem:     "music.m3u8: invalid playlist",
+			retranscode: true,
+		},
+		{
+			name:    "empty cover",
+			damage:  func(t *testing.T, mediaDir string) { writeTestFile(t, filepath.Join(mediaDir, "cover.jpg"), "") },
+			problem: "cover.jpg: empty",
+			dropped: []string{"cover.jpg"},
+		},
+		{
+			name:    "missing lyric",
+			damage:  func(t *testing.T, mediaDir string) { removeTestFile(t, filepath.Join(mediaDir, "lyric.lrc")) },
+			problem: "lyric.lrc: missing",
+			dropped: []string{"lyric.lrc"},
+		},
+		{
+			// Same size, other content: only the deep check reads the files
+			name: "transcode checksum mismatch, quick",
+			damage: func(t *testing.T, mediaDir string) {
+				writeTestFile(t, filepath.Join(mediaDir, "music.mp3"), "TRANSCODED AUDIO")
+			},
+		},
+		{
+			name: "transcode checksum mismatch",
+			damage: func(t *testing.T, mediaDir string) {
+				writeTestFile(t, filepath.Join(mediaDir, "music.mp3"), "TRANSCODED AUDIO")
+			},
+			deep:        true,
+			problem:     "music.mp3: checksum mismatch",
+			retranscode: true,
+		},
+		{
+			name: "original checksum mismatch",
+			damage: func(t *testing.T, mediaDir string) {
+				writeTestFile(t, filepath.Join(mediaDir, "music_full.flac"), "ORIGINAL AUDIO")
+			},
+			deep:    true,
+			problem: "music_full.flac: checksum mismatch",
+			refetch: true,
+		},
+		{
+			name: "cover checksum mismatch",
+			damage: func(t *testing.T, mediaDir string) {
+				writeTestFile(t, filepath.Join(mediaDir, "cover.jpg"), "COVER IMAGE")
+			},
+			deep:    true,
+			problem: "cover.jpg: checksum mismatch",
+			dropped: []string{"cover.jpg"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.deep && ffprobeErr == nil {
+				// ffprobe would also reject the made-up audio files
+				t.Skip("ffprobe is installed")
+			}
+			t.Chdir(t.TempDir())
+			mediaDir := writeTestCacheEntry(t, "", "")
+			test.damage(t, mediaDir)
+
+			result, _ := verifyCacheEntry(context.Background(), "Alice-Song", test.deep)
+			problems := strings.Join(result.Problems, "; ")
+			if test.problem == "" && !result.healthy() || !strings.Contains(problems, test.problem) {
+				t.Errorf("problems %q, want %q", problems, test.problem)
+			}
+			if result.refetch != test.refetch || result.retranscode != test.retranscode || strings.Join(result.dropped, ",") != strings.Join(test.dropped, ",") {
+				t.Errorf("refetch %v, retranscode %v, dropped %v, want %v, %v, %v", result.refetch, result.retranscode, result.dropped, test.refetch, test.retranscode, test.dropped)
+			}
+		})
+	}
+}
+
+func TestVerifyCacheEntryWithoutOriginal(t *testing.T) {
+	t.Chdir(t.TempDir())
+	mediaDir := writeTestCacheEntry(t, "", "")
+	data, err := readCacheFileData(filepath.Join("cache", "Alice-Song.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.AudioFullURL = ""
+	removeTestFile(t, filepath.Join(mediaDir, "music_full.flac"))
+	if err := writeCacheFile(data.MusicItem, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(mediaDir, "music.mp3"), "")
+
+	// Nothing is left to transcode from, the song has to be downloaded again
+	result, _ := verifyCacheEntry(context.Background(), "Alice-Song", false)
+	if !result.retranscode || !result.refetch {
+		t.Errorf("retranscode %v, refetch %v, want both", result.retranscode, result.refetch)
+	}
+}
+
+func TestHealCacheEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(t *testing.T, mediaDir string)
+		action  string
+		refetch bool // Whether the failed repair was a new download rather than a transcode
+		removed bool
+	}{
+		{
+			name:   "broken cover is dropped",
+			damage: func(t *testing.T, mediaDir string) { writeTestFile(t, filepath.Join(mediaDir, "cover.jpg"), "") },
+			action: "dropped",
+		},
+		{
+			// The made-up original cannot be transcoded, with or without ffmpeg
+			name:    "failed retranscode removes the entry",
+			damage:  func(t *testing.T, mediaDir string) { writeTestFile(t, filepath.Join(mediaDir, "music.mp3"), "") },
+			action:  "removed",
+			removed: true,
+		},
+		{
+			// The provider the entry came from is gone, so the download fails
+			name:    "failed refetch removes the entry",
+			damage:  func(t *testing.T, mediaDir string) { removeTestFile(t, filepath.Join(mediaDir, "music_full.flac")) },
+			action:  "removed",
+			refetch: true,
+			removed: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			mediaDir := writeTestCacheEntry(t, "no-such-provider", "1")
+			test.damage(t, mediaDir)
+
+			result, data := verifyCacheEntry(context.Background(), "Alice-Song", false)
+			result, musicItem := healCacheEntry(context.Background(), result, data)
+			if result.Action != test.action {
+				t.Errorf("action %q (%s), want %q", result.Action, result.Error, test.action)
+			}
+			if refetched := strings.Contains(result.Error, "no provider returned the song"); test.removed && refetched != test.refetch {
+				t.Errorf("repair failed with %q, want a refetch %v", result.Error, test.refetch)
+			}
+			if test.removed {
+				for _, path := range []string{filepath.Join("cache", "Alice-Song.json"), mediaDir} {
+					if _, err := os.Stat(path); !os.IsNotExist(err) {
+						t.Errorf("%s is left after the removal: %v", path, err)
+					}
+				}
+				return
+			}
+
+			// The repaired entry no longer links the dropped file and passes the check
+			if musicItem.CoverURL != "" {
+				t.Errorf("cover still linked: %q", musicItem.CoverURL)
+			}
+			if _, err := os.Stat(filepath.Join(mediaDir, "cover.jpg")); !os.IsNotExist(err) {
+				t.Errorf("broken cover is left: %v", err)
+			}
+			if result, _ := verifyCacheEntry(context.Background(), "Alice-Song", false); !result.healthy() {
+				t.Errorf("still broken after the repair: %v", result.Problems)
+			}
+		})
+	}
+}
+
+func TestHealCacheEntryRetranscodes(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	t.Chdir(t.TempDir())
+	mediaDir := writeTestCacheEntry(t, "", "")
+	original := filepath.Join(mediaDir, "music_full.flac")
+	if output, err := exec.Command("ffmpeg", "-y", "-f", "lavfi", "-i", "sine=duration=3", original).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	data, err := readCacheFileData(filepath.Join("cache", "Alice-Song.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new original is recorded, then the transcode breaks
+	if err := writeCacheFile(data.MusicItem, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(mediaDir, "music.mp3"), "")
+
+	result, data := verifyCacheEntry(context.Background(), "Alice-Song", false)
+	result, _ = healCacheEntry(context.Background(), result, data)
+	if result.Action != "retranscoded" {
+		t.Fatalf("action %q (%s), want retranscoded", result.Action, result.Error)
+	}
+	if result, _ := verifyCacheEntry(context.Background(), "Alice-Song", true); !result.healthy() {
+		t.Errorf("still broken after the repair: %v", result.Problems)
+	}
+}
+
+// Helper function to overwrite a file in a test
+func writeTestFile(t *testing.T, filePath, content string) {
+	t.Helper()
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Helper function to remove a file in a test
+func removeTestFile(t *testing.T, filePath string) {
+	t.Helper()
+	if err := os.Remove(filePath); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobState is the stage a fetch job is in.
+type JobState string
+
+const (
+	JobQueued      JobState = "queued"
+	JobDownloading JobState = "downloading"
+	JobTranscoding JobState = "transcoding"
+	JobSegmenting  JobState = "segmenting"
+	JobDone        JobState = "done"
+	JobFailed      JobState = "failed"
+)
+
+// jobStageWeights maps each stage to the share of the overall progress it starts at and covers.
+var jobStageWeights = map[JobState][2]float64{
+	JobQueued:      {0, 0},
+	JobDownloading: {0, 40},
+	JobTranscoding: {40, 40},
+	JobSegmenting:  {80, 20},
+	JobDone:        {100, 0},
+}
+
+// ProgressFunc receives the current stage and the percentage completed within that stage.
+type ProgressFunc func(state JobState, percent float64)
+
+// Helper function to report progress if a progress function is set
+func reportProgress(progress ProgressFunc, state JobState, percent float64) {
+	if progress != nil {
+		progress(state, percent)
+	}
+}
+
+// Job is an asynchronous cache-miss fetch.
+type Job struct {
+	ID            string     `json:"id"`
+	Song          string     `json:"song"`
+	Singer        string     `json:"singer"`
+	State         JobState   `json:"state"`
+	Progress      float64    `json:"progress"`       // Overall percentage
+	StageProgress float64    `json:"stage_progress"` // Percentage of the current stage
+	Error         string     `json:"error,omitempty"`
+	Result        *MusicItem `json:"result,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	key           string
+}
+
+// jobRetention is how long finished jobs can still be queried.
+const jobRetention = time.Hour
+
+// jobSubscriber receives job updates, for a single job or all jobs when jobID is empty.
+type jobSubscriber struct {
+	jobID  string
+	events chan Job
+}
+
+// jobManager tracks fetch jobs and the SSE subscribers watching them.
+type jobManager struct {
+	mu          sync.Mutex
+	jobs        map[string]*Job
+	active      map[string]*Job // Running jobs by request flight key
+	subscribers map[*jobSubscriber]struct{}
+}
+
+var jobs = &jobManager{
+	jobs:        map[string]*Job{},
+	active:      map[string]*Job{},
+	subscribers: map[*jobSubscriber]struct{}{},
+}
+
+// Helper function to generate a random job ID
+func newJobID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Start returns the running job for the key, or starts fn as a new job.
+func (m *jobManager) Start(key, song, singer string, fn func(progress ProgressFunc) (MusicItem, error)) Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job, ok := m.active[key]; ok {
+		return *job
+	}
+
+	// Forget finished jobs past their retention
+	for id, job := range m.jobs {
+		if (job.State == JobDone || job.State == JobFailed) && time.Since(job.UpdatedAt) > jobRetention {
+			delete(m.jobs, id)
+		}
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:        newJobID(),
+		Song:      song,
+		Singer:    singer,
+		State:     JobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+		key:       key,
+	}
+	m.jobs[job.ID] = job
+	m.active[key] = job
+	fmt.Printf("[Info] Started job %s for %s by %s\n", job.ID, song, singer)
+
+	go func() {
+		musicItem, err := fn(func(state JobState, percent float64) {
+			m.update(job, func(job *Job) {
+				job.State = state
+				job.StageProgress = percent
+				weight := jobStageWeights[state]
+				job.Progress = weight[0] + weight[1]*percent/100
+			})
+		})
+		m.update(job, func(job *Job) {
+			if err == nil && musicItem.Title == "" {
+				err = fmt.Errorf("no valid music item retrieved")
+			}
+			if err != nil {
+				job.State = JobFailed
+				job.Error = err.Error()
+			} else {
+				job.State = JobDone
+				job.Progress = 100
+				job.StageProgress = 100
+				job.Result = &musicItem
+			}
+		})
+		m.mu.Lock()
+		delete(m.active, key)
+		m.mu.Unlock()
+		fmt.Printf("[Info] Job %s finished: %s\n", job.ID, job.State)
+	}()
+
+	return *job
+}
+
+// Helper function to change a job and notify its subscribers
+func (m *jobManager) update(job *Job, change func(job *Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	change(job)
+	job.UpdatedAt = time.Now()
+	for subscriber := range m.subscribers {
+		if subscriber.jobID != "" && subscriber.jobID != job.ID {
+			continue
+		}
+		// Slow subscribers miss intermediate updates rather than blocking the job, but the final state
+		// takes the place of the oldest pending update so streams always see the job finish
+		select {
+		case subscriber.events <- *job:
+		default:
+			if job.State == JobDone || job.State == JobFailed {
+				select {
+				case <-subscriber.events:
+				default:
+				}
+				select {
+				case subscriber.events <- *job:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Get returns a snapshot of the job with the ID.
+func (m *jobManager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// List returns snapshots of all known jobs, newest first.
+func (m *jobManager) List() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		list = append(list, *job)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Helper function to subscribe to updates of a job, or all jobs when jobID is empty
+func (m *jobManager) subscribe(jobID string) *jobSubscriber {
+	subscriber := &jobSubscriber{jobID: jobID, events: make(chan Job, 16)}
+	m.mu.Lock()
+	m.subscribers[subscriber] = struct{}{}
+	m.mu.Unlock()
+	return subscriber
+}
+
+// Helper function to remove a subscriber
+func (m *jobManager) unsubscribe(subscriber *jobSubscriber) {
+	m.mu.Lock()
+	delete(m.subscribers, subscriber)
+	m.mu.Unlock()
+}
+
+// Helper function to start an asynchronous fetch of a song through the request flights
+func startFetchJob(ctx context.Context, song, singer, provider, id string) Job {
+	key := requestFlightKey(song, singer) + "\x00" + provider + "\x00" + id
+	return jobs.Start(key, song, singer, func(progress ProgressFunc) (MusicItem, error) {
+		musicItem, err, _ := requestFlights.DoContext(ctx, key, func(ctx context.Context) (MusicItem, error) {
+			if provider != "" && id != "" {
+				return requestAndCacheProviderTrack(ctx, provider, id, song, singer, progress)
+			}
+			return requestAndCacheMusic(ctx, song, singer, progress)
+		}, func() {
+			// The fetch already running for a request reports no progress, it is at least under way
+			reportProgress(progress, JobDownloading, 0)
+		})
+		return musicItem, err
+	})
+}
+
+// Helper function to write a job as JSON with absolute result URLs
+func writeJobJSON(w http.ResponseWriter, r *http.Request, status int, job Job) {
+	if job.Result != nil {
+		result := absoluteMusicItemURLs(r, *job.Result)
+		job.Result = &result
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
+
+// Helper function to write a job as a server-sent event
+func writeJobEvent(w io.Writer, r *http.Request, job Job) error {
+	if job.Result != nil {
+		result := absoluteMusicItemURLs(r, *job.Result)
+		job.Result = &result
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: job\ndata: %s\n\n", data)
+	return err
+}
+
+// jobsHandler handles /api/jobs, /api/jobs/events, /api/jobs/{id} and /api/jobs/{id}/events.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "MeowMusicEmbeddedServer")
+	fmt.Printf("[Web Access] Handling request for %s\n", r.URL.Path)
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(jobs.List())
+	case path == "events":
+		streamJobEvents(w, r, "")
+	case len(parts) == 1:
+		job, ok := jobs.Get(parts[0])
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		writeJobJSON(w, r, http.StatusOK, job)
+	case len(parts) == 2 && parts[1] == "events":
+		if _, ok := jobs.Get(parts[0]); !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		streamJobEvents(w, r, parts[0])
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// Helper function to stream job updates as server-sent events until the client leaves or the job finishes
+func streamJobEvents(w http.ResponseWriter, r *http.Request, jobID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	subscriber := jobs.subscribe(jobID)
+	defer jobs.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	out := bufio.NewWriter(w)
+
+	// Send the current state first
+	var current []Job
+	if jobID != "" {
+		job, _ := jobs.Get(jobID)
+		current = []Job{job}
+	} else {
+		current = jobs.List()
+	}
+	for _, job := range current {
+		writeJobEvent(out, r, job)
+		if jobID != "" && (job.State == JobDone || job.State == JobFailed) {
+			out.Flush()
+			flusher.Flush()
+			return
+		}
+	}
+	out.Flush()
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			// A job stream never waits longer than a keep-alive for the final state
+			if job, ok := jobs.Get(jobID); jobID != "" && ok && (job.State == JobDone || job.State == JobFailed) {
+				writeJobEvent(out, r, job)
+				out.Flush()
+				flusher.Flush()
+				return
+			}
+			fmt.Fprintf(out, ": keep-alive %s\n\n", strconv.FormatInt(time.Now().Unix(), 10))
+		case job := <-subscriber.events:
+			if err := writeJobEvent(out, r, job); err != nil {
+				return
+			}
+			if jobID != "" && (job.State == JobDone || job.State == JobFailed) {
+				out.Flush()
+				flusher.Flush()
+				return
+			}
+		}
+		if err := out.Flush(); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
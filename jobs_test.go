@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Helper function to wait until the job with the ID is in the state
+func waitForJobState(t *testing.T, id string, state JobState) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, ok := jobs.Get(id)
+		if ok && job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want %s", id, job.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJobUpdateKeepsFinalState(t *testing.T) {
+	release := make(chan struct{})
+	job := jobs.Start("test\x00final", "Song", "Singer", func(progress ProgressFunc) (MusicItem, error) {
+		<-release
+		return MusicItem{Title: "Song"}, nil
+	})
+	subscriber := jobs.subscribe(job.ID)
+	defer jobs.unsubscribe(subscriber)
+
+	// A subscriber that does not keep up fills its channel with progress updates
+	jobs.mu.Lock()
+	running := jobs.jobs[job.ID]
+	jobs.mu.Unlock()
+	for percent := 0; percent <= 100; percent++ {
+		jobs.update(running, func(job *Job) {
+			job.State = JobDownloading
+			job.StageProgress = float64(percent)
+		})
+	}
+	close(release)
+	waitForJobState(t, job.ID, JobDone)
+
+	var last Job
+	for len(subscriber.events) > 0 {
+		last = <-subscriber.events
+	}
+	if last.State != JobDone || last.Result == nil {
+		t.Errorf("last event is %s, want the final done state", last.State)
+	}
+}
+
+func TestFetchJobJoiningFlightReportsDownloading(t *testing.T) {
+	song, singer := "Shared Song", "Shared Singer"
+	key := requestFlightKey(song, singer) + "\x00\x00"
+	release := make(chan struct{})
+	started := make(chan struct{})
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		requestFlights.Do(key, func() (MusicItem, error) {
+			close(started)
+			<-release
+			return MusicItem{Title: song, Artist: singer}, nil
+		})
+	}()
+	<-started
+
+	job := startFetchJob(context.Background(), song, singer, "", "")
+	running := waitForJobState(t, job.ID, JobDownloading)
+	if running.Progress != 0 {
+		t.Errorf("progress %v before any data arrived", running.Progress)
+	}
+
+	close(release)
+	<-leaderDone
+	done := waitForJobState(t, job.ID, JobDone)
+	if done.Result == nil || done.Result.Title != song {
+		t.Errorf("job result %+v", done.Result)
+	}
+}
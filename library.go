@@ -0,0 +1,844 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Library sources, in the order lookups try them
+const (
+	librarySources = "sources"
+	libraryLocal   = "local"
+	libraryCache   = "cache"
+)
+
+var (
+	libraryTracksBucket   = []byte("tracks")   // source/name -> LibraryEntry JSON
+	libraryTitlesBucket   = []byte("titles")   // source/title\x00artist\x00name -> source/name, both lower case
+	libraryNamesBucket    = []byte("names")    // source/normalized title\x00name -> source/name, see nameKeys
+	libraryWordsBucket    = []byte("words")    // source/title word\x00name -> source/name, see wordKeys
+	libraryMetaBucket     = []byte("meta")     // file path -> fileStamp JSON of files that are indexed as a whole
+	libraryAccessBucket   = []byte("access")   // cache name -> unix nanoseconds of the last time it was served
+	libraryRequestsBucket = []byte("requests") // normalized song\x00singer -> SongRequestCount JSON
+)
+
+// fileStamp identifies a version of a file without reading it.
+type fileStamp struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mod_time"`
+}
+
+// LibraryEntry is an indexed track from sources.json, the local folder or the cache.
+type LibraryEntry struct {
+	Source    string               `json:"source"`
+	Name      string               `json:"name"`   // Folder name, cache file name or position in sources.json
+	Format    string               `json:"format"` // Extension of the best quality audio file
+	Item      MusicItem            `json:"item"`
+	Album     string               `json:"album,omitempty"`
+	Track     int                  `json:"track,omitempty"`
+	Year      int                  `json:"year,omitempty"`
+	Files     map[string]fileStamp `json:"files"` // The files the entry was built from, to detect changes
+	IndexedAt time.Time            `json:"indexed_at"`
+}
+
+// Helper function to get the key of an entry in the tracks bucket
+func (entry LibraryEntry) key() []byte {
+	return []byte(entry.Source + "/" + entry.Name)
+}
+
+// Helper function to get the key of an entry in the titles bucket
+func (entry LibraryEntry) titleKey() []byte {
+	return []byte(entry.Source + "/" + strings.ToLower(entry.Item.Title) + "\x00" + strings.ToLower(entry.Item.Artist) + "\x00" + entry.Name)
+}
+
+// Helper function to get the keys of an entry in the names bucket. A playback lookup accepts a track whose
+// title, or artist and title run together, folds to the same text or pinyin as the song, see isPlaybackMatch.
+func (entry LibraryEntry) nameKeys() [][]byte {
+	title, artist := entry.Item.Title, entry.Item.Artist
+	if title == "" {
+		return nil
+	}
+	names := []string{title}
+	if artist != "" {
+		names = append(names, artist+title, title+artist)
+	}
+	seen := map[string]bool{}
+	var keys [][]byte
+	for _, name := range names {
+		key := newMatchKey(name)
+		for _, text := range []string{key.Text, key.Pinyin} {
+			if text == "" || seen[text] {
+				continue
+			}
+			seen[text] = true
+			keys = append(keys, []byte(entry.Source+"/"+text+"\x00"+entry.Name))
+		}
+	}
+	return keys
+}
+
+// Helper function to get the keys of an entry in the words bucket, one per word of the title. A confident
+// fuzzy match shares at least one word with the song, see coversName.
+func (entry LibraryEntry) wordKeys() [][]byte {
+	seen := map[string]bool{}
+	var keys [][]byte
+	for _, word := range newMatchKey(entry.Item.Title).Words {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		keys = append(keys, []byte(entry.Source+"/"+word+"\x00"+entry.Name))
+	}
+	return keys
+}
+
+// libraryLookupBuckets are the buckets derived from the entries for lookups, built from the entries when an
+// index written by an earlier version lacks them.
+var libraryLookupBuckets = []struct {
+	name []byte
+	keys func(entry LibraryEntry) [][]byte
+}{
+	{libraryNamesBucket, LibraryEntry.nameKeys},
+	{libraryWordsBucket, LibraryEntry.wordKeys},
+}
+
+// libraryIndex is the on-disk index of every known track, kept in LIBRARY_INDEX_FILE.
+type libraryIndex struct {
+	db        *bolt.DB
+	refreshMu sync.Mutex
+	// missMu guards the background refreshes started by lookup misses
+	missMu          sync.Mutex
+	missRefreshing  bool
+	lastMissRefresh time.Time
+}
+
+var (
+	library     *libraryIndex
+	libraryOnce sync.Once
+)
+
+// Helper function to open the library index, returning nil if it cannot be opened
+func getLibrary() *libraryIndex {
+	libraryOnce.Do(func() {
+		indexFile := os.Getenv("LIBRARY_INDEX_FILE")
+		if indexFile == "" {
+			indexFile = "./cache/library.db"
+		}
+		err := os.MkdirAll(filepath.Dir(indexFile), 0755)
+		if err != nil {
+			fmt.Println("[Error] Failed to create library index directory:", err)
+			return
+		}
+		lib, err := openLibraryIndex(indexFile)
+		if err != nil {
+			fmt.Println("[Error] Failed to open library index, scanning folders on every request instead:", err)
+			return
+		}
+		library = lib
+	})
+	return library
+}
+
+// Helper function to open an index file and create its buckets
+func openLibraryIndex(indexFile string) (*libraryIndex, error) {
+	db, err := bolt.Open(indexFile, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{libraryTracksBucket, libraryTitlesBucket, libraryMetaBucket, libraryAccessBucket, libraryRequestsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		for _, lookup := range libraryLookupBuckets {
+			if tx.Bucket(lookup.name) != nil {
+				continue
+			}
+			bucket, err := tx.CreateBucket(lookup.name)
+			if err != nil {
+				return err
+			}
+			err = tx.Bucket(libraryTracksBucket).ForEach(func(k, v []byte) error {
+				var entry LibraryEntry
+				if json.Unmarshal(v, &entry) != nil {
+					return nil
+				}
+				for _, lookupKey := range lookup.keys(entry) {
+					if err := bucket.Put(lookupKey, k); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing library index: %w", err)
+	}
+	return &libraryIndex{db: db}, nil
+}
+
+// Helper function to open the library index, bring it up to date in the background and keep it live
+func startLibraryIndex() {
+	go func() {
+		lib := getLibrary()
+		if lib == nil {
+			return
+		}
+		if err := lib.Refresh(); err != nil {
+			fmt.Println("[Error] Failed to refresh library index:", err)
+		}
+		watchLibrary(lib)
+	}()
+}
+
+// Helper function to close the library index on shutdown
+func closeLibrary() {
+	if library != nil {
+		library.db.Close()
+	}
+}
+
+// Helper function to stat a set of files, leaving out the ones that do not exist
+func statFiles(paths ...string) map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		stamps[filepath.Base(path)] = fileStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	}
+	return stamps
+}
+
+// Helper function to compare two sets of file stamps
+func sameStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, stamp := range a {
+		if b[name] != stamp {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper function to get the audio format of a music item from its best quality URL
+func getMusicItemFormat(musicItem MusicItem) string {
+	for _, rawURL := range []string{musicItem.AudioFullURL, musicItem.AudioURL} {
+		if ext := strings.TrimPrefix(filepath.Ext(strings.SplitN(rawURL, "?", 2)[0]), "."); ext != "" {
+			return strings.ToLower(ext)
+		}
+	}
+	return ""
+}
+
+// Helper function to get the files a local music folder entry is built from
+func statLocalMusicDir(musicDir, dirName string) map[string]fileStamp {
+	dirPath := filepath.Join(musicDir, dirName)
+	paths := []string{}
+	for _, name := range append([]string{"music.mp3", "music.m3u8", "lyric.lrc", "cover.jpg", "cover.png"}, localFullAudioFormats...) {
+		paths = append(paths, filepath.Join(dirPath, name))
+	}
+	return statFiles(paths...)
+}
+
+// Helper function to build the index entry of a local music folder, probing the duration and reading the tags
+func buildLocalLibraryEntry(musicDir, dirName string, stamps map[string]fileStamp) (LibraryEntry, bool) {
+	// Indexing is maintenance, the ffprobe runs queue behind the jobs devices are waiting on
+	musicItem, tags, ok := buildLocalMusicItemWithTags(withPriority(context.Background(), PriorityBackground), musicDir, dirName)
+	if !ok {
+		return LibraryEntry{}, false
+	}
+	// Covers and lyrics extracted from the tags are part of the entry from now on
+	if stamps != nil {
+		dirPath := filepath.Join(musicDir, dirName)
+		for name, stamp := range statFiles(filepath.Join(dirPath, "lyric.lrc"), filepath.Join(dirPath, "cover.jpg"), filepath.Join(dirPath, "cover.png")) {
+			if _, ok := stamps[name]; !ok {
+				stamps[name] = stamp
+			}
+		}
+	}
+	return LibraryEntry{
+		Source:    libraryLocal,
+		Name:      dirName,
+		Format:    getMusicItemFormat(musicItem),
+		Item:      musicItem,
+		Album:     tags.Album,
+		Track:     tags.Track,
+		Year:      tags.Year,
+		Files:     stamps,
+		IndexedAt: time.Now(),
+	}, true
+}
+
+// Helper function to build the index entry of a cache file
+func buildCacheLibraryEntry(filePath string, stamps map[string]fileStamp) (LibraryEntry, bool) {
+	musicItem, ok := readFromCache(filePath)
+	if !ok {
+		return LibraryEntry{}, false
+	}
+	return LibraryEntry{Source: libraryCache, Name: filepath.Base(filePath), Format: getMusicItemFormat(musicItem), Item: musicItem, Album: musicItem.Album, Files: stamps, IndexedAt: time.Now()}, true
+}
+
+// Helper function to build the index entries of sources.json, failing if it is invalid
+func buildSourceLibraryEntries(stamps map[string]fileStamp) ([]LibraryEntry, error) {
+	sources, err := loadSources("./sources.json")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []LibraryEntry
+	for i, source := range sources {
+		entries = append(entries, LibraryEntry{Source: librarySources, Name: fmt.Sprintf("%06d", i), Format: getMusicItemFormat(source), Item: source, Album: source.Album, Files: stamps, IndexedAt: time.Now()})
+	}
+	return entries, nil
+}
+
+// Helper function to list the local music folder names, sorted like os.ReadDir
+func listLocalMusicDirs(musicDir string) []string {
+	files, err := os.ReadDir(musicDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("[Error] Failed to read local music directory:", err)
+		}
+		return nil
+	}
+	var dirNames []string
+	for _, file := range files {
+		// Hidden folders are skipped, folders without a "-" need tags to name them
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			dirNames = append(dirNames, file.Name())
+		}
+	}
+	return dirNames
+}
+
+// Refresh brings the index up to date with sources.json, the local folder and the cache. Only
+// entries whose files changed are rebuilt, so ffprobe runs once per new or changed file.
+func (l *libraryIndex) Refresh() error {
+	l.refreshMu.Lock()
+	defer l.refreshMu.Unlock()
+	started := time.Now()
+
+	existing := map[string]LibraryEntry{}
+	sourcesStamp := fileStamp{}
+	err := l.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(libraryTracksBucket).ForEach(func(k, v []byte) error {
+			var entry LibraryEntry
+			if json.Unmarshal(v, &entry) == nil {
+				existing[string(k)] = entry
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if data := tx.Bucket(libraryMetaBucket).Get([]byte("sources.json")); data != nil {
+			json.Unmarshal(data, &sourcesStamp)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var changed []LibraryEntry
+	seen := map[string]bool{}
+
+	// sources.json is small and indexed as a whole
+	sourcesStamps := statFiles("./sources.json")
+	newSourcesStamp := sourcesStamps["sources.json"]
+	var sourceEntries []LibraryEntry
+	if newSourcesStamp != sourcesStamp {
+		sourceEntries, err = buildSourceLibraryEntries(sourcesStamps)
+		if err != nil {
+			// A half-edited sources.json must not wipe the working entries
+			fmt.Println("[Error] Invalid sources.json, keeping the previous version:", err)
+			newSourcesStamp = sourcesStamp
+		}
+	}
+	if newSourcesStamp != sourcesStamp {
+		changed = append(changed, sourceEntries...)
+		for _, entry := range changed {
+			seen[string(entry.key())] = true
+		}
+	} else {
+		for key, entry := range existing {
+			if entry.Source == librarySources {
+				seen[key] = true
+			}
+		}
+	}
+
+	musicDir := "./files/music"
+	for _, dirName := range listLocalMusicDirs(musicDir) {
+		key := libraryLocal + "/" + dirName
+		seen[key] = true
+		stamps := statLocalMusicDir(musicDir, dirName)
+		if entry, ok := existing[key]; ok && sameStamps(entry.Files, stamps) {
+			continue
+		}
+		if entry, ok := buildLocalLibraryEntry(musicDir, dirName, stamps); ok {
+			changed = append(changed, entry)
+		}
+	}
+
+	files, err := filepath.Glob("./cache/*.json")
+	if err != nil {
+		fmt.Println("[Error] Error reading cache directory:", err)
+	}
+	for _, file := range files {
+		key := libraryCache + "/" + filepath.Base(file)
+		seen[key] = true
+		stamps := statFiles(file)
+		if entry, ok := existing[key]; ok && sameStamps(entry.Files, stamps) {
+			continue
+		}
+		if entry, ok := buildCacheLibraryEntry(file, stamps); ok {
+			changed = append(changed, entry)
+		}
+	}
+
+	var removed []LibraryEntry
+	for key, entry := range existing {
+		if !seen[key] {
+			removed = append(removed, entry)
+		}
+	}
+
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		for _, entry := range removed {
+			if err := deleteLibraryEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		for _, entry := range changed {
+			if old, ok := existing[string(entry.key())]; ok {
+				if err := deleteLibraryEntry(tx, old); err != nil {
+					return err
+				}
+			}
+			if err := putLibraryEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		data, _ := json.Marshal(newSourcesStamp)
+		return tx.Bucket(libraryMetaBucket).Put([]byte("sources.json"), data)
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range changed {
+		action := "Added"
+		if _, ok := existing[string(entry.key())]; ok {
+			action = "Updated"
+		}
+		fmt.Printf("[Info] Library: %s %s %s - %s\n", action, entry.Source, entry.Item.Artist, entry.Item.Title)
+	}
+	for _, entry := range removed {
+		fmt.Printf("[Info] Library: Removed %s %s - %s\n", entry.Source, entry.Item.Artist, entry.Item.Title)
+	}
+	if len(changed) > 0 || len(removed) > 0 {
+		fmt.Printf("[Info] Library index refreshed in %s: %d updated, %d removed\n", time.Since(started).Round(time.Millisecond), len(changed), len(removed))
+	}
+	return nil
+}
+
+// RefreshInBackground starts a refresh unless one is running or one was started within the interval,
+// reporting whether it started one.
+func (l *libraryIndex) RefreshInBackground(interval time.Duration) bool {
+	l.missMu.Lock()
+	defer l.missMu.Unlock()
+	if l.missRefreshing || time.Since(l.lastMissRefresh) < interval {
+		return false
+	}
+	l.missRefreshing = true
+	l.lastMissRefresh = time.Now()
+	go func() {
+		if err := l.Refresh(); err != nil {
+			fmt.Println("[Error] Failed to refresh library index:", err)
+		}
+		l.missMu.Lock()
+		l.missRefreshing = false
+		l.missMu.Unlock()
+	}()
+	return true
+}
+
+// Helper function to store an entry and its title and lookup keys
+func putLibraryEntry(tx *bolt.Tx, entry LibraryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(libraryTracksBucket).Put(entry.key(), data); err != nil {
+		return err
+	}
+	for _, lookup := range libraryLookupBuckets {
+		for _, lookupKey := range lookup.keys(entry) {
+			if err := tx.Bucket(lookup.name).Put(lookupKey, entry.key()); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket(libraryTitlesBucket).Put(entry.titleKey(), entry.key())
+}
+
+// Helper function to remove an entry and its title and lookup keys
+func deleteLibraryEntry(tx *bolt.Tx, entry LibraryEntry) error {
+	if err := tx.Bucket(libraryTitlesBucket).Delete(entry.titleKey()); err != nil {
+		return err
+	}
+	for _, lookup := range libraryLookupBuckets {
+		for _, lookupKey := range lookup.keys(entry) {
+			if err := tx.Bucket(lookup.name).Delete(lookupKey); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket(libraryTracksBucket).Delete(entry.key())
+}
+
+// Helper function to replace a single entry
+func (l *libraryIndex) put(entry LibraryEntry) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(libraryTracksBucket).Get(entry.key()); data != nil {
+			var old LibraryEntry
+			if json.Unmarshal(data, &old) == nil {
+				if err := deleteLibraryEntry(tx, old); err != nil {
+					return err
+				}
+			}
+		}
+		return putLibraryEntry(tx, entry)
+	})
+}
+
+// IndexLocalDir updates the entry of a single local music folder.
+func (l *libraryIndex) IndexLocalDir(musicDir, dirName string) {
+	entry, ok := buildLocalLibraryEntry(musicDir, dirName, statLocalMusicDir(musicDir, dirName))
+	if !ok {
+		return
+	}
+	if err := l.put(entry); err != nil {
+		fmt.Println("[Error] Failed to index local music folder:", err)
+	}
+}
+
+// IndexCacheFile updates the entry of a single cache file.
+func (l *libraryIndex) IndexCacheFile(filePath string) {
+	entry, ok := buildCacheLibraryEntry(filePath, statFiles(filePath))
+	if !ok {
+		return
+	}
+	if err := l.put(entry); err != nil {
+		fmt.Println("[Error] Failed to index cache file:", err)
+	}
+}
+
+// Entries returns all entries of a source in key order.
+func (l *libraryIndex) Entries(source string) []LibraryEntry {
+	var entries []LibraryEntry
+	prefix := []byte(source + "/")
+	l.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(libraryTracksBucket).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var entry LibraryEntry
+			if json.Unmarshal(v, &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries
+}
+
+// FindExact returns the entries of a source with the title and, if set, the artist, ignoring case.
+func (l *libraryIndex) FindExact(source, title, artist string) []LibraryEntry {
+	var entries []LibraryEntry
+	prefix := []byte(source + "/" + strings.ToLower(title) + "\x00")
+	if artist != "" {
+		prefix = append(prefix, []byte(strings.ToLower(artist)+"\x00")...)
+	}
+	l.db.View(func(tx *bolt.Tx) error {
+		tracks := tx.Bucket(libraryTracksBucket)
+		cursor := tx.Bucket(libraryTitlesBucket).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var entry LibraryEntry
+			if data := tracks.Get(v); data != nil && json.Unmarshal(data, &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries
+}
+
+// FindNormalized returns the entries of a source with a name key equal to the folded song, the candidates
+// of a playback lookup. Entries are returned in name order.
+func (l *libraryIndex) FindNormalized(source string, song matchKey) []LibraryEntry {
+	if song.Text == "" {
+		return nil
+	}
+	return l.findByLookupKeys(libraryNamesBucket, []string{source + "/" + song.Text + "\x00"})
+}
+
+// FindByWords returns the entries of a source whose title shares a word with the song, the candidates of a
+// fuzzy playback lookup. Entries are returned in name order.
+func (l *libraryIndex) FindByWords(source string, song matchKey) []LibraryEntry {
+	var prefixes []string
+	for _, word := range song.Words {
+		prefixes = append(prefixes, source+"/"+word+"\x00")
+	}
+	entries := l.findByLookupKeys(libraryWordsBucket, prefixes)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Helper function to read the entries a lookup bucket lists under any of the key prefixes, each entry once
+func (l *libraryIndex) findByLookupKeys(bucket []byte, prefixes []string) []LibraryEntry {
+	var entries []LibraryEntry
+	seen := map[string]bool{}
+	l.db.View(func(tx *bolt.Tx) error {
+		tracks := tx.Bucket(libraryTracksBucket)
+		cursor := tx.Bucket(bucket).Cursor()
+		for _, prefix := range prefixes {
+			for k, v := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = cursor.Next() {
+				if seen[string(v)] {
+					continue
+				}
+				seen[string(v)] = true
+				var entry LibraryEntry
+				if data := tracks.Get(v); data != nil && json.Unmarshal(data, &entry) == nil {
+					entries = append(entries, entry)
+				}
+			}
+		}
+		return nil
+	})
+	return entries
+}
+
+// Helper function to find the entries of a source matching the song and singer, best match first.
+// Exact titles come straight from the index, everything else is ranked by scoreTrackMatch.
+func findLibraryEntries(source, song, singer string, limit int) []LibraryEntry {
+	lib := getLibrary()
+	if lib != nil && song != "" {
+		entries := lib.FindExact(source, song, singer)
+		if len(entries) > 0 {
+			if limit > 0 && len(entries) > limit {
+				entries = entries[:limit]
+			}
+			return entries
+		}
+	}
+
+	entries := getLibraryEntries(source)
+	if song == "" {
+		if limit > 0 && len(entries) > limit {
+			entries = entries[:limit]
+		}
+		return entries
+	}
+	ranked := rankLibraryEntries(entries, song, singer)
+	matches := make([]LibraryEntry, 0, len(ranked))
+	for _, match := range ranked {
+		matches = append(matches, match.entry)
+		if limit > 0 && len(matches) >= limit {
+			break
+		}
+	}
+	return matches
+}
+
+// scoredLibraryEntry is a library entry with the score of a fuzzy lookup.
+type scoredLibraryEntry struct {
+	entry LibraryEntry
+	score float64
+}
+
+// Helper function to score entries against the song and singer, keeping the matches ordered by score
+func rankLibraryEntries(entries []LibraryEntry, song, singer string) []scoredLibraryEntry {
+	songKey, singerKey := newMatchKey(song), newMatchKey(singer)
+	var ranked []scoredLibraryEntry
+	for _, entry := range entries {
+		if entry.Item.Title == "" {
+			continue
+		}
+		if score := scoreTrackMatch(songKey, singerKey, entry.Item.Title, entry.Item.Artist); score > 0 {
+			ranked = append(ranked, scoredLibraryEntry{entry: entry, score: score})
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].score > ranked[j].score })
+	return ranked
+}
+
+// Helper function to get every entry of a library source, scanning the folders if the index is unavailable
+func getLibraryEntries(source string) []LibraryEntry {
+	if lib := getLibrary(); lib != nil {
+		return lib.Entries(source)
+	}
+	return scanLibraryEntries(source, func(string) bool { return true }, 0)
+}
+
+// Helper function to build the matching entries of a source straight from disk when the index is unavailable
+func scanLibraryEntries(source string, match func(name string) bool, limit int) []LibraryEntry {
+	var entries []LibraryEntry
+	switch source {
+	case librarySources:
+		entries, _ = buildSourceLibraryEntries(nil)
+	case libraryLocal:
+		for _, dirName := range listLocalMusicDirs("./files/music") {
+			if !match(dirName) {
+				continue
+			}
+			if entry, ok := buildLocalLibraryEntry("./files/music", dirName, nil); ok {
+				entries = append(entries, entry)
+			}
+			if limit > 0 && len(entries) >= limit {
+				break
+			}
+		}
+	case libraryCache:
+		files, _ := filepath.Glob("./cache/*.json")
+		for _, file := range files {
+			if !match(filepath.Base(file)) {
+				continue
+			}
+			if entry, ok := buildCacheLibraryEntry(file, nil); ok {
+				entries = append(entries, entry)
+			}
+			if limit > 0 && len(entries) >= limit {
+				break
+			}
+		}
+	}
+	return entries
+}
+
+// Helper function to get the music items of sources.json in file order
+func getSourceMusicItems() []MusicItem {
+	lib := getLibrary()
+	if lib == nil {
+		return readSources()
+	}
+	var sources []MusicItem
+	for _, entry := range lib.Entries(librarySources) {
+		sources = append(sources, entry.Item)
+	}
+	return sources
+}
+
+// Helper function to find the entry of sources.json, the local folder or the cache that is the requested
+// song. Exact and normalized-equal names are tried in tier order first, then a confident fuzzy match in tier
+// order, so a close name in sources.json never beats the exact song in the cache.
+func findBestLibraryEntry(song, singer string) (LibraryEntry, bool) {
+	tiers := []string{librarySources, libraryLocal, libraryCache}
+	songKey, singerKey := newMatchKey(song), newMatchKey(singer)
+	lib := getLibrary()
+	if lib != nil {
+		for _, source := range tiers {
+			entries := lib.FindExact(source, song, singer)
+			if len(entries) == 0 {
+				continue
+			}
+			// Prefer the first matching entry of sources.json
+			sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+			return entries[0], true
+		}
+	}
+
+	for _, source := range tiers {
+		var entries []LibraryEntry
+		if lib != nil {
+			// Only the entries sharing a folded name with the song are read from the index
+			entries = lib.FindNormalized(source, songKey)
+		} else {
+			entries = getLibraryEntries(source)
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		for _, entry := range entries {
+			if entry.Item.Title != "" && isPlaybackMatch(songKey, singerKey, entry.Item.Title, entry.Item.Artist) {
+				if entry.Item.Title != song || singer != "" && entry.Item.Artist != singer {
+					fmt.Printf("[Info] Matched %q by %q to %s - %s in %s\n", song, singer, entry.Item.Artist, entry.Item.Title, entry.Source)
+				}
+				return entry, true
+			}
+		}
+	}
+
+	// Messy speech transcripts rarely name the song exactly, a confident fuzzy match still beats going upstream
+	for _, source := range tiers {
+		var entries []LibraryEntry
+		if lib != nil {
+			entries = lib.FindByWords(source, songKey)
+		} else {
+			entries = getLibraryEntries(source)
+		}
+		if entry, score, ok := pickPlaybackEntry(entries, songKey, singerKey); ok {
+			fmt.Printf("[Info] Matched %q by %q to %s - %s in %s with score %.2f\n", song, singer, entry.Item.Artist, entry.Item.Title, entry.Source, score)
+			return entry, true
+		}
+	}
+	return LibraryEntry{}, false
+}
+
+// Helper function to pick the confident fuzzy match among entries, see scorePlaybackMatch. When another
+// track scores almost as high the song is ambiguous and none is picked, the same track listed twice is fine.
+func pickPlaybackEntry(entries []LibraryEntry, song, singer matchKey) (LibraryEntry, float64, bool) {
+	var ranked []scoredLibraryEntry
+	for _, entry := range entries {
+		if entry.Item.Title == "" {
+			continue
+		}
+		if score := scorePlaybackMatch(song, singer, entry.Item.Title, entry.Item.Artist); score > 0 {
+			ranked = append(ranked, scoredLibraryEntry{entry: entry, score: score})
+		}
+	}
+	if len(ranked) == 0 {
+		return LibraryEntry{}, 0, false
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].score > ranked[j].score })
+	best := ranked[0]
+	bestTrack := normalizeMatchText(best.entry.Item.Artist) + "\x00" + normalizeMatchText(best.entry.Item.Title)
+	for _, other := range ranked[1:] {
+		if best.score-other.score >= playbackMatchMargin {
+			break
+		}
+		if normalizeMatchText(other.entry.Item.Artist)+"\x00"+normalizeMatchText(other.entry.Item.Title) != bestTrack {
+			fmt.Printf("[Info] %q is ambiguous between %s - %s and %s - %s\n", song.Text, best.entry.Item.Artist, best.entry.Item.Title, other.entry.Item.Artist, other.entry.Item.Title)
+			return LibraryEntry{}, 0, false
+		}
+	}
+	return best.entry, best.score, true
+}
+
+// Helper function to pick up files added behind the watcher's back after a lookup missed. The refresh runs
+// in the background, at most once per LIBRARY_MISS_REFRESH_INTERVAL seconds, so the request goes on upstream
+// without waiting for a scan.
+func refreshLibraryAfterMiss() {
+	if lib := getLibrary(); lib != nil {
+		lib.RefreshInBackground(time.Duration(getEnvInt("LIBRARY_MISS_REFRESH_INTERVAL", 60)) * time.Second)
+	}
+}
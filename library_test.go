@@ -0,0 +1,193 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Helper function to open an empty library index that is closed at the end of the test
+func openTestLibrary(t *testing.T, indexFile string) *libraryIndex {
+	t.Helper()
+	lib, err := openLibraryIndex(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lib.db.Close() })
+	return lib
+}
+
+// Helper function to list the names of entries
+func libraryEntryNames(entries []LibraryEntry) []string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+func TestLibraryFindNormalized(t *testing.T) {
+	lib := openTestLibrary(t, filepath.Join(t.TempDir(), "library.db"))
+	for _, entry := range []LibraryEntry{
+		{Source: libraryLocal, Name: "周杰伦-稻香", Item: MusicItem{Title: "稻香", Artist: "周杰伦"}},
+		{Source: libraryLocal, Name: "周杰倫-晴天", Item: MusicItem{Title: "晴天", Artist: "周杰倫"}},
+		{Source: libraryLocal, Name: "林俊杰-倒影", Item: MusicItem{Title: "倒影", Artist: "林俊杰"}},
+		{Source: libraryLocal, Name: "Taylor Swift-Lover", Item: MusicItem{Title: "Lover", Artist: "Taylor Swift"}},
+		{Source: libraryCache, Name: "周杰伦-稻香", Item: MusicItem{Title: "稻香", Artist: "周杰伦"}},
+	} {
+		if err := lib.put(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		source string
+		song   string
+		want   []string
+	}{
+		{libraryLocal, "稻香", []string{"周杰伦-稻香"}},
+		{libraryLocal, "稻 香！", []string{"周杰伦-稻香"}},
+		{libraryLocal, "daoxiang", []string{"周杰伦-稻香"}},
+		{libraryLocal, "周杰伦稻香", []string{"周杰伦-稻香"}},
+		{libraryLocal, "稻香周杰伦", []string{"周杰伦-稻香"}},
+		{libraryLocal, "晴天", []string{"周杰倫-晴天"}},
+		{libraryLocal, "LOVER", []string{"Taylor Swift-Lover"}},
+		{libraryLocal, "Love", nil},
+		{libraryLocal, "青天", nil},
+		{libraryLocal, "稻", nil},
+		{libraryLocal, "", nil},
+		{libraryCache, "稻香", []string{"周杰伦-稻香"}},
+		{librarySources, "稻香", nil},
+	}
+	for _, test := range tests {
+		got := libraryEntryNames(lib.FindNormalized(test.source, newMatchKey(test.song)))
+		if len(got) != len(test.want) || len(got) > 0 && got[0] != test.want[0] {
+			t.Errorf("FindNormalized(%s, %q) = %v, want %v", test.source, test.song, got, test.want)
+		}
+	}
+
+	// Renamed tracks lose their old keys
+	if err := lib.put(LibraryEntry{Source: libraryLocal, Name: "周杰伦-稻香", Item: MusicItem{Title: "稻香 (Live)", Artist: "周杰伦"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := lib.FindNormalized(libraryLocal, newMatchKey("稻香")); len(got) != 0 {
+		t.Errorf("old title still found: %v", libraryEntryNames(got))
+	}
+	if got := lib.FindNormalized(libraryLocal, newMatchKey("稻香live")); len(got) != 1 {
+		t.Errorf("new title not found: %v", libraryEntryNames(got))
+	}
+}
+
+func TestLibraryFuzzyPlaybackLookup(t *testing.T) {
+	lib := openTestLibrary(t, filepath.Join(t.TempDir(), "library.db"))
+	for _, entry := range []LibraryEntry{
+		{Source: libraryLocal, Name: "周杰伦-稻香", Item: MusicItem{Title: "稻香", Artist: "周杰伦"}},
+		{Source: libraryLocal, Name: "周杰伦-告白气球", Item: MusicItem{Title: "告白气球", Artist: "周杰伦"}},
+		{Source: libraryLocal, Name: "Ed Sheeran-Shape of You", Item: MusicItem{Title: "Shape of You", Artist: "Ed Sheeran"}},
+		{Source: libraryLocal, Name: "Taylor Swift-Lover", Item: MusicItem{Title: "Lover", Artist: "Taylor Swift"}},
+		{Source: libraryLocal, Name: "Adele-Hello", Item: MusicItem{Title: "Hello", Artist: "Adele"}},
+		{Source: libraryLocal, Name: "Lionel Richie-Hello", Item: MusicItem{Title: "Hello", Artist: "Lionel Richie"}},
+		{Source: libraryCache, Name: "周杰伦-稻香", Item: MusicItem{Title: "稻香", Artist: "周杰伦"}},
+	} {
+		if err := lib.put(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		song, singer string
+		want         string
+	}{
+		{"播放稻香", "", "周杰伦-稻香"},
+		{"告白的气球", "", "周杰伦-告白气球"},
+		{"shape you", "", "Ed Sheeran-Shape of You"},
+		{"play hello", "adele", "Adele-Hello"},
+		// Two different songs named Hello score the same
+		{"play hello", "", ""},
+		{"Love", "", ""},
+		{"青天", "", ""},
+	}
+	for _, test := range tests {
+		entry, _, ok := pickPlaybackEntry(lib.FindByWords(libraryLocal, newMatchKey(test.song)), newMatchKey(test.song), newMatchKey(test.singer))
+		if got := entry.Name; !ok && got != "" || got != test.want {
+			t.Errorf("fuzzy lookup of %q by %q = %q, want %q", test.song, test.singer, got, test.want)
+		}
+	}
+
+	// Candidates share a title word with the song, each entry once
+	if got := libraryEntryNames(lib.FindByWords(libraryLocal, newMatchKey("稻香稻"))); len(got) != 1 || got[0] != "周杰伦-稻香" {
+		t.Errorf("FindByWords = %v", got)
+	}
+	if got := lib.FindByWords(librarySources, newMatchKey("稻香")); len(got) != 0 {
+		t.Errorf("FindByWords read another source: %v", libraryEntryNames(got))
+	}
+}
+
+func TestLibraryBuildsNamesOfOldIndexes(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "library.db")
+	lib, err := openLibraryIndex(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.put(LibraryEntry{Source: libraryLocal, Name: "周杰伦-稻香", Item: MusicItem{Title: "稻香", Artist: "周杰伦"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Indexes of earlier versions have no lookup buckets
+	err = lib.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(libraryNamesBucket); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(libraryWordsBucket)
+	})
+	lib.db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lib = openTestLibrary(t, indexFile)
+	if got := lib.FindNormalized(libraryLocal, newMatchKey("daoxiang")); len(got) != 1 {
+		t.Errorf("names were not built for the existing entries: %v", libraryEntryNames(got))
+	}
+	if got := lib.FindByWords(libraryLocal, newMatchKey("播放稻香")); len(got) != 1 {
+		t.Errorf("words were not built for the existing entries: %v", libraryEntryNames(got))
+	}
+}
+
+func TestLibraryRefreshInBackground(t *testing.T) {
+	t.Chdir(t.TempDir())
+	lib := openTestLibrary(t, "library.db")
+	// The refresh has to finish before the index is closed
+	waitForRefresh := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			lib.missMu.Lock()
+			running := lib.missRefreshing
+			lib.missMu.Unlock()
+			if !running {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("refresh did not finish")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if !lib.RefreshInBackground(time.Hour) {
+		t.Fatal("first miss did not start a refresh")
+	}
+	if lib.RefreshInBackground(time.Hour) {
+		t.Error("second miss within the interval started another refresh")
+	}
+	waitForRefresh()
+	if lib.RefreshInBackground(time.Hour) {
+		t.Error("a finished refresh within the interval started another one")
+	}
+	if !lib.RefreshInBackground(0) {
+		t.Error("a refresh after the interval was not started")
+	}
+	waitForRefresh()
+}
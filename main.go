@@ -22,17 +22,54 @@ func main() {
 		fmt.Printf("[Warning] %s Loading .env file failed: %v\nUse the default configuration instead.\n", TAG, err)
 	}
 
+	// Bulk import mode, organizes a folder of audio files or a bundle into the library and exits
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImportCommand(os.Args[2:]))
+	}
+	// Export mode, packs cache entries into a bundle for servers without internet access and exits
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExportCommand(os.Args[2:]))
+	}
+	// Prefetch mode, fetches a list of songs into the cache and exits
+	if len(os.Args) > 1 && os.Args[1] == "prefetch" {
+		os.Exit(runPrefetchCommand(os.Args[2:]))
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		fmt.Printf("[Warning] %s PORT environment variable not set\nUse the default port 2233 instead.\n", TAG)
 		port = "2233"
 	}
 
+	cleanupTempFiles()
+	startLibraryIndex()
+	startCacheManager()
+	startCacheVerifier()
+
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/stream_pcm", apiHandler)
+	http.HandleFunc("/api/search", searchHandler)
+	http.HandleFunc("/api/jobs", jobsHandler)
+	http.HandleFunc("/api/jobs/", jobsHandler)
+
+	http.HandleFunc("/api/albums", albumsHandler)
+	http.HandleFunc("/api/albums/", albumsHandler)
+	http.HandleFunc("/api/artists", artistsHandler)
+	http.HandleFunc("/api/artists/", artistsHandler)
+
+	http.HandleFunc("/api/playlists", playlistsHandler)
+	http.HandleFunc("/api/playlists/", playlistsHandler)
+
+	http.HandleFunc("/api/cache", cacheHandler)
+	http.HandleFunc("/api/cache/", cacheHandler)
+
+	http.HandleFunc("/files/", fileHandler)
 
-	fs := http.FileServer(http.Dir("files"))
-	http.Handle("/files/", http.StripPrefix("/files/", fs))
+	http.HandleFunc("/api/admin/import", importHandler)
+	http.HandleFunc("/api/admin/import/", importHandler)
+	http.HandleFunc("/api/admin/bundle", bundleHandler)
+	http.HandleFunc("/api/admin/prefetch", prefetchHandler)
+	http.HandleFunc("/api/admin/prefetch/", prefetchHandler)
 
 	fmt.Printf("[Info] %s Started.\n喵波音律-音乐家园QQ交流群:865754861\n", TAG)
 	fmt.Printf("[Info] Starting music server at port %s\n", port)
@@ -85,4 +122,7 @@ func main() {
 	if err := srv.Shutdown(context.Background()); err != nil {
 		fmt.Println(err)
 	}
+	stopCacheManager()
+	flushSongRequests()
+	closeLibrary()
 }
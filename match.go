@@ -0,0 +1,323 @@
+package main
+
+import (
+	_ "embed"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+//go:generate go run gen_hanzi.go
+
+// pinyinData lists every pinyin syllable followed by the characters read that way.
+//
+//go:embed data/pinyin.txt
+var pinyinData string
+
+// t2sData lists traditional characters each followed by its simplified form.
+//
+//go:embed data/t2s.txt
+var t2sData string
+
+var (
+	hanziOnce       sync.Once
+	hanziPinyin     map[rune]string
+	hanziSimplified map[rune]rune
+)
+
+// matchThreshold is the lowest score accepted as a match by the fuzzy lookups.
+const matchThreshold = 0.6
+
+const (
+	// playbackMatchThreshold is the lowest score of a fuzzy match that is played without an exact name
+	playbackMatchThreshold = 0.7
+	// playbackMatchMargin is how far such a match has to lead the next different track
+	playbackMatchMargin = 0.05
+)
+
+// Helper function to load the embedded pinyin and traditional to simplified tables
+func loadHanziTables() {
+	hanziOnce.Do(func() {
+		hanziPinyin = make(map[rune]string, 28000)
+		for _, line := range strings.Split(pinyinData, "\n") {
+			syllable, chars, ok := strings.Cut(line, "\t")
+			if !ok || strings.HasPrefix(line, "#") {
+				continue
+			}
+			for _, char := range chars {
+				hanziPinyin[char] = syllable
+			}
+		}
+		hanziSimplified = make(map[rune]rune, 3000)
+		for _, line := range strings.Split(t2sData, "\n") {
+			if strings.HasPrefix(line, "#") || utf8.RuneCountInString(line) != 2 {
+				continue
+			}
+			chars := []rune(line)
+			hanziSimplified[chars[0]] = chars[1]
+		}
+	})
+}
+
+// matchKey is a song or artist name prepared for fuzzy matching.
+type matchKey struct {
+	Text     string   // NFKC, lower case and simplified, without spaces and punctuation
+	Pinyin   string   // Text with every Chinese character spelled in pinyin
+	Initials string   // First letter of every pinyin syllable and every other word
+	Words    []string // Words of other scripts and single Chinese characters
+}
+
+// Helper function to prepare a name for fuzzy matching. Full-width forms, traditional characters,
+// case, spaces and punctuation are folded away, so "周杰倫" and "周 杰伦！" get the same key.
+func newMatchKey(name string) matchKey {
+	loadHanziTables()
+	var key matchKey
+	var text, pinyin, initials, word strings.Builder
+	flushWord := func() {
+		if word.Len() > 0 {
+			key.Words = append(key.Words, word.String())
+			word.Reset()
+		}
+	}
+	for _, char := range norm.NFKC.String(name) {
+		char = unicode.ToLower(char)
+		if simplified, ok := hanziSimplified[char]; ok {
+			char = simplified
+		}
+		if syllable, ok := hanziPinyin[char]; ok {
+			flushWord()
+			text.WriteRune(char)
+			pinyin.WriteString(syllable)
+			initials.WriteByte(syllable[0])
+			key.Words = append(key.Words, string(char))
+			continue
+		}
+		if !unicode.IsLetter(char) && !unicode.IsDigit(char) {
+			// Spaces, punctuation and symbols only separate words
+			flushWord()
+			continue
+		}
+		if word.Len() == 0 {
+			initials.WriteRune(char)
+		}
+		text.WriteRune(char)
+		pinyin.WriteRune(char)
+		word.WriteRune(char)
+	}
+	flushWord()
+	key.Text, key.Pinyin, key.Initials = text.String(), pinyin.String(), initials.String()
+	return key
+}
+
+// Helper function to get the folded text of a name, for comparisons that need no scoring
+func normalizeMatchText(name string) string {
+	return newMatchKey(name).Text
+}
+
+// Helper function to check whether a string only holds the ASCII letters of pinyin initials
+func isLatinLetters(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 'a' || s[i] > 'z' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Helper function to compute the edit distance between two strings, counted in characters
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// Helper function to get the share of the longer string that the shorter one covers
+func lengthRatio(a, b string) float64 {
+	la, lb := utf8.RuneCountInString(a), utf8.RuneCountInString(b)
+	if la == 0 || lb == 0 {
+		return 0
+	}
+	return float64(min(la, lb)) / float64(max(la, lb))
+}
+
+// Helper function to score how well a query matches a name, from 0 for no match to 1 for the same name
+func matchScore(query, name matchKey) float64 {
+	if query.Text == "" || name.Text == "" {
+		return 0
+	}
+	switch {
+	case query.Text == name.Text:
+		return 1
+	case query.Pinyin == name.Pinyin:
+		// Pinyin typed for Chinese characters, or homophones from a speech transcript
+		return 0.95
+	case len(query.Text) >= 2 && isLatinLetters(query.Text) && query.Text == name.Initials:
+		// Initials like "zjl" for 周杰伦
+		return 0.9
+	}
+
+	score := 0.0
+	// A word missing from either side still leaves one name inside the other
+	if strings.Contains(name.Text, query.Text) {
+		score = max(score, 0.7+0.25*lengthRatio(query.Text, name.Text))
+	} else if strings.Contains(name.Pinyin, query.Pinyin) {
+		score = max(score, 0.65+0.25*lengthRatio(query.Pinyin, name.Pinyin))
+	}
+	if strings.Contains(query.Text, name.Text) {
+		score = max(score, 0.6+0.3*lengthRatio(query.Text, name.Text))
+	}
+
+	// The same words in a different order
+	if len(query.Words) > 1 && len(name.Words) > 1 {
+		found := 0
+		for _, word := range query.Words {
+			for _, other := range name.Words {
+				if word == other {
+					found++
+					break
+				}
+			}
+		}
+		score = max(score, 0.85*float64(found)/float64(max(len(query.Words), len(name.Words))))
+	}
+
+	// Typos and misheard syllables, compared on the pinyin so a wrong character costs little
+	a, b := []rune(query.Pinyin), []rune(name.Pinyin)
+	if len(a) <= 128 && len(b) <= 128 {
+		similarity := 1 - float64(levenshtein(a, b))/float64(max(len(a), len(b)))
+		score = max(score, 0.9*similarity)
+	}
+	return score
+}
+
+// Helper function to check that a name is the query once both are normalized: the same after NFKC, case,
+// traditional to simplified folding and dropping punctuation, or the query is the name typed in pinyin.
+// Chinese homophones like 晴天 and 青天 are different names.
+func isSameName(query, name matchKey) bool {
+	if query.Text == "" {
+		return false
+	}
+	return query.Text == name.Text || isLatinLetters(query.Text) && query.Text == name.Pinyin
+}
+
+// Helper function to check whether a track is the requested song, for lookups that decide what gets played.
+// Unlike scoreTrackMatch there are no partial matches, similar songs are left to scorePlaybackMatch.
+func isPlaybackMatch(song, singer matchKey, title, artist string) bool {
+	titleKey := newMatchKey(title)
+	if singer.Text != "" {
+		return isSameName(song, titleKey) && isSameName(singer, newMatchKey(artist))
+	}
+	if isSameName(song, titleKey) {
+		return true
+	}
+	// Speech transcripts often put the singer into the song
+	if artist == "" {
+		return false
+	}
+	for _, combined := range []string{artist + title, title + artist} {
+		if isSameName(song, newMatchKey(combined)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to score a track against the requested song and singer, returning 0 for no match.
+// Speech transcripts often put the singer into the song, so the song is also compared with both names.
+func scoreTrackMatch(song, singer matchKey, title, artist string) float64 {
+	titleKey := newMatchKey(title)
+	score := matchScore(song, titleKey)
+	if singer.Text != "" {
+		artistScore := matchScore(singer, newMatchKey(artist))
+		if artistScore < matchThreshold || score < matchThreshold {
+			return 0
+		}
+		return 0.7*score + 0.3*artistScore
+	}
+	// The combined names only count when the title was said, so naming just the singer matches none of its songs
+	if score < 1 && artist != "" && titleKey.Text != "" && (strings.Contains(song.Text, titleKey.Text) || strings.Contains(song.Pinyin, titleKey.Pinyin)) {
+		for _, combined := range []string{artist + title, title + artist} {
+			score = max(score, matchScore(song, newMatchKey(combined)))
+		}
+	}
+	if score < matchThreshold {
+		return 0
+	}
+	return score
+}
+
+// Helper function to check whether a word of a name appears in the query words. Long words of names with
+// several words may be misspelled by one character, single-word names must be spelled right.
+func hasNameWord(queryWords []string, word string, typos bool) (found, exact bool) {
+	for _, queryWord := range queryWords {
+		if queryWord == word {
+			return true, true
+		}
+	}
+	if !typos || utf8.RuneCountInString(word) < 5 {
+		return false, false
+	}
+	for _, queryWord := range queryWords {
+		if levenshtein([]rune(queryWord), []rune(word)) <= 1 {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// Helper function to check that the query names every word of a name except at most one. Extra words in the
+// query are fine, speech transcripts add things like "播放" or "的". One differing character of a Chinese name
+// is a missing word too, so homophones like 晴天 and 青天 or Lover and Love are not covered.
+func coversName(query, name matchKey) bool {
+	common, exact, missing := 0, 0, 0
+	for _, word := range name.Words {
+		found, isExact := hasNameWord(query.Words, word, len(name.Words) > 1)
+		switch {
+		case isExact:
+			common++
+			exact++
+		case found:
+			common++
+		default:
+			missing++
+		}
+	}
+	if exact == 0 || missing > 1 || common <= missing {
+		return false
+	}
+	// A single word is only trusted when it is long enough not to hide inside other words
+	return common >= 2 || utf8.RuneCountInString(name.Text) >= 3
+}
+
+// Helper function to score a track for playback when no name is the same, returning 0 unless the match is
+// confident: scoreTrackMatch is high and the query covers the title, and the singer if one was given.
+func scorePlaybackMatch(song, singer matchKey, title, artist string) float64 {
+	score := scoreTrackMatch(song, singer, title, artist)
+	if score < playbackMatchThreshold || !coversName(song, newMatchKey(title)) {
+		return 0
+	}
+	if singer.Text != "" {
+		artistKey := newMatchKey(artist)
+		if !isSameName(singer, artistKey) && !coversName(singer, artistKey) {
+			return 0
+		}
+	}
+	return score
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestIsPlaybackMatch(t *testing.T) {
+	tests := []struct {
+		song, singer, title, artist string
+		want                        bool
+	}{
+		{"稻香", "", "稻香", "周杰伦", true},
+		{"稻香", "周杰倫", "稻香", "周杰伦", true},
+		{"dao xiang", "", "稻香", "周杰伦", true},
+		{"Mr. Brightside!", "", "mr brightside", "The Killers", true},
+		{"ＬＯＶＥＲ", "", "Lover", "Taylor Swift", true},
+		{"周杰伦稻香", "", "稻香", "周杰伦", true},
+		{"稻香", "林俊杰", "稻香", "周杰伦", false},
+		{"稻香", "", "倒影", "周杰伦", false},
+		{"Lover", "", "Love", "", false},
+		{"Believer", "", "Believe", "", false},
+		{"晴天", "", "青天", "", false},
+		{"Yellow", "", "Hello", "", false},
+		{"dx", "", "稻香", "周杰伦", false},
+		{"", "", "稻香", "周杰伦", false},
+	}
+	for _, test := range tests {
+		got := isPlaybackMatch(newMatchKey(test.song), newMatchKey(test.singer), test.title, test.artist)
+		if got != test.want {
+			t.Errorf("isPlaybackMatch(%q, %q, %q, %q) = %v, want %v", test.song, test.singer, test.title, test.artist, got, test.want)
+		}
+	}
+}
+
+func TestScorePlaybackMatch(t *testing.T) {
+	tests := []struct {
+		song, singer, title, artist string
+		want                        bool
+	}{
+		{"周杰伦的稻香", "", "稻香", "周杰伦", true},
+		{"播放稻香", "", "稻香", "周杰伦", true},
+		{"告白的气球", "", "告白气球", "周杰伦", true},
+		{"shape you", "", "Shape of You", "Ed Sheeran", true},
+		{"bohemian rapsody", "", "Bohemian Rhapsody", "Queen", true},
+		{"稻香", "", "稻香 (Live)", "周杰伦", true},
+		{"稻香", "", "倒影", "周杰伦", false},
+		{"Lover", "", "Love", "", false},
+		{"Lover", "", "Lovers", "", false},
+		{"Believer", "", "Believe", "", false},
+		{"晴天", "", "青天", "", false},
+		{"Yellow", "", "Hello", "", false},
+		{"七里香", "", "稻香", "周杰伦", false},
+		{"你好", "", "你", "", false},
+		{"播放稻香", "林俊杰", "稻香", "周杰伦", false},
+	}
+	for _, test := range tests {
+		score := scorePlaybackMatch(newMatchKey(test.song), newMatchKey(test.singer), test.title, test.artist)
+		if got := score >= playbackMatchThreshold; got != test.want || !got && score != 0 {
+			t.Errorf("scorePlaybackMatch(%q, %q, %q, %q) = %.2f, want match %v", test.song, test.singer, test.title, test.artist, score, test.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PCMOptions describes the raw audio layout requested by a device.
+type PCMOptions struct {
+	Format     string // "pcm" for headerless samples, "wav" for a WAV header followed by samples
+	SampleRate int
+	Channels   int
+	Bits       int
+}
+
+// Helper function to parse PCM options from query parameters
+func parsePCMOptions(queryParams url.Values) (PCMOptions, error) {
+	options := PCMOptions{
+		Format:     strings.ToLower(queryParams.Get("format")),
+		SampleRate: 16000,
+		Channels:   1,
+		Bits:       16,
+	}
+	if options.Format != "pcm" && options.Format != "wav" {
+		return options, fmt.Errorf("unsupported format: %s", options.Format)
+	}
+
+	if rate := queryParams.Get("rate"); rate != "" {
+		value, err := strconv.Atoi(rate)
+		if err != nil || value < 8000 || value > 48000 {
+			return options, fmt.Errorf("invalid sample rate: %s", rate)
+		}
+		options.SampleRate = value
+	}
+	if channels := queryParams.Get("channels"); channels != "" {
+		value, err := strconv.Atoi(channels)
+		if err != nil || value < 1 || value > 2 {
+			return options, fmt.Errorf("invalid channel count: %s", channels)
+		}
+		options.Channels = value
+	}
+	if bits := queryParams.Get("bits"); bits != "" {
+		value, err := strconv.Atoi(bits)
+		if err != nil || (value != 8 && value != 16 && value != 24 && value != 32) {
+			return options, fmt.Errorf("invalid bit depth: %s", bits)
+		}
+		options.Bits = value
+	}
+
+	return options, nil
+}
+
+// ffmpegSampleFormat returns the ffmpeg raw muxer and codec for the bit depth.
+func (options PCMOptions) ffmpegSampleFormat() (string, string) {
+	switch options.Bits {
+	case 8:
+		return "u8", "pcm_u8"
+	case 24:
+		return "s24le", "pcm_s24le"
+	case 32:
+		return "s32le", "pcm_s32le"
+	default:
+		return "s16le", "pcm_s16le"
+	}
+}
+
+// contentType returns the Content-Type header for the stream.
+func (options PCMOptions) contentType() string {
+	if options.Format == "wav" {
+		return "audio/wav"
+	}
+	return fmt.Sprintf("audio/pcm;rate=%d;channels=%d;bits=%d;endianness=little-endian", options.SampleRate, options.Channels, options.Bits)
+}
+
+// Helper function to build a streaming WAV header with unknown data length
+func buildStreamingWAVHeader(options PCMOptions) []byte {
+	header := make([]byte, 44)
+	blockAlign := options.Channels * options.Bits / 8
+	// The data length is unknown while streaming, so use the maximum value
+	dataSize := uint32(0xFFFFFFFF - 36)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], dataSize+36)
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], 1) // PCM
+	binary.LittleEndian.PutUint16(header[22:24], uint16(options.Channels))
+	binary.LittleEndian.PutUint32(header[24:28], uint32(options.SampleRate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(options.SampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(header[32:34], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:36], uint16(options.Bits))
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], dataSize)
+	return header
+}
+
+// pcmInput is the audio a PCM stream decodes, either a file inside ./files or a remote URL.
+type pcmInput struct {
+	Path string
+	URL  string
+}
+
+// Helper function to find the decoder input for a resolved music item
+func getPCMInput(r *http.Request, musicItem MusicItem) (pcmInput, error) {
+	// Prefer the original quality file and fall back to the compressed one
+	for _, rawURL := range []string{musicItem.AudioFullURL, musicItem.AudioURL} {
+		if rawURL == "" {
+			continue
+		}
+		if localPath, ok := getLocalPathFromURL(r, rawURL); ok {
+			return pcmInput{Path: localPath}, nil
+		}
+		parsedURL, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+		if parsedURL.Host != "" && parsedURL.Host != r.Host {
+			return pcmInput{URL: rawURL}, nil
+		}
+
+		// Remote sources are wrapped by the /url/ proxy, they are fetched without going through it again
+		decodedPath, err := url.PathUnescape(parsedURL.Path)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(decodedPath, "/url/http/") {
+			return pcmInput{URL: "http://" + strings.TrimPrefix(decodedPath, "/url/http/")}, nil
+		}
+		if strings.HasPrefix(decodedPath, "/url/https/") {
+			return pcmInput{URL: "https://" + strings.TrimPrefix(decodedPath, "/url/https/")}, nil
+		}
+	}
+
+	return pcmInput{}, fmt.Errorf("no playable audio for %s - %s", musicItem.Artist, musicItem.Title)
+}
+
+// flushWriter flushes the response after every write so samples reach the device immediately. Devices
+// that stop reading are dropped after the idle timeout instead of holding a stream slot.
+type flushWriter struct {
+	w          io.Writer
+	controller *http.ResponseController
+	idle       time.Duration
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	if fw.idle > 0 {
+		fw.controller.SetWriteDeadline(time.Now().Add(fw.idle))
+	}
+	n, err := fw.w.Write(p)
+	if err == nil {
+		if flushErr := fw.controller.Flush(); !errors.Is(flushErr, http.ErrNotSupported) {
+			err = flushErr
+		}
+	}
+	return n, err
+}
+
+// Helper function to decode a music item and stream it as raw PCM or WAV
+func streamPCM(w http.ResponseWriter, r *http.Request, musicItem MusicItem, options PCMOptions) {
+	input, err := getPCMInput(r, musicItem)
+	if err != nil {
+		fmt.Println("[Error] Error finding PCM input:", err)
+		NotFoundHandler(w, r)
+		return
+	}
+	source := input.Path
+	if source == "" {
+		source = input.URL
+	}
+	fmt.Printf("[Info] Streaming %s as %s %d Hz %d ch %d bit\n", source, options.Format, options.SampleRate, options.Channels, options.Bits)
+
+	// Streams use their own pool, bounded by the stream time limit rather than the transcoding job timeout
+	pool := getStreamPool()
+	ctx, release, err := pool.Acquire(r.Context(), true)
+	if errors.Is(err, ErrQueueFull) {
+		pool.writeQueueFull(w)
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer release()
+
+	// ffmpeg would fetch URLs with its own HTTP stack and skip the URL policy, so remote audio is
+	// downloaded here and piped in
+	ffmpegInput := input.Path
+	var remote io.ReadCloser
+	if input.Path == "" {
+		remote, err = openRemoteFile(ctx, input.URL)
+		if errors.Is(err, ErrURLForbidden) {
+			writeForbidden(w, r, err)
+			return
+		}
+		if err != nil {
+			fmt.Println("[Error] Error fetching remote audio:", err)
+			NotFoundHandler(w, r)
+			return
+		}
+		defer remote.Close()
+		ffmpegInput = "pipe:0"
+	}
+
+	muxer, codec := options.ffmpegSampleFormat()
+	// The stream context kills ffmpeg when the device disconnects or the stream time limit is reached
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error", "-i", ffmpegInput, "-vn",
+		"-acodec", codec, "-ar", strconv.Itoa(options.SampleRate), "-ac", strconv.Itoa(options.Channels), "-f", muxer, "pipe:1")
+	if remote != nil {
+		cmd.Stdin = remote
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, "Failed to start decoder", http.StatusInternalServerError)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Println("[Error] Error starting ffmpeg:", err)
+		http.Error(w, "Failed to start decoder", http.StatusInternalServerError)
+		return
+	}
+	defer cmd.Wait()
+
+	// No Content-Length is set, so the response uses chunked transfer encoding
+	w.Header().Set("Content-Type", options.contentType())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Audio-Sample-Rate", strconv.Itoa(options.SampleRate))
+	w.Header().Set("X-Audio-Channels", strconv.Itoa(options.Channels))
+	w.Header().Set("X-Audio-Bits", strconv.Itoa(options.Bits))
+	w.WriteHeader(http.StatusOK)
+
+	out := flushWriter{w: w, controller: http.NewResponseController(w), idle: time.Duration(getEnvInt("PCM_WRITE_TIMEOUT", 30)) * time.Second}
+	if options.Format == "wav" {
+		if _, err := out.Write(buildStreamingWAVHeader(options)); err != nil {
+			return
+		}
+	}
+
+	buffer := make([]byte, 4096)
+	if _, err := io.CopyBuffer(out, stdout, buffer); err != nil {
+		fmt.Println("[Info] PCM stream stopped:", err)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		fmt.Printf("[Warning] PCM stream of %s reached the stream time limit\n", source)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PlaylistTrack is a reference to a song, resolved through the usual tiers when it is played.
+type PlaylistTrack struct {
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+	Source   string `json:"source,omitempty"`   // Tier the track was found in when it was added
+	Provider string `json:"provider,omitempty"` // Upstream version picked from the search results
+	ID       string `json:"id,omitempty"`
+	URL      string `json:"url,omitempty"` // Remote location of an imported track that is not in the library
+}
+
+// Playlist is a named list of tracks stored on the server.
+type Playlist struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Tracks      []PlaylistTrack `json:"tracks"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// PlaylistTrackView is a playlist track with the links to play it.
+type PlaylistTrackView struct {
+	PlaylistTrack
+	Position  int    `json:"position"`
+	PlayURL   string `json:"play_url"`
+	StreamURL string `json:"stream_url"`
+}
+
+// ErrPlaylistNotFound is returned for an unknown playlist ID.
+var ErrPlaylistNotFound = errors.New("playlist not found")
+
+// maxPlaylistBody limits the size of playlist requests and imported files.
+const maxPlaylistBody = 4 << 20
+
+// playlistStore keeps the playlists in PLAYLISTS_FILE.
+type playlistStore struct {
+	mu        sync.Mutex
+	file      string
+	playlists map[string]*Playlist
+}
+
+var (
+	playlists     *playlistStore
+	playlistsOnce sync.Once
+)
+
+// Helper function to get the playlist store, loading it on first use
+func getPlaylistStore() *playlistStore {
+	playlistsOnce.Do(func() {
+		file := os.Getenv("PLAYLISTS_FILE")
+		if file == "" {
+			file = "./playlists.json"
+		}
+		playlists = &playlistStore{file: file, playlists: map[string]*Playlist{}}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Println("[Error] Failed to read playlists file:", err)
+			}
+			return
+		}
+		var list []*Playlist
+		if err := json.Unmarshal(data, &list); err != nil {
+			fmt.Println("[Error] Failed to parse playlists file:", err)
+			return
+		}
+		for _, playlist := range list {
+			playlists.playlists[playlist.ID] = playlist
+		}
+		fmt.Printf("[Info] Loaded %d playlists from %s\n", len(list), file)
+	})
+	return playlists
+}
+
+// Helper function to write all playlists to the playlists file. The caller holds the lock.
+func (s *playlistStore) save() error {
+	data, err := json.MarshalIndent(s.sortedLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file, data, 0644)
+}
+
+// Helper function to list the playlists by creation time. The caller holds the lock.
+func (s *playlistStore) sortedLocked() []*Playlist {
+	list := make([]*Playlist, 0, len(s.playlists))
+	for _, playlist := range s.playlists {
+		list = append(list, playlist)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// List returns copies of all playlists.
+func (s *playlistStore) List() []Playlist {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []Playlist{}
+	for _, playlist := range s.sortedLocked() {
+		list = append(list, *playlist)
+	}
+	return list
+}
+
+// Get returns a copy of a playlist.
+func (s *playlistStore) Get(id string) (Playlist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	playlist, ok := s.playlists[id]
+	if !ok {
+		return Playlist{}, ErrPlaylistNotFound
+	}
+	copied := *playlist
+	copied.Tracks = append([]PlaylistTrack{}, playlist.Tracks...)
+	return copied, nil
+}
+
+// Create stores a new playlist and returns it.
+func (s *playlistStore) Create(name, description string, tracks []PlaylistTrack) (Playlist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if tracks == nil {
+		tracks = []PlaylistTrack{}
+	}
+	playlist := &Playlist{ID: newJobID(), Name: name, Description: description, Tracks: tracks, CreatedAt: now, UpdatedAt: now}
+	s.playlists[playlist.ID] = playlist
+	if err := s.save(); err != nil {
+		delete(s.playlists, playlist.ID)
+		return Playlist{}, err
+	}
+	return *playlist, nil
+}
+
+// Update changes a playlist through fn and stores it, leaving it untouched if fn or saving fails.
+func (s *playlistStore) Update(id string, fn func(playlist *Playlist) error) (Playlist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.playlists[id]
+	if !ok {
+		return Playlist{}, ErrPlaylistNotFound
+	}
+	playlist := *old
+	playlist.Tracks = append([]PlaylistTrack{}, old.Tracks...)
+	if err := fn(&playlist); err != nil {
+		return Playlist{}, err
+	}
+	playlist.UpdatedAt = time.Now()
+	s.playlists[id] = &playlist
+	if err := s.save(); err != nil {
+		s.playlists[id] = old
+		return Playlist{}, err
+	}
+	return playlist, nil
+}
+
+// Delete removes a playlist.
+func (s *playlistStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.playlists[id]
+	if !ok {
+		return ErrPlaylistNotFound
+	}
+	delete(s.playlists, id)
+	if err := s.save(); err != nil {
+		s.playlists[id] = old
+		return err
+	}
+	return nil
+}
+
+// Helper function to find a track in sources.json, the local folder or the cache without fetching it
+func findPlaylistTrackEntry(title, artist string) (LibraryEntry, bool) {
+	return findBestLibraryEntry(title, artist)
+}
+
+// Helper function to fill in a track from the library, recording the tier it was found in
+func completePlaylistTrack(track PlaylistTrack) PlaylistTrack {
+	track.Title, track.Artist = strings.TrimSpace(track.Title), strings.TrimSpace(track.Artist)
+	if track.Provider != "" && track.ID != "" {
+		setFirst(&track.Source, "provider:"+track.Provider)
+		return track
+	}
+	entry, ok := findPlaylistTrackEntry(track.Title, track.Artist)
+	if !ok {
+		if track.URL == "" {
+			// Unknown songs are looked up upstream when they are played
+			setFirst(&track.Source, "upstream")
+		} else {
+			setFirst(&track.Source, "url")
+		}
+		return track
+	}
+	track.Source = entry.Source
+	setFirst(&track.Artist, entry.Item.Artist)
+	setFirst(&track.Album, entry.Album)
+	setFirst(&track.Album, entry.Item.Album)
+	if track.Duration == 0 {
+		track.Duration = entry.Item.Duration
+	}
+	return track
+}
+
+// Helper function to build the /stream_pcm link that plays a playlist track
+func buildPlaylistPlayURL(r *http.Request, track PlaylistTrack) string {
+	return buildPlayURL(r, SearchHit{MusicItem: MusicItem{Title: track.Title, Artist: track.Artist}, Provider: track.Provider, ID: track.ID})
+}
+
+// Helper function to get a link that streams the audio of a playlist track directly
+func resolvePlaylistStreamURL(r *http.Request, track PlaylistTrack) string {
+	if track.Provider == "" {
+		if entry, ok := findPlaylistTrackEntry(track.Title, track.Artist); ok {
+			musicItem := buildLibraryEntryMusicItem(r, entry)
+			// Local tracks have no music.mp3 until they were requested once
+			if musicItem.AudioURL != "" {
+				return musicItem.AudioURL
+			}
+		} else if track.URL != "" {
+			return buildSourceURL(r, track.URL)
+		}
+	}
+	// Fetch the track on demand and answer with the audio file
+	return buildPlaylistPlayURL(r, track) + "&url=true"
+}
+
+// Helper function to build the views of the tracks of a playlist
+func buildPlaylistTrackViews(r *http.Request, playlist Playlist) []PlaylistTrackView {
+	views := []PlaylistTrackView{}
+	for i, track := range playlist.Tracks {
+		views = append(views, PlaylistTrackView{
+			PlaylistTrack: track,
+			Position:      i + 1,
+			PlayURL:       buildPlaylistPlayURL(r, track),
+			StreamURL:     resolvePlaylistStreamURL(r, track),
+		})
+	}
+	return views
+}
+
+// Helper function to write a playlist with its track views
+func writePlaylistJSON(w http.ResponseWriter, r *http.Request, status int, playlist Playlist) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Playlist
+		Tracks []PlaylistTrackView `json:"tracks"`
+	}{playlist, buildPlaylistTrackViews(r, playlist)})
+}
+
+// Helper function to answer a playlist store error
+func writePlaylistError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrPlaylistNotFound) {
+		NotFoundHandler(w, r)
+		return
+	}
+	fmt.Println("[Error] Playlist operation failed:", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// playlistRequest is the body of playlist create and update requests.
+type playlistRequest struct {
+	Name        *string          `json:"name"`
+	Description *string          `json:"description"`
+	Tracks      *[]PlaylistTrack `json:"tracks"`
+}
+
+// Helper function to decode a JSON request body
+func decodePlaylistBody(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPlaylistBody)).Decode(value); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Helper function to fill in the tracks of a request, rejecting tracks without a title
+func completePlaylistTracks(tracks []PlaylistTrack) ([]PlaylistTrack, error) {
+	completed := make([]PlaylistTrack, 0, len(tracks))
+	for i, track := range tracks {
+		if strings.TrimSpace(track.Title) == "" {
+			return nil, fmt.Errorf("track %d has no title", i+1)
+		}
+		completed = append(completed, completePlaylistTrack(track))
+	}
+	return completed, nil
+}
+
+// playlistsHandler handles the /api/playlists endpoints:
+//
+//	GET    /api/playlists                       list playlists
+//	POST   /api/playlists                       create a playlist
+//	POST   /api/playlists/import?format=&name=  create a playlist from an M3U, PLS or XSPF file
+//	GET    /api/playlists/{id}                  get a playlist with playable links
+//	PUT    /api/playlists/{id}                  change the name, description or tracks
+//	DELETE /api/playlists/{id}                  delete a playlist
+//	POST   /api/playlists/{id}/tracks           add a track, optionally at ?position=
+//	DELETE /api/playlists/{id}/tracks/{n}       remove the track at position n
+//	GET    /api/playlists/{id}/export?format=   export as m3u, m3u8, pls or xspf
+func playlistsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "MeowMusicEmbeddedServer")
+	fmt.Printf("[Web Access] Handling request for %s %s\n", r.Method, r.URL.Path)
+	store := getPlaylistStore()
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/playlists"), "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		// The list carries the track count instead of the tracks
+		type playlistSummary struct {
+			Playlist
+			Tracks     []PlaylistTrack `json:"tracks,omitempty"`
+			TrackCount int             `json:"track_count"`
+		}
+		summaries := []playlistSummary{}
+		for _, playlist := range store.List() {
+			summaries = append(summaries, playlistSummary{Playlist: playlist, TrackCount: len(playlist.Tracks)})
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{"total": len(summaries), "playlists": summaries})
+
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var request playlistRequest
+		if !decodePlaylistBody(w, r, &request) {
+			return
+		}
+		if request.Name == nil || strings.TrimSpace(*request.Name) == "" {
+			http.Error(w, "missing playlist name", http.StatusBadRequest)
+			return
+		}
+		var tracks []PlaylistTrack
+		if request.Tracks != nil {
+			var err error
+			if tracks, err = completePlaylistTracks(*request.Tracks); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		description := ""
+		if request.Description != nil {
+			description = *request.Description
+		}
+		playlist, err := store.Create(strings.TrimSpace(*request.Name), description, tracks)
+		if err != nil {
+			writePlaylistError(w, r, err)
+			return
+		}
+		w.Header().Set("Location", "/api/playlists/"+playlist.ID)
+		writePlaylistJSON(w, r, http.StatusCreated, playlist)
+
+	case len(parts) == 1 && parts[0] == "import" && r.Method == http.MethodPost:
+		importPlaylistHandler(w, r, store)
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		playlist, err := store.Get(parts[0])
+		if err != nil {
+			writePlaylistError(w, r, err)
+			return
+		}
+		writePlaylistJSON(w, r, http.StatusOK, playlist)
+
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var request playlistRequest
+		if !decodePlaylistBody(w, r, &request) {
+			return
+		}
+		var tracks []PlaylistTrack
+		if request.Tracks != nil {
+			var err error
+			if tracks, err = completePlaylistTracks(*request.Tracks); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if request.Name != nil && strings.TrimSpace(*request.Name) == "" {
+			http.Error(w, "missing playlist name", http.StatusBadRequest)
+			return
+		}
+		playlist, err := store.Update(parts[0], func(playlist *Playlist) error {
+			if request.Name != nil {
+				playlist.Name = strings.TrimSpace(*request.Name)
+			}
+			if request.Description != nil {
+				playlist.Description = *request.Description
+			}
+			if request.Tracks != nil {
+				playlist.Tracks = tracks
+			}
+			return nil
+		})
+		if err != nil {
+			writePlaylistError(w, r, err)
+			return
+		}
+		writePlaylistJSON(w, r, http.StatusOK, playlist)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if err := store.Delete(parts[0]); err != nil {
+			writePlaylistError(w, r, err)
+			return
+		}
+		fmt.Printf("[Info] Deleted playlist %s\n", parts[0])
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "tracks" && r.Method == http.MethodPost:
+		var track PlaylistTrack
+		if !decodePlaylistBody(w, r, &track) {
+			return
+		}
+		if strings.TrimSpace(track.Title) == "" {
+			http.Error(w, "missing track title", http.StatusBadRequest)
+			return
+		}
+		track = completePlaylistTrack(track)
+		position, _ := strconv.Atoi(r.URL.Query().Get("position"))
+		playlist, err := store.Update(parts[0], func(playlist *Playlist) error {
+			if position < 1 || position > len(playlist.Tracks) {
+				playlist.Tracks = append(playlist.Tracks, track)
+				return nil
+			}
+			playlist.Tracks = append(playlist.Tracks[:position-1], append([]PlaylistTrack{track}, playlist.Tracks[position-1:]...)...)
+			return nil
+		})
+		if err != nil {
+			writePlaylistError(w, r, err)
+			return
+		}
+		writePlaylistJSON(w, r, http.StatusOK, playlist)
+
+	case len(parts) == 3 && parts[1] == "tracks" && r.Method == http.MethodDelete:
+		position, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, "invalid track position", http.StatusBadRequest)
+			return
+		}
+		playlist, err := store.Update(parts[0], func(playlist *Playlist) error {
+			if position < 1 || position > len(playlist.Tracks) {
+				return ErrPlaylistNotFound
+			}
+			playlist.Tracks = append(playlist.Tracks[:position-1], playlist.Tracks[position:]...)
+			return nil
+		})
+		if err != nil {
+			writePlaylistError(w, r, err)
+			return
+		}
+		writePlaylistJSON(w, r, http.StatusOK, playlist)
+
+	case len(parts) == 2 && parts[1] == "export" && r.Method == http.MethodGet:
+		playlist, err := store.Get(parts[0])
+		if err != nil {
+			writePlaylistError(w, r, err)
+			return
+		}
+		format := strings.ToLower(r.URL.Query().Get("format"))
+		if format == "" {
+			format = "m3u8"
+		}
+		data, contentType, err := exportPlaylist(playlist, buildPlaylistTrackViews(r, playlist), format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(playlist.Name+"."+format))
+		w.Write(data)
+
+	default:
+		if len(parts) > 3 {
+			NotFoundHandler(w, r)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Helper function to create a playlist from an uploaded M3U, PLS or XSPF file
+func importPlaylistHandler(w http.ResponseWriter, r *http.Request, store *playlistStore) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxPlaylistBody+1))
+	if err != nil {
+		http.Error(w, "failed to read playlist: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxPlaylistBody {
+		http.Error(w, "playlist too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	parsed, err := parsePlaylist(data, strings.ToLower(r.URL.Query().Get("format")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	setFirst(&name, parsed.Name)
+	setFirst(&name, "Imported playlist")
+	tracks := []PlaylistTrack{}
+	skipped := []string{}
+	for _, track := range parsed.Tracks {
+		if track.Title == "" {
+			skipped = append(skipped, track.URL)
+			continue
+		}
+		tracks = append(tracks, completePlaylistTrack(track))
+	}
+	playlist, err := store.Create(name, "", tracks)
+	if err != nil {
+		writePlaylistError(w, r, err)
+		return
+	}
+	fmt.Printf("[Info] Imported playlist %s with %d tracks, skipped %d entries\n", playlist.Name, len(tracks), len(skipped))
+	w.Header().Set("Location", "/api/playlists/"+playlist.ID)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Playlist
+		Tracks  []PlaylistTrackView `json:"tracks"`
+		Skipped []string            `json:"skipped"`
+	}{playlist, buildPlaylistTrackViews(r, playlist), skipped})
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parsedPlaylist is a playlist read from an M3U, PLS or XSPF file.
+type parsedPlaylist struct {
+	Name   string
+	Tracks []PlaylistTrack
+}
+
+// xspfPlaylist is the XML layout of an XSPF playlist.
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+// xspfTrack is a track of an XSPF playlist.
+type xspfTrack struct {
+	Location string `xml:"location,omitempty"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int    `xml:"duration,omitempty"` // Milliseconds
+}
+
+// Helper function to detect the format of a playlist file from its content
+func detectPlaylistFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return "xspf"
+	case len(trimmed) >= 10 && strings.EqualFold(string(trimmed[:10]), "[playlist]"):
+		return "pls"
+	}
+	return "m3u"
+}
+
+// Helper function to parse a playlist file, detecting the format if it is not given
+func parsePlaylist(data []byte, format string) (parsedPlaylist, error) {
+	if format == "" {
+		format = detectPlaylistFormat(data)
+	}
+	// Playlists written by old desktop players are not always valid UTF-8
+	text := strings.ToValidUTF8(string(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))), "�")
+	switch format {
+	case "m3u", "m3u8", "extm3u":
+		return parseM3U(text)
+	case "pls":
+		return parsePLS(text), nil
+	case "xspf":
+		return parseXSPF(text)
+	}
+	return parsedPlaylist{}, fmt.Errorf("unsupported playlist format: %s", format)
+}
+
+// Helper function to split a display name like "<artist> - <title>"
+func splitDisplayName(name string) (string, string) {
+	if parts := strings.SplitN(name, " - ", 2); len(parts) == 2 {
+		return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	}
+	return "", strings.TrimSpace(name)
+}
+
+// Helper function to build a track from the location of a playlist entry. Links to this server's
+// /stream_pcm keep their query, remote links are kept so they can be streamed through the proxy,
+// and local paths only give their file name.
+func trackFromLocation(location string) PlaylistTrack {
+	location = strings.TrimSpace(location)
+	track := PlaylistTrack{}
+	if location == "" {
+		return track
+	}
+	filePath := strings.ReplaceAll(location, "\\", "/")
+	if parsed, err := url.Parse(location); err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") {
+		if strings.HasSuffix(parsed.Path, "/stream_pcm") {
+			query := parsed.Query()
+			track.Title, track.Artist = query.Get("song"), query.Get("singer")
+			track.Provider, track.ID = query.Get("provider"), query.Get("id")
+			return track
+		}
+		track.URL = location
+		filePath = parsed.Path
+		if unescaped, err := url.PathUnescape(filePath); err == nil {
+			filePath = unescaped
+		}
+	} else if strings.HasPrefix(location, "file://") {
+		if parsed, err := url.Parse(location); err == nil {
+			filePath = parsed.Path
+		}
+	}
+
+	name := path.Base(filePath)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if name == "music" || name == "music_full" {
+		// Files laid out like the library are named by their folder
+		parent := path.Base(path.Dir(filePath))
+		if parts := strings.SplitN(parent, "-", 2); len(parts) == 2 {
+			track.Artist, track.Title = parts[0], parts[1]
+			return track
+		}
+		name = parent
+	}
+	track.Artist, track.Title = splitDisplayName(name)
+	return track
+}
+
+// Helper function to parse a plain or extended M3U playlist
+func parseM3U(text string) (parsedPlaylist, error) {
+	var playlist parsedPlaylist
+	var pending PlaylistTrack
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), maxPlaylistBody)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			playlist.Name = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := strings.TrimPrefix(line, "#EXTINF:")
+			duration, display, _ := strings.Cut(info, ",")
+			// The duration may be followed by attributes like tvg-name="..."
+			if fields := strings.Fields(duration); len(fields) > 0 {
+				if seconds, err := strconv.ParseFloat(fields[0], 64); err == nil && seconds > 0 {
+					pending.Duration = int(seconds)
+				}
+			}
+			pending.Artist, pending.Title = splitDisplayName(display)
+		case strings.HasPrefix(line, "#EXTALB:"):
+			pending.Album = strings.TrimSpace(strings.TrimPrefix(line, "#EXTALB:"))
+		case strings.HasPrefix(line, "#EXTART:"):
+			pending.Artist = strings.TrimSpace(strings.TrimPrefix(line, "#EXTART:"))
+		case strings.HasPrefix(line, "#"):
+			// Other directives and comments are ignored
+		default:
+			playlist.Tracks = append(playlist.Tracks, mergePlaylistTrack(pending, trackFromLocation(line)))
+			pending = PlaylistTrack{}
+		}
+	}
+	// A line the scanner could not hold would otherwise cut the playlist short without a word
+	if err := scanner.Err(); err != nil {
+		return parsedPlaylist{}, fmt.Errorf("error reading M3U playlist: %w", err)
+	}
+	return playlist, nil
+}
+
+// Helper function to parse a PLS playlist
+func parsePLS(text string) parsedPlaylist {
+	var playlist parsedPlaylist
+	entries := map[int]*PlaylistTrack{}
+	locations := map[int]string{}
+	for _, line := range strings.Split(text, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if key == "x-gnome-title" || key == "playlistname" {
+			playlist.Name = value
+			continue
+		}
+		var field string
+		for _, prefix := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, prefix) {
+				field = prefix
+				break
+			}
+		}
+		index, err := strconv.Atoi(strings.TrimPrefix(key, field))
+		if field == "" || err != nil {
+			continue
+		}
+		entry, ok := entries[index]
+		if !ok {
+			entry = &PlaylistTrack{}
+			entries[index] = entry
+		}
+		switch field {
+		case "file":
+			locations[index] = value
+		case "title":
+			entry.Artist, entry.Title = splitDisplayName(value)
+		case "length":
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				entry.Duration = seconds
+			}
+		}
+	}
+
+	indexes := make([]int, 0, len(locations))
+	for index := range locations {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		playlist.Tracks = append(playlist.Tracks, mergePlaylistTrack(*entries[index], trackFromLocation(locations[index])))
+	}
+	return playlist
+}
+
+// Helper function to parse an XSPF playlist
+func parseXSPF(text string) (parsedPlaylist, error) {
+	var document struct {
+		Title  string      `xml:"title"`
+		Tracks []xspfTrack `xml:"trackList>track"`
+	}
+	if err := xml.Unmarshal([]byte(text), &document); err != nil {
+		return parsedPlaylist{}, fmt.Errorf("invalid XSPF playlist: %w", err)
+	}
+	playlist := parsedPlaylist{Name: strings.TrimSpace(document.Title)}
+	for _, entry := range document.Tracks {
+		track := PlaylistTrack{
+			Title:    strings.TrimSpace(entry.Title),
+			Artist:   strings.TrimSpace(entry.Creator),
+			Album:    strings.TrimSpace(entry.Album),
+			Duration: entry.Duration / 1000,
+		}
+		playlist.Tracks = append(playlist.Tracks, mergePlaylistTrack(track, trackFromLocation(entry.Location)))
+	}
+	return playlist, nil
+}
+
+// Helper function to combine the metadata of a playlist entry with what its location tells
+func mergePlaylistTrack(metadata, location PlaylistTrack) PlaylistTrack {
+	track := metadata
+	if track.Title == "" {
+		track.Title, track.Artist = location.Title, location.Artist
+	}
+	setFirst(&track.Artist, location.Artist)
+	track.Provider, track.ID, track.URL = location.Provider, location.ID, location.URL
+	return track
+}
+
+// Helper function to get the display name of a track
+func playlistDisplayName(track PlaylistTrack) string {
+	if track.Artist == "" {
+		return track.Title
+	}
+	return track.Artist + " - " + track.Title
+}
+
+// Helper function to keep a name on its line of an M3U or PLS file, a line break would start a new entry
+func playlistLineText(text string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(text)
+}
+
+// Helper function to write a playlist as m3u (plain list of links), m3u8 (extended M3U), pls or xspf
+func exportPlaylist(playlist Playlist, tracks []PlaylistTrackView, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "m3u":
+		// Devices only need the links to play one after another
+		for _, track := range tracks {
+			buf.WriteString(track.StreamURL + "\n")
+		}
+		return buf.Bytes(), "audio/x-mpegurl", nil
+
+	case "m3u8", "extm3u":
+		buf.WriteString("#EXTM3U\n")
+		buf.WriteString("#PLAYLIST:" + playlistLineText(playlist.Name) + "\n")
+		for _, track := range tracks {
+			duration := track.Duration
+			if duration == 0 {
+				duration = -1
+			}
+			fmt.Fprintf(&buf, "#EXTINF:%d,%s\n", duration, playlistLineText(playlistDisplayName(track.PlaylistTrack)))
+			if track.Album != "" {
+				buf.WriteString("#EXTALB:" + playlistLineText(track.Album) + "\n")
+			}
+			buf.WriteString(track.StreamURL + "\n")
+		}
+		return buf.Bytes(), "audio/mpegurl; charset=utf-8", nil
+
+	case "pls":
+		buf.WriteString("[playlist]\n")
+		buf.WriteString("X-GNOME-Title=" + playlistLineText(playlist.Name) + "\n")
+		for i, track := range tracks {
+			duration := track.Duration
+			if duration == 0 {
+				duration = -1
+			}
+			fmt.Fprintf(&buf, "File%d=%s\nTitle%d=%s\nLength%d=%d\n", i+1, track.StreamURL, i+1, playlistLineText(playlistDisplayName(track.PlaylistTrack)), i+1, duration)
+		}
+		fmt.Fprintf(&buf, "NumberOfEntries=%d\nVersion=2\n", len(tracks))
+		return buf.Bytes(), "audio/x-scpls; charset=utf-8", nil
+
+	case "xspf":
+		document := xspfPlaylist{Version: "1", Title: playlist.Name, Tracks: []xspfTrack{}}
+		for _, track := range tracks {
+			document.Tracks = append(document.Tracks, xspfTrack{
+				Location: track.StreamURL,
+				Title:    track.Title,
+				Creator:  track.Artist,
+				Album:    track.Album,
+				Duration: track.Duration * 1000,
+			})
+		}
+		buf.WriteString(xml.Header)
+		encoder := xml.NewEncoder(&buf)
+		encoder.Indent("", "  ")
+		if err := encoder.Encode(document); err != nil {
+			return nil, "", err
+		}
+		buf.WriteString("\n")
+		return buf.Bytes(), "application/xspf+xml; charset=utf-8", nil
+	}
+	return nil, "", fmt.Errorf("unsupported playlist format: %s", format)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		want   string
+		tracks []PlaylistTrack
+	}{
+		{
+			name: "extended m3u",
+			data: "\xef\xbb\xbf#EXTM3U\r\n#PLAYLIST:Road Trip\r\n#EXTINF:215 tvg-name=\"x\",周杰伦 - 稻香\r\n#EXTALB:魔杰座\r\nD:\\Music\\daoxiang.mp3\r\n\r\n#EXTINF:-1,Mr. Brightside\r\n#EXTART:The Killers\r\nhttps://example.com/a.mp3\r\n",
+			want: "Road Trip",
+			tracks: []PlaylistTrack{
+				{Title: "稻香", Artist: "周杰伦", Album: "魔杰座", Duration: 215},
+				{Title: "Mr. Brightside", Artist: "The Killers", URL: "https://example.com/a.mp3"},
+			},
+		},
+		{
+			name: "plain m3u of stream links",
+			data: "http://192.168.1.2:2233/stream_pcm?song=%E7%A8%BB%E9%A6%99&singer=%E5%91%A8%E6%9D%B0%E4%BC%A6\n/music/Alice - Song One.flac\n",
+			tracks: []PlaylistTrack{
+				{Title: "稻香", Artist: "周杰伦"},
+				{Title: "Song One", Artist: "Alice"},
+			},
+		},
+		{
+			name: "pls",
+			data: "[playlist]\nX-GNOME-Title=Mix\nFile2=/b.mp3\nTitle2=Bob - Two\nFile1=/a.mp3\nTitle1=Alice - One\nLength1=61\nNumberOfEntries=2\nVersion=2\n",
+			want: "Mix",
+			tracks: []PlaylistTrack{
+				{Title: "One", Artist: "Alice", Duration: 61},
+				{Title: "Two", Artist: "Bob"},
+			},
+		},
+		{
+			name: "xspf",
+			data: `<?xml version="1.0"?><playlist version="1" xmlns="http://xspf.org/ns/0/"><title> Chill </title><trackList><track><location>/a.mp3</location><title>One</title><creator>Alice</creator><album>First</album><duration>61000</duration></track></trackList></playlist>`,
+			want: "Chill",
+			tracks: []PlaylistTrack{
+				{Title: "One", Artist: "Alice", Album: "First", Duration: 61},
+			},
+		},
+	}
+	for _, test := range tests {
+		playlist, err := parsePlaylist([]byte(test.data), "")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if playlist.Name != test.want {
+			t.Errorf("%s: name %q, want %q", test.name, playlist.Name, test.want)
+		}
+		if len(playlist.Tracks) != len(test.tracks) {
+			t.Errorf("%s: got tracks %+v, want %+v", test.name, playlist.Tracks, test.tracks)
+			continue
+		}
+		for i, want := range test.tracks {
+			if got := playlist.Tracks[i]; got != want {
+				t.Errorf("%s: track %d = %+v, want %+v", test.name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestParsePlaylistErrors(t *testing.T) {
+	if _, err := parsePlaylist([]byte("<playlist><trackList>"), "xspf"); err == nil {
+		t.Error("broken XSPF was accepted")
+	}
+	if _, err := parsePlaylist([]byte("a.mp3"), "wpl"); err == nil {
+		t.Error("unknown format was accepted")
+	}
+	// A line longer than the scanner buffer must not silently end the playlist
+	long := "#EXTM3U\n/a.mp3\n#" + strings.Repeat("x", maxPlaylistBody) + "\n/b.mp3\n"
+	if _, err := parsePlaylist([]byte(long), "m3u"); !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("got %v, want the scanner error", err)
+	}
+}
+
+func TestExportPlaylistKeepsNamesOnOneLine(t *testing.T) {
+	playlist := Playlist{Name: "Mix\nhttp://evil.example/name.mp3"}
+	tracks := []PlaylistTrackView{
+		{
+			PlaylistTrack: PlaylistTrack{Title: "One\r\nhttp://evil.example/title.mp3", Artist: "Alice", Album: "First\nhttp://evil.example/album.mp3", Duration: 61},
+			StreamURL:     "http://server/stream_pcm?song=One&singer=Alice",
+		},
+		{
+			PlaylistTrack: PlaylistTrack{Title: "Two", Artist: "Bob\rFile9=http://evil.example/pls.mp3"},
+			StreamURL:     "http://server/stream_pcm?song=Two&singer=Bob",
+		},
+	}
+	for _, format := range []string{"m3u", "m3u8", "pls", "xspf"} {
+		data, _, err := exportPlaylist(playlist, tracks, format)
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		parsed, err := parsePlaylist(data, "")
+		if err != nil {
+			t.Errorf("%s: exported playlist does not parse: %v", format, err)
+			continue
+		}
+		if len(parsed.Tracks) != len(tracks) {
+			t.Errorf("%s: got %d tracks, want %d:\n%s", format, len(parsed.Tracks), len(tracks), data)
+			continue
+		}
+		// XML keeps the line breaks inside the element
+		if format == "m3u8" || format == "pls" {
+			if title := parsed.Tracks[0].Title; title != "One http://evil.example/title.mp3" {
+				t.Errorf("%s: title %q", format, title)
+			}
+		}
+		for _, track := range parsed.Tracks {
+			if strings.Contains(track.URL, "evil.example") {
+				t.Errorf("%s: injected entry %q", format, track.URL)
+			}
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Priority decides which queued ffmpeg job gets the next free worker.
+type Priority int
+
+const (
+	// PriorityInteractive is used for jobs a device or user is waiting on
+	PriorityInteractive Priority = iota
+	// PriorityBackground is used for prefetching and maintenance
+	PriorityBackground
+	priorityCount
+)
+
+// ErrQueueFull is returned when the transcoding queue cannot take another job.
+var ErrQueueFull = errors.New("transcoding queue is full")
+
+type priorityKey struct{}
+
+// Helper function to attach a job priority to a context
+func withPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// Helper function to read the job priority of a context, defaulting to interactive
+func priorityFromContext(ctx context.Context) Priority {
+	if isFetchRaised(ctx) {
+		return PriorityInteractive
+	}
+	if priority, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return priority
+	}
+	return PriorityInteractive
+}
+
+// poolWaiter is a queued job waiting for a worker.
+type poolWaiter struct {
+	ready chan struct{}
+}
+
+// workerPool limits the number of concurrent ffmpeg and ffprobe processes.
+type workerPool struct {
+	mu         sync.Mutex
+	maxWorkers int
+	maxQueue   int
+	jobTimeout time.Duration
+	retryAfter time.Duration
+	running    int
+	queues     [priorityCount][]*poolWaiter
+}
+
+var (
+	transcodePool     *workerPool
+	transcodePoolOnce sync.Once
+	streamPool        *workerPool
+	streamPoolOnce    sync.Once
+)
+
+// Helper function to get the transcoding pool configured by FFMPEG_MAX_WORKERS, FFMPEG_QUEUE_DEPTH,
+// FFMPEG_JOB_TIMEOUT and FFMPEG_RETRY_AFTER
+func getTranscodePool() *workerPool {
+	transcodePoolOnce.Do(func() {
+		transcodePool = &workerPool{
+			maxWorkers: getEnvInt("FFMPEG_MAX_WORKERS", runtime.NumCPU()),
+			maxQueue:   getEnvInt("FFMPEG_QUEUE_DEPTH", 16),
+			jobTimeout: time.Duration(getEnvInt("FFMPEG_JOB_TIMEOUT", 600)) * time.Second,
+			retryAfter: time.Duration(getEnvInt("FFMPEG_RETRY_AFTER", 10)) * time.Second,
+		}
+		if transcodePool.maxWorkers < 1 {
+			transcodePool.maxWorkers = 1
+		}
+		fmt.Printf("[Info] Transcoding pool: %d workers, queue depth %d, job timeout %s\n", transcodePool.maxWorkers, transcodePool.maxQueue, transcodePool.jobTimeout)
+	})
+	return transcodePool
+}
+
+// Helper function to get the PCM streaming pool configured by PCM_MAX_STREAMS, PCM_QUEUE_DEPTH and
+// PCM_MAX_STREAM_TIME. Streams last as long as the song, so they get their own slots instead of
+// holding transcoding workers that downloads and imports are waiting on.
+func getStreamPool() *workerPool {
+	streamPoolOnce.Do(func() {
+		streamPool = &workerPool{
+			maxWorkers: getEnvInt("PCM_MAX_STREAMS", runtime.NumCPU()),
+			maxQueue:   getEnvInt("PCM_QUEUE_DEPTH", 4),
+			jobTimeout: time.Duration(getEnvInt("PCM_MAX_STREAM_TIME", 1800)) * time.Second,
+			retryAfter: getTranscodePool().retryAfter,
+		}
+		if streamPool.maxWorkers < 1 {
+			streamPool.maxWorkers = 1
+		}
+		fmt.Printf("[Info] PCM streaming pool: %d streams, queue depth %d, stream time limit %s\n", streamPool.maxWorkers, streamPool.maxQueue, streamPool.jobTimeout)
+	})
+	return streamPool
+}
+
+// Helper function to read an integer environment variable with a default
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("[Warning] Invalid %s value %q, using %d\n", key, value, defaultValue)
+		return defaultValue
+	}
+	return number
+}
+
+// Helper function to count the queued jobs, the caller must hold the lock
+func (p *workerPool) queued() int {
+	total := 0
+	for _, queue := range p.queues {
+		total += len(queue)
+	}
+	return total
+}
+
+// Acquire waits for a free worker. It returns a context that is cancelled after the job
+// timeout (if timeout is true) and a release function that must be called when the job is done.
+func (p *workerPool) Acquire(ctx context.Context, timeout bool) (context.Context, func(), error) {
+	priority := priorityFromContext(ctx)
+
+	p.mu.Lock()
+	if p.running < p.maxWorkers && p.queued() == 0 {
+		p.running++
+		p.mu.Unlock()
+		return p.jobContext(ctx, timeout)
+	}
+	if p.queued() >= p.maxQueue {
+		p.mu.Unlock()
+		return nil, nil, ErrQueueFull
+	}
+	waiter := &poolWaiter{ready: make(chan struct{})}
+	p.queues[priority] = append(p.queues[priority], waiter)
+	p.mu.Unlock()
+
+	var raised <-chan struct{}
+	if priority != PriorityInteractive {
+		raised = fetchRaised(ctx)
+	}
+	for {
+		select {
+		case <-waiter.ready:
+			return p.jobContext(ctx, timeout)
+		case <-raised:
+			// A device joined the fetch, the job moves to the end of the interactive queue
+			raised = nil
+			p.mu.Lock()
+			if p.removeWaiter(priority, waiter) {
+				priority = PriorityInteractive
+				p.queues[priority] = append(p.queues[priority], waiter)
+			}
+			p.mu.Unlock()
+		case <-ctx.Done():
+			p.mu.Lock()
+			removed := p.removeWaiter(priority, waiter)
+			p.mu.Unlock()
+			if !removed {
+				// The worker was handed over while giving up, pass it on
+				p.release()
+			}
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// Helper function to take a waiter out of its queue, false if it was already handed a worker. The caller
+// must hold the lock.
+func (p *workerPool) removeWaiter(priority Priority, waiter *poolWaiter) bool {
+	for i, queued := range p.queues[priority] {
+		if queued == waiter {
+			p.queues[priority] = append(p.queues[priority][:i], p.queues[priority][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to build the context and release function of an acquired worker
+func (p *workerPool) jobContext(ctx context.Context, timeout bool) (context.Context, func(), error) {
+	cancel := func() {}
+	if timeout && p.jobTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.jobTimeout)
+	}
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			cancel()
+			p.release()
+		})
+	}, nil
+}
+
+// Helper function to hand the worker to the next queued job, interactive jobs first
+func (p *workerPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for priority := range p.queues {
+		if len(p.queues[priority]) > 0 {
+			waiter := p.queues[priority][0]
+			p.queues[priority] = p.queues[priority][1:]
+			close(waiter.ready)
+			return
+		}
+	}
+	p.running--
+}
+
+// Helper function to answer a request with 503 and Retry-After when the queue is full
+func writeQueueFull(w http.ResponseWriter) {
+	getTranscodePool().writeQueueFull(w)
+}
+
+// Helper function to answer a request with 503 and the Retry-After of this pool when its queue is full
+func (p *workerPool) writeQueueFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(p.retryAfter.Seconds())))
+	http.Error(w, ErrQueueFull.Error(), http.StatusServiceUnavailable)
+}
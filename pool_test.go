@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolPriority(t *testing.T) {
+	pool := &workerPool{maxWorkers: 1, maxQueue: 2}
+	_, release, err := pool.Acquire(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan Priority, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	acquire := func(priority Priority) {
+		defer wg.Done()
+		_, release, err := pool.Acquire(withPriority(context.Background(), priority), false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		order <- priority
+		release()
+	}
+	go acquire(PriorityBackground)
+	time.Sleep(20 * time.Millisecond)
+	go acquire(PriorityInteractive)
+	time.Sleep(20 * time.Millisecond)
+
+	// Both waiters fill the queue
+	if _, _, err := pool.Acquire(context.Background(), false); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("got %v, want ErrQueueFull", err)
+	}
+
+	release()
+	if first, second := <-order, <-order; first != PriorityInteractive || second != PriorityBackground {
+		t.Errorf("got order %v, %v, want the interactive job first", first, second)
+	}
+	wg.Wait()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.running != 0 {
+		t.Errorf("%d workers still running", pool.running)
+	}
+}
+
+func TestWorkerPoolRaisedWaiter(t *testing.T) {
+	pool := &workerPool{maxWorkers: 1, maxQueue: 2}
+	_, release, err := pool.Acquire(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	acquire := func(name string, ctx context.Context) {
+		defer wg.Done()
+		_, release, err := pool.Acquire(ctx, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		order <- name
+		release()
+	}
+	background := withPriority(context.Background(), PriorityBackground)
+	go acquire("first", background)
+	time.Sleep(20 * time.Millisecond)
+	prefetchCtx, fetch := withSharedFetch(background)
+	go acquire("prefetch", prefetchCtx)
+	time.Sleep(20 * time.Millisecond)
+
+	// A device joins the prefetch while it is queued
+	fetch.Raise()
+	time.Sleep(20 * time.Millisecond)
+	release()
+	if first, second := <-order, <-order; first != "prefetch" || second != "first" {
+		t.Errorf("got order %v, %v, want the raised job first", first, second)
+	}
+	wg.Wait()
+}
+
+func TestWorkerPoolCancelledWaiter(t *testing.T) {
+	pool := &workerPool{maxWorkers: 1, maxQueue: 1}
+	_, release, err := pool.Acquire(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := pool.Acquire(ctx, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context error", err)
+	}
+	release()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.running != 0 || pool.queued() != 0 {
+		t.Errorf("running %d queued %d after the release", pool.running, pool.queued())
+	}
+}
+
+func TestWorkerPoolJobTimeout(t *testing.T) {
+	pool := &workerPool{maxWorkers: 1, jobTimeout: 50 * time.Millisecond}
+	ctx, release, err := pool.Acquire(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job context was not cancelled after the job timeout")
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("got %v, want DeadlineExceeded", ctx.Err())
+	}
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// PrefetchOptions chooses the songs a prefetch run brings into the cache.
+type PrefetchOptions struct {
+	Files    []string `json:"-"`                  // Song lists or playlists on disk, only for the command line
+	Playlist string   `json:"playlist,omitempty"` // ID of a playlist stored on this server
+	Top      int      `json:"top,omitempty"`      // The songs requested most often through /stream_pcm
+	Songs    []string `json:"songs,omitempty"`    // "<artist> - <title>" or just the title
+}
+
+// PrefetchResult is the outcome for a single song of a prefetch run.
+type PrefetchResult struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist,omitempty"`
+	Target string `json:"target,omitempty"` // Library entry that holds the song
+	Reason string `json:"reason,omitempty"`
+}
+
+// PrefetchReport lists what a prefetch run did with every song of its list.
+type PrefetchReport struct {
+	Fetched []PrefetchResult `json:"fetched"`
+	Cached  []PrefetchResult `json:"cached"` // Already in sources.json, the local folder or the cache
+	Failed  []PrefetchResult `json:"failed"`
+}
+
+// SongRequestCount counts how often a song was asked for, to prefetch the most requested ones.
+type SongRequestCount struct {
+	Song          string    `json:"song"`
+	Singer        string    `json:"singer,omitempty"`
+	Count         int       `json:"count"`
+	LastRequested time.Time `json:"last_requested"`
+}
+
+// requestCountFlushInterval is how long request counts are collected in memory before they are written.
+const requestCountFlushInterval = time.Minute
+
+// requestCounter collects song requests and adds them to the library index in batches.
+type requestCounter struct {
+	mu        sync.Mutex
+	pending   map[string]*SongRequestCount
+	lastFlush time.Time
+}
+
+var songRequests = &requestCounter{pending: map[string]*SongRequestCount{}, lastFlush: time.Now()}
+
+// Helper function to count a request for a song, songs asked for in different spellings count as one
+func recordSongRequest(song, singer string) {
+	key := requestFlightKey(song, singer)
+	if strings.HasPrefix(key, "\x00") {
+		return
+	}
+	c := songRequests
+	c.mu.Lock()
+	count, ok := c.pending[key]
+	if !ok {
+		count = &SongRequestCount{}
+		c.pending[key] = count
+	}
+	count.Song, count.Singer = song, singer
+	count.Count++
+	count.LastRequested = time.Now()
+	flush := time.Since(c.lastFlush) >= requestCountFlushInterval
+	if flush {
+		c.lastFlush = time.Now()
+	}
+	c.mu.Unlock()
+	if flush {
+		go c.flush()
+	}
+}
+
+// Helper function to add the pending request counts to the library index
+func (c *requestCounter) flush() {
+	lib := getLibrary()
+	if lib == nil {
+		// Without an index the counts only live in memory
+		return
+	}
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = map[string]*SongRequestCount{}
+	c.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	err := lib.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(libraryRequestsBucket)
+		for key, count := range pending {
+			var stored SongRequestCount
+			if data := bucket.Get([]byte(key)); data != nil {
+				json.Unmarshal(data, &stored)
+			}
+			count.Count += stored.Count
+			data, err := json.Marshal(count)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("[Error] Failed to save song request counts:", err)
+	}
+}
+
+// Helper function to write the pending request counts on shutdown, before the library index is closed
+func flushSongRequests() {
+	songRequests.flush()
+}
+
+// Helper function to get the n songs requested most often, the most recent first among equal counts
+func topRequestedSongs(n int) []SongRequestCount {
+	c := songRequests
+	c.flush()
+	counts := map[string]SongRequestCount{}
+	if lib := getLibrary(); lib != nil {
+		err := lib.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(libraryRequestsBucket).ForEach(func(key, data []byte) error {
+				var count SongRequestCount
+				if json.Unmarshal(data, &count) == nil {
+					counts[string(key)] = count
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			fmt.Println("[Error] Failed to read song request counts:", err)
+		}
+	}
+	c.mu.Lock()
+	for key, count := range c.pending {
+		merged := *count
+		merged.Count += counts[key].Count
+		counts[key] = merged
+	}
+	c.mu.Unlock()
+
+	top := make([]SongRequestCount, 0, len(counts))
+	for _, count := range counts {
+		top = append(top, count)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].LastRequested.After(top[j].LastRequested)
+	})
+	if n >= 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// bandwidthLimiter spreads the downloads that share it so together they stay below a rate.
+type bandwidthLimiter struct {
+	mu   sync.Mutex
+	rate int64 // Bytes per second
+	next time.Time
+}
+
+type bandwidthKey struct{}
+
+// Helper function to attach a bandwidth limit to a context, downloads made with it are slowed down
+func withBandwidthLimit(ctx context.Context, limiter *bandwidthLimiter) context.Context {
+	if limiter == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, bandwidthKey{}, limiter)
+}
+
+// Helper function to get the bandwidth limit of a context, nil if downloads may go at full speed
+func bandwidthLimitFromContext(ctx context.Context) *bandwidthLimiter {
+	if isFetchRaised(ctx) {
+		return nil
+	}
+	limiter, _ := ctx.Value(bandwidthKey{}).(*bandwidthLimiter)
+	return limiter
+}
+
+// Helper function to get the size of the reads, small enough that no wait gets near the read timeout
+func (l *bandwidthLimiter) chunkSize() int {
+	return int(min(max(l.rate/4, 1024), 32*1024))
+}
+
+// Wait blocks until n more bytes fit into the rate.
+func (l *bandwidthLimiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads a body no faster than its bandwidth limit allows.
+type throttledReader struct {
+	reader  io.Reader
+	limiter *bandwidthLimiter
+	ctx     context.Context
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	// A device joined the fetch halfway through the download
+	if isFetchRaised(tr.ctx) {
+		return tr.reader.Read(p)
+	}
+	if chunk := tr.limiter.chunkSize(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := tr.reader.Read(p)
+	if n > 0 {
+		if waitErr := tr.limiter.Wait(tr.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+var (
+	prefetchLimiter     *bandwidthLimiter
+	prefetchLimiterOnce sync.Once
+)
+
+// Helper function to get the bandwidth limit configured by PREFETCH_MAX_KBPS, shared by all prefetch runs
+func getPrefetchLimiter() *bandwidthLimiter {
+	prefetchLimiterOnce.Do(func() {
+		kbps := getEnvInt("PREFETCH_MAX_KBPS", 0)
+		if kbps <= 0 {
+			return
+		}
+		prefetchLimiter = &bandwidthLimiter{rate: int64(kbps) * 1024}
+		fmt.Printf("[Info] Prefetch downloads are limited to %d KB/s\n", kbps)
+	})
+	return prefetchLimiter
+}
+
+// Helper function to read a list of songs, either a playlist file or one "<artist> - <title>" per line
+func parsePrefetchList(data []byte, fileName string) ([]PlaylistTrack, error) {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".m3u", ".m3u8", ".pls", ".xspf":
+		return parsePrefetchPlaylist(data)
+	}
+	if bytes.HasPrefix(trimmed, []byte("#EXTM3U")) || detectPlaylistFormat(data) != "m3u" {
+		return parsePrefetchPlaylist(data)
+	}
+
+	// Plain text lists are not parsed as M3U, which would cut song names with dots at the "extension"
+	var tracks []PlaylistTrack
+	text := strings.ToValidUTF8(string(trimmed), "�")
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		artist, title := splitDisplayName(line)
+		tracks = append(tracks, PlaylistTrack{Title: title, Artist: artist})
+	}
+	return tracks, nil
+}
+
+// Helper function to get the songs of a playlist file
+func parsePrefetchPlaylist(data []byte) ([]PlaylistTrack, error) {
+	parsed, err := parsePlaylist(data, "")
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Tracks, nil
+}
+
+// Helper function to gather the songs of every list chosen by the options, without duplicates
+func collectPrefetchSongs(options PrefetchOptions) ([]PlaylistTrack, error) {
+	var tracks []PlaylistTrack
+	for _, file := range options.Files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fileTracks, err := parsePrefetchList(data, file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		tracks = append(tracks, fileTracks...)
+	}
+	if options.Playlist != "" {
+		playlist, err := getPlaylistStore().Get(options.Playlist)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, playlist.Tracks...)
+	}
+	if options.Top > 0 {
+		for _, count := range topRequestedSongs(options.Top) {
+			tracks = append(tracks, PlaylistTrack{Title: count.Song, Artist: count.Singer})
+		}
+	}
+	for _, song := range options.Songs {
+		artist, title := splitDisplayName(song)
+		tracks = append(tracks, PlaylistTrack{Title: title, Artist: artist})
+	}
+	return uniquePrefetchSongs(tracks), nil
+}
+
+// Helper function to drop the songs without a title and those listed more than once
+func uniquePrefetchSongs(tracks []PlaylistTrack) []PlaylistTrack {
+	seen := map[string]bool{}
+	songs := make([]PlaylistTrack, 0, len(tracks))
+	for _, track := range tracks {
+		track.Title, track.Artist = strings.TrimSpace(track.Title), strings.TrimSpace(track.Artist)
+		key := requestFlightKey(track.Title, track.Artist) + "\x00" + track.Provider + "\x00" + track.ID
+		if track.Title == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		songs = append(songs, track)
+	}
+	return songs
+}
+
+// Helper function to bring a single song into the cache, returning whether it had to be fetched. Cancelling
+// the context stops the wait for a full queue, a fetch that has started is finished.
+func prefetchSong(ctx context.Context, track PlaylistTrack) (PrefetchResult, bool, error) {
+	// The fetch may be shared with a device, so it is not cancelled with the run
+	fetchCtx := withBandwidthLimit(withPriority(context.WithoutCancel(ctx), PriorityBackground), getPrefetchLimiter())
+	result := PrefetchResult{Title: track.Title, Artist: track.Artist}
+	if entry, ok := findBestLibraryEntry(track.Title, track.Artist); ok {
+		// Broken cache entries are repaired, or removed and fetched again below
+		if entry.Source != libraryCache {
+			result.Target = entry.Source + "/" + entry.Name
+			return result, false, nil
+		}
+		if _, ok := checkCacheEntry(fetchCtx, entry); ok {
+			result.Target = entry.Source + "/" + entry.Name
+			return result, false, nil
+		}
+	}
+
+	// Shares the fetch with a device asking for the same song at the same time, which lifts the background
+	// priority and the bandwidth limit
+	key := requestFlightKey(track.Title, track.Artist) + "\x00" + track.Provider + "\x00" + track.ID
+	for {
+		musicItem, err, _ := requestFlights.DoContext(fetchCtx, key, func(fetchCtx context.Context) (MusicItem, error) {
+			if track.Provider != "" && track.ID != "" {
+				return requestAndCacheProviderTrack(fetchCtx, track.Provider, track.ID, track.Title, track.Artist, nil)
+			}
+			return requestAndCacheMusic(fetchCtx, track.Title, track.Artist, nil)
+		}, nil)
+		if errors.Is(err, ErrQueueFull) {
+			// Devices are waiting on the queue, the prefetch waits its turn instead of failing
+			select {
+			case <-time.After(getTranscodePool().retryAfter):
+				continue
+			case <-ctx.Done():
+				return result, true, ctx.Err()
+			}
+		}
+		if err != nil {
+			return result, true, err
+		}
+		if musicItem.Title == "" {
+			return result, true, errors.New("no provider returned the song")
+		}
+		result.Target = libraryCache + "/" + safeFileName(musicItem.Artist+"-"+musicItem.Title) + ".json"
+		return result, true, nil
+	}
+}
+
+// Helper function to fetch a list of songs one after another in the background priority, reporting every
+// song as it is done. Cancelling the context stops the run after the current song.
+func prefetchSongs(ctx context.Context, tracks []PlaylistTrack, onResult func(status string, result PrefetchResult)) error {
+	for i, track := range tracks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fmt.Printf("[Info] Prefetching %d/%d: %s\n", i+1, len(tracks), prefetchSongName(track.Title, track.Artist))
+		result, fetched, err := prefetchSong(ctx, track)
+		if err != nil && ctx.Err() != nil {
+			// Stopped while waiting for the queue, the song is neither fetched nor failed
+			return ctx.Err()
+		}
+		switch {
+		case err != nil:
+			result.Reason = err.Error()
+			onResult("failed", result)
+		case fetched:
+			onResult("fetched", result)
+		default:
+			result.Reason = "already available"
+			onResult("cached", result)
+		}
+	}
+	return nil
+}
+
+// Helper function to name a song in the logs like "<artist> - <title>"
+func prefetchSongName(title, artist string) string {
+	if artist == "" {
+		return title
+	}
+	return artist + " - " + title
+}
+
+// Helper function to add the outcome of a song to a report
+func (report *PrefetchReport) add(status string, result PrefetchResult) {
+	switch status {
+	case "fetched":
+		report.Fetched = append(report.Fetched, result)
+	case "cached":
+		report.Cached = append(report.Cached, result)
+	default:
+		report.Failed = append(report.Failed, result)
+	}
+}
+
+// Helper function to print a prefetch report
+func printPrefetchReport(report PrefetchReport) {
+	for _, result := range report.Failed {
+		fmt.Printf("[Warning] Failed to prefetch %s: %s\n", prefetchSongName(result.Title, result.Artist), result.Reason)
+	}
+	fmt.Printf("[Info] Prefetch finished: %d fetched, %d already cached, %d failed\n", len(report.Fetched), len(report.Cached), len(report.Failed))
+}
+
+// Helper function to run the prefetch subcommand, returning the process exit code
+func runPrefetchCommand(args []string) int {
+	flags := flag.NewFlagSet("prefetch", flag.ContinueOnError)
+	playlist := flags.String("playlist", "", "ID of a playlist stored on this server")
+	top := flags.Int("top", 0, "also prefetch the N songs requested most often")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s prefetch [-playlist id] [-top N] [list.txt | playlist.m3u ...]\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	options := PrefetchOptions{Files: flags.Args(), Playlist: *playlist, Top: *top}
+	if len(options.Files) == 0 && options.Playlist == "" && options.Top <= 0 {
+		flags.Usage()
+		return 2
+	}
+	defer closeLibrary()
+
+	tracks, err := collectPrefetchSongs(options)
+	if err != nil {
+		fmt.Println("[Error] Failed to read the prefetch list:", err)
+		return 1
+	}
+	report := PrefetchReport{Fetched: []PrefetchResult{}, Cached: []PrefetchResult{}, Failed: []PrefetchResult{}}
+	prefetchSongs(context.Background(), tracks, report.add)
+	printPrefetchReport(report)
+	if len(report.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// prefetchRun is a prefetch started through the admin endpoint.
+type prefetchRun struct {
+	ID         string          `json:"id"`
+	Options    PrefetchOptions `json:"options"`
+	State      string          `json:"state"` // running, done or cancelled
+	Total      int             `json:"total"`
+	Done       int             `json:"done"`
+	Report     PrefetchReport  `json:"report"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	cancel     context.CancelFunc
+}
+
+var (
+	prefetchRunsMu sync.Mutex
+	prefetchRuns   = map[string]*prefetchRun{}
+)
+
+// Helper function to start a prefetch run in the background
+func startPrefetchRun(options PrefetchOptions, tracks []PlaylistTrack) *prefetchRun {
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &prefetchRun{
+		ID:        newJobID(),
+		Options:   options,
+		State:     "running",
+		Total:     len(tracks),
+		Report:    PrefetchReport{Fetched: []PrefetchResult{}, Cached: []PrefetchResult{}, Failed: []PrefetchResult{}},
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+	prefetchRunsMu.Lock()
+	prefetchRuns[run.ID] = run
+	prefetchRunsMu.Unlock()
+	fmt.Printf("[Info] Started prefetch %s of %d songs\n", run.ID, len(tracks))
+
+	go func() {
+		defer cancel()
+		err := prefetchSongs(ctx, tracks, func(status string, result PrefetchResult) {
+			prefetchRunsMu.Lock()
+			defer prefetchRunsMu.Unlock()
+			run.Report.add(status, result)
+			run.Done++
+		})
+		finished := time.Now()
+		prefetchRunsMu.Lock()
+		defer prefetchRunsMu.Unlock()
+		printPrefetchReport(run.Report)
+		run.FinishedAt = &finished
+		run.State = "done"
+		if err != nil {
+			run.State = "cancelled"
+		}
+	}()
+	return run
+}
+
+// Helper function to write a prefetch run as JSON
+func writePrefetchRun(w http.ResponseWriter, status int, run *prefetchRun) {
+	prefetchRunsMu.Lock()
+	snapshot := *run
+	snapshot.Report = PrefetchReport{
+		Fetched: append([]PrefetchResult{}, run.Report.Fetched...),
+		Cached:  append([]PrefetchResult{}, run.Report.Cached...),
+		Failed:  append([]PrefetchResult{}, run.Report.Failed...),
+	}
+	prefetchRunsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// prefetchHandler handles the admin prefetch endpoints:
+//
+//	GET    /api/admin/prefetch?top=20  the songs requested most often
+//	POST   /api/admin/prefetch         start a run from PrefetchOptions JSON, or from an uploaded list or playlist
+//	GET    /api/admin/prefetch/{id}    progress and report of a run
+//	DELETE /api/admin/prefetch/{id}    stop a run after the current song
+func prefetchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "MeowMusicEmbeddedServer")
+	fmt.Printf("[Web Access] Handling request for %s %s\n", r.Method, r.URL.Path)
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/prefetch"), "/")
+	if id != "" {
+		prefetchRunsMu.Lock()
+		run, ok := prefetchRuns[id]
+		prefetchRunsMu.Unlock()
+		if !ok {
+			http.Error(w, "prefetch not found", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writePrefetchRun(w, http.StatusOK, run)
+		case http.MethodDelete:
+			run.cancel()
+			writePrefetchRun(w, http.StatusOK, run)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		n, err := strconv.Atoi(r.URL.Query().Get("top"))
+		if err != nil || n <= 0 {
+			n = 20
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{"top": topRequestedSongs(n)})
+
+	case http.MethodPost:
+		var options PrefetchOptions
+		var tracks []PlaylistTrack
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxPlaylistBody+1))
+		if err != nil {
+			http.Error(w, "failed to read request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(data) > maxPlaylistBody {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if mediaType == "application/json" {
+			err = json.Unmarshal(data, &options)
+			if err == nil {
+				tracks, err = collectPrefetchSongs(options)
+			}
+		} else {
+			// The body is a song list or playlist file, named by ?name= to tell the format
+			tracks, err = parsePrefetchList(data, r.URL.Query().Get("name"))
+			tracks = uniquePrefetchSongs(tracks)
+		}
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrPlaylistNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if len(tracks) == 0 {
+			http.Error(w, "no songs to prefetch", http.StatusBadRequest)
+			return
+		}
+		run := startPrefetchRun(options, tracks)
+		w.Header().Set("Location", "/api/admin/prefetch/"+run.ID)
+		writePrefetchRun(w, http.StatusAccepted, run)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
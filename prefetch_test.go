@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrefetchHandlerIgnoresFiles(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	var options PrefetchOptions
+	if err := json.Unmarshal([]byte(`{"files": ["/etc/passwd"]}`), &options); err != nil {
+		t.Fatal(err)
+	}
+	if len(options.Files) != 0 {
+		t.Fatalf("files were decoded from JSON: %v", options.Files)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/prefetch", strings.NewReader(`{"files": ["/etc/passwd"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Admin-Token", "secret")
+	rec := httptest.NewRecorder()
+	prefetchHandler(rec, req)
+	if rec.Code != http.StatusBadRequest || strings.Contains(rec.Body.String(), "root") {
+		t.Errorf("got %d %q, want 400 without file contents", rec.Code, rec.Body.String())
+	}
+}
+
+func TestParsePrefetchList(t *testing.T) {
+	tracks, err := parsePrefetchList([]byte("\xef\xbb\xbfAlice - Song One\n# comment\n\nMr. Brightside\n"), "list.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PlaylistTrack{{Title: "Song One", Artist: "Alice"}, {Title: "Mr. Brightside"}}
+	if len(tracks) != len(want) {
+		t.Fatalf("got %d tracks, want %d: %+v", len(tracks), len(want), tracks)
+	}
+	for i := range want {
+		if tracks[i].Title != want[i].Title || tracks[i].Artist != want[i].Artist {
+			t.Errorf("track %d = %+v, want %+v", i, tracks[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TranscodeProfile describes the compressed and segmented outputs produced for a device class.
+type TranscodeProfile struct {
+	Name              string `json:"-"`
+	Codec             string `json:"codec"`               // ffmpeg audio encoder, e.g. libmp3lame or libopus
+	Extension         string `json:"extension"`           // Output file extension without the dot, e.g. mp3 or opus
+	Bitrate           string `json:"bitrate"`             // e.g. 32k
+	SampleRate        int    `json:"sample_rate"`         // e.g. 24000
+	Channels          int    `json:"channels"`            // 1 for mono, 2 for stereo
+	SegmentTime       int    `json:"segment_time"`        // HLS segment length in seconds
+	SegmentSampleRate int    `json:"segment_sample_rate"` // Sample rate of the segments, defaults to SampleRate
+}
+
+// defaultProfileName is the profile whose outputs live directly in the track directory.
+const defaultProfileName = "default"
+
+// builtinDefaultProfile matches the music.mp3 and chunk/ outputs every cached track already has.
+var builtinDefaultProfile = TranscodeProfile{
+	Name:              defaultProfileName,
+	Codec:             "libmp3lame",
+	Extension:         "mp3",
+	Bitrate:           "32k",
+	SampleRate:        24000,
+	Channels:          1,
+	SegmentTime:       10,
+	SegmentSampleRate: 16000,
+}
+
+var (
+	profilesMu     sync.RWMutex
+	profiles       map[string]TranscodeProfile
+	deviceProfiles map[string]string
+	profilesOnce   sync.Once
+)
+
+// Helper function to load profiles.json and devices.json
+func loadProfiles() {
+	loaded := map[string]TranscodeProfile{defaultProfileName: builtinDefaultProfile}
+
+	profilesFile := os.Getenv("PROFILES_FILE")
+	if profilesFile == "" {
+		profilesFile = "./profiles.json"
+	}
+	data, err := os.ReadFile(profilesFile)
+	if err == nil {
+		var configs map[string]TranscodeProfile
+		err = json.Unmarshal(data, &configs)
+		if err != nil {
+			fmt.Println("[Error] Failed to parse profiles file:", err)
+		}
+		for name, profile := range configs {
+			profile.Name = name
+			err = validateProfile(&profile)
+			if err != nil {
+				fmt.Printf("[Error] Invalid profile %s: %v\n", name, err)
+				continue
+			}
+			loaded[name] = profile
+		}
+	} else if !os.IsNotExist(err) {
+		fmt.Println("[Error] Failed to read profiles file:", err)
+	}
+
+	// Devices are registered by device ID or client IP address
+	devices := map[string]string{}
+	devicesFile := os.Getenv("DEVICES_FILE")
+	if devicesFile == "" {
+		devicesFile = "./devices.json"
+	}
+	data, err = os.ReadFile(devicesFile)
+	if err == nil {
+		err = json.Unmarshal(data, &devices)
+		if err != nil {
+			fmt.Println("[Error] Failed to parse devices file:", err)
+		}
+	} else if !os.IsNotExist(err) {
+		fmt.Println("[Error] Failed to read devices file:", err)
+	}
+
+	profilesMu.Lock()
+	profiles = loaded
+	deviceProfiles = devices
+	profilesMu.Unlock()
+	fmt.Printf("[Info] Loaded %d transcoding profiles and %d device registrations\n", len(loaded), len(devices))
+}
+
+// Helper function to check a profile and fill in its defaults
+func validateProfile(profile *TranscodeProfile) error {
+	if profile.Codec == "" {
+		return fmt.Errorf("codec is empty")
+	}
+	if profile.Extension == "" {
+		return fmt.Errorf("extension is empty")
+	}
+	profile.Extension = strings.TrimPrefix(profile.Extension, ".")
+	if strings.ContainsAny(profile.Name, `/\.`) {
+		return fmt.Errorf("profile name must not contain path separators or dots")
+	}
+	// Cache files, the local library, bundles and the integrity check all link the default output as music.mp3
+	if profile.Name == defaultProfileName && profile.Extension != builtinDefaultProfile.Extension {
+		return fmt.Errorf("the default profile must produce %s files", builtinDefaultProfile.Extension)
+	}
+	if profile.Channels <= 0 {
+		profile.Channels = 1
+	}
+	if profile.SampleRate <= 0 {
+		return fmt.Errorf("sample_rate must be positive")
+	}
+	if profile.SegmentTime <= 0 {
+		profile.SegmentTime = 10
+	}
+	if profile.SegmentSampleRate <= 0 {
+		profile.SegmentSampleRate = profile.SampleRate
+	}
+	return nil
+}
+
+// Helper function to get a profile by name
+func getProfile(name string) (TranscodeProfile, bool) {
+	profilesOnce.Do(loadProfiles)
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	profile, ok := profiles[name]
+	return profile, ok
+}
+
+// Helper function to get the profile used for the outputs in the track directory itself
+func getDefaultProfile() TranscodeProfile {
+	profile, _ := getProfile(defaultProfileName)
+	return profile
+}
+
+// Helper function to select the profile of a request from the profile parameter or the registered device
+func selectProfile(r *http.Request) (TranscodeProfile, error) {
+	name := r.URL.Query().Get("profile")
+	if name == "" {
+		profilesOnce.Do(loadProfiles)
+		deviceID := r.URL.Query().Get("device")
+		if deviceID == "" {
+			deviceID = r.Header.Get("X-Device-ID")
+		}
+		ip, _ := IPhandler(r)
+		profilesMu.RLock()
+		if deviceID != "" {
+			name = deviceProfiles[deviceID]
+		}
+		if name == "" && ip != "" {
+			name = deviceProfiles[ip]
+		}
+		profilesMu.RUnlock()
+	}
+	if name == "" {
+		name = defaultProfileName
+	}
+	profile, ok := getProfile(name)
+	if !ok {
+		return TranscodeProfile{}, fmt.Errorf("unknown profile: %s", name)
+	}
+	return profile, nil
+}
+
+// Helper function to get the directory holding the outputs of a profile for an input file. Every input
+// gets its own directory, a folder may hold several tracks.
+func getProfileDir(inputFile string, profile TranscodeProfile) string {
+	trackDir := filepath.Dir(inputFile)
+	if profile.Name == defaultProfileName {
+		return trackDir
+	}
+	return filepath.Join(trackDir, "profiles", profile.Name, safeFileName(filepath.Base(inputFile)))
+}
+
+// Helper function to get the URL path of a profile output relative to the folder of the input file
+func getProfileRelativePath(inputFile string, profile TranscodeProfile, fileName string) string {
+	if profile.Name == defaultProfileName {
+		return fileName
+	}
+	return "profiles/" + url.PathEscape(profile.Name) + "/" + url.PathEscape(safeFileName(filepath.Base(inputFile))) + "/" + fileName
+}
+
+// Helper function to compress an audio file and split it into segments with a profile
+func transcodeWithProfile(ctx context.Context, inputFile, outputDir string, profile TranscodeProfile, progress ProgressFunc) error {
+	fmt.Printf("[Info] Transcoding %s with profile %s\n", inputFile, profile.Name)
+	// Hold a single worker for the whole job so it cannot be starved between passes
+	ctx, release, err := getTranscodePool().Acquire(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The duration is only needed to turn ffmpeg progress into a percentage
+	var duration float64
+	if progress != nil {
+		duration, _ = probeMusicDuration(ctx, inputFile)
+	}
+
+	// Compress music files
+	reportProgress(progress, JobTranscoding, 0)
+	outputFile := filepath.Join(outputDir, "music."+profile.Extension)
+	args := []string{"-i", inputFile, "-vn", "-c:a", profile.Codec, "-ac", strconv.Itoa(profile.Channels), "-ar", strconv.Itoa(profile.SampleRate)}
+	if profile.Bitrate != "" {
+		args = append(args, "-b:a", profile.Bitrate)
+	}
+	err = runFFmpegWithProgress(ctx, append(args, outputFile), duration, func(percent float64) {
+		reportProgress(progress, JobTranscoding, percent)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Split music files
+	chunkDir := filepath.Join(outputDir, "chunk")
+	err = os.MkdirAll(chunkDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Using ffmpeg for segmentation
+	reportProgress(progress, JobSegmenting, 0)
+	segmentedFilePattern := filepath.Join(chunkDir, "%03d."+profile.Extension) // e.g. 001.mp3, 002.mp3, ...
+	args = []string{"-i", outputFile, "-vn", "-c:a", profile.Codec, "-ac", strconv.Itoa(profile.Channels), "-ar", strconv.Itoa(profile.SegmentSampleRate)}
+	if profile.Bitrate != "" {
+		args = append(args, "-b:a", profile.Bitrate)
+	}
+	args = append(args, "-f", "segment", "-segment_time", strconv.Itoa(profile.SegmentTime), segmentedFilePattern)
+	return runFFmpegWithProgress(ctx, args, duration, func(percent float64) {
+		reportProgress(progress, JobSegmenting, percent)
+	})
+}
+
+// Helper function to produce the outputs of a non-default profile for an input file if they are missing
+func ensureProfileOutputs(ctx context.Context, inputFile string, profile TranscodeProfile) error {
+	profileDir := getProfileDir(inputFile, profile)
+	if _, err := os.Stat(filepath.Join(profileDir, "music.m3u8")); err == nil {
+		return nil
+	}
+
+	// Concurrent requests for the same profile wait for a single transcode
+	_, err, _ := trackFlights.Do(profileDir, func() (MusicItem, error) {
+		stagingDir, err := createStagingDir(profileDir)
+		if err != nil {
+			return MusicItem{}, err
+		}
+		defer os.RemoveAll(stagingDir)
+
+		err = transcodeWithProfile(ctx, inputFile, stagingDir, profile, nil)
+		if err != nil {
+			return MusicItem{}, err
+		}
+		err = createM3U8Playlist(ctx, stagingDir)
+		if err != nil {
+			return MusicItem{}, err
+		}
+		return MusicItem{}, publishStagingDir(stagingDir, profileDir)
+	})
+	return err
+}
+
+// Helper function to point the audio and playlist URLs of a music item at the outputs of a profile
+func applyProfile(r *http.Request, musicItem MusicItem, profile TranscodeProfile) (MusicItem, error) {
+	if profile.Name == defaultProfileName {
+		return musicItem, nil
+	}
+
+	// Transcode from the original quality file when there is one
+	inputURL := musicItem.AudioFullURL
+	inputFile, ok := getLocalPathFromURL(r, inputURL)
+	if !ok {
+		inputURL = musicItem.AudioURL
+		inputFile, ok = getLocalPathFromURL(r, inputURL)
+	}
+	if !ok {
+		fmt.Printf("[Warning] Profile %s is only available for local files, serving %s unchanged\n", profile.Name, musicItem.Title)
+		return musicItem, nil
+	}
+
+	baseURL := inputURL[:strings.LastIndex(inputURL, "/")]
+	err := ensureProfileOutputs(context.WithoutCancel(r.Context()), inputFile, profile)
+	if err != nil {
+		return musicItem, err
+	}
+
+	musicItem.AudioURL = baseURL + "/" + getProfileRelativePath(inputFile, profile, "music."+profile.Extension)
+	musicItem.M3U8URL = baseURL + "/" + getProfileRelativePath(inputFile, profile, "music.m3u8")
+	return musicItem, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetProfileDir(t *testing.T) {
+	lofi := TranscodeProfile{Name: "lofi"}
+	album := filepath.Join("files", "music", "Album")
+	first := getProfileDir(filepath.Join(album, "01 Intro.flac"), lofi)
+	second := getProfileDir(filepath.Join(album, "02 Song.flac"), lofi)
+	if first == second {
+		t.Fatalf("tracks of one folder share the profile directory %s", first)
+	}
+	if got, want := first, filepath.Join(album, "profiles", "lofi", "01 Intro.flac"); got != want {
+		t.Errorf("getProfileDir = %s, want %s", got, want)
+	}
+	if got := getProfileRelativePath(filepath.Join(album, "01 Intro.flac"), lofi, "music.mp3"); got != "profiles/lofi/01%20Intro.flac/music.mp3" {
+		t.Errorf("getProfileRelativePath = %s", got)
+	}
+	if got := getProfileDir(filepath.Join(album, "music_full.flac"), TranscodeProfile{Name: defaultProfileName}); got != album {
+		t.Errorf("default profile directory = %s, want %s", got, album)
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	tests := []struct {
+		profile TranscodeProfile
+		valid   bool
+	}{
+		{TranscodeProfile{Name: "opus", Codec: "libopus", Extension: ".opus", SampleRate: 48000}, true},
+		{TranscodeProfile{Name: defaultProfileName, Codec: "libmp3lame", Extension: "mp3", Bitrate: "64k", SampleRate: 44100}, true},
+		{TranscodeProfile{Name: defaultProfileName, Codec: "libopus", Extension: "opus", SampleRate: 48000}, false},
+		{TranscodeProfile{Name: "lofi", Extension: "mp3", SampleRate: 8000}, false},
+		{TranscodeProfile{Name: "lofi", Codec: "libmp3lame", SampleRate: 8000}, false},
+		{TranscodeProfile{Name: "lofi", Codec: "libmp3lame", Extension: "mp3"}, false},
+		{TranscodeProfile{Name: "../lofi", Codec: "libmp3lame", Extension: "mp3", SampleRate: 8000}, false},
+	}
+	for _, test := range tests {
+		profile := test.profile
+		err := validateProfile(&profile)
+		if (err == nil) != test.valid {
+			t.Errorf("validateProfile(%+v) = %v, want valid %v", test.profile, err, test.valid)
+		}
+		if err == nil && (strings.HasPrefix(profile.Extension, ".") || profile.Channels != 1 || profile.SegmentTime != 10 || profile.SegmentSampleRate != profile.SampleRate) {
+			t.Errorf("defaults not filled in: %+v", profile)
+		}
+	}
+}
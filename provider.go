@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Track represents a song as reported by an upstream provider.
+type Track struct {
+	Provider string `json:"provider"`
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	MusicURL string `json:"music_url"`
+	CoverURL string `json:"cover_url"`
+	Lyric    string `json:"lyric"` // Either the lyric text or a link to it
+	Duration int    `json:"duration"`
+}
+
+// Provider is an upstream music catalogue.
+type Provider interface {
+	// Name returns the name used in API_SOURCES and providers.json.
+	Name() string
+	// Search returns at most limit tracks matching the song and singer.
+	Search(ctx context.Context, song, singer string, limit int) ([]Track, error)
+	// ResolveTrack fills in the playable music URL of a search result.
+	ResolveTrack(ctx context.Context, track Track) (Track, error)
+	// FetchLyric returns the lyric text or a link to the lyric file.
+	FetchLyric(ctx context.Context, track Track) (string, error)
+	// FetchCover returns the link to the cover image.
+	FetchCover(ctx context.Context, track Track) (string, error)
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]Provider{}
+	// providersOnce loads the built-in and configured providers on first use
+	providersOnce sync.Once
+)
+
+// providerHTTPClient is shared by the built-in providers.
+var providerHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Helper function to register a provider, replacing any provider with the same name
+func registerProvider(provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[provider.Name()] = provider
+}
+
+// Helper function to get a registered provider by name
+func getProvider(name string) (Provider, bool) {
+	providersOnce.Do(loadProviders)
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// Helper function to list the names of all registered providers
+func listProviders() []string {
+	providersOnce.Do(loadProviders)
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Helper function to get the provider names configured by API_SOURCES, API_SOURCES_1, API_SOURCES_2, etc.
+func getConfiguredProviders() []string {
+	var names []string
+	for i := 0; ; i++ {
+		var key string
+		if i == 0 {
+			key = "API_SOURCES"
+		} else {
+			key = "API_SOURCES_" + strconv.Itoa(i)
+		}
+		source := os.Getenv(key)
+		if source == "" {
+			break
+		}
+		names = append(names, strings.TrimSpace(source))
+	}
+	return names
+}
+
+// Helper function to register the built-in providers and those defined in providers.json
+func loadProviders() {
+	registerYuafengProviders()
+
+	providersFile := os.Getenv("PROVIDERS_FILE")
+	if providersFile == "" {
+		providersFile = "./providers.json"
+	}
+	data, err := os.ReadFile(providersFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("[Error] Failed to read providers file:", err)
+		}
+		return
+	}
+	fmt.Printf("[Info] Reading providers from %s\n", providersFile)
+
+	var configs []HTTPJSONProviderConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		fmt.Println("[Error] Failed to parse providers file:", err)
+		return
+	}
+	for _, config := range configs {
+		provider, err := NewHTTPJSONProvider(config, providerHTTPClient)
+		if err != nil {
+			fmt.Println("[Error] Invalid provider configuration:", err)
+			continue
+		}
+		registerProvider(provider)
+		fmt.Printf("[Info] Registered provider %s\n", provider.Name())
+	}
+}
+
+// Helper function to download a provider track and cache its music, cover and lyric files
+func cacheProviderTrack(ctx context.Context, provider Provider, track Track, progress ProgressFunc) (MusicItem, error) {
+	fmt.Printf("[Info] Caching %s by %s from provider %s\n", track.Title, track.Artist, provider.Name())
+	if track.MusicURL == "" {
+		resolved, err := provider.ResolveTrack(ctx, track)
+		if err != nil {
+			return MusicItem{}, err
+		}
+		track = resolved
+	}
+	if track.MusicURL == "" {
+		return MusicItem{}, fmt.Errorf("music URL is empty")
+	}
+
+	// Upstream names may contain slashes, so they are made safe before becoming a directory name
+	finalDir, err := filesRoot.Join("cache/music/" + safeFileName(track.Artist+"-"+track.Title))
+	if err != nil {
+		return MusicItem{}, err
+	}
+
+	// Concurrent fetches of the same track wait for a single download and transcode
+	musicItem, err, _ := trackFlights.DoContext(ctx, finalDir, func(ctx context.Context) (MusicItem, error) {
+		return buildProviderTrack(ctx, provider, track, finalDir, progress)
+	}, nil)
+	return musicItem, err
+}
+
+// Helper function to produce the files of a provider track in a staging directory and publish them
+func buildProviderTrack(ctx context.Context, provider Provider, track Track, finalDir string, progress ProgressFunc) (MusicItem, error) {
+	// Create a staging directory so half-written files are never served
+	dirName, err := createStagingDir(finalDir)
+	if err != nil {
+		return MusicItem{}, fmt.Errorf("error creating directory: %w", err)
+	}
+	defer os.RemoveAll(dirName)
+
+	// Identify music file format
+	musicExt, err := getMusicFileExtension(ctx, track.MusicURL)
+	if err != nil {
+		return MusicItem{}, fmt.Errorf("error identifying music file format: %w", err)
+	}
+
+	// Download music files
+	musicFilePath := filepath.Join(dirName, "music_full"+musicExt)
+	reportProgress(progress, JobDownloading, 0)
+	err = downloadFileWithProgress(ctx, musicFilePath, track.MusicURL, func(percent float64) {
+		reportProgress(progress, JobDownloading, percent)
+	})
+	if err == nil {
+		err = checkFileNotEmpty(musicFilePath)
+	}
+	if err != nil {
+		// Nothing is published without the music itself
+		return MusicItem{}, fmt.Errorf("error downloading music file: %w", err)
+	}
+
+	// Retrieve music file duration
+	duration := getMusicDurationContext(ctx, musicFilePath)
+	if duration == 0 {
+		duration = track.Duration
+	}
+
+	// Download cover image
+	coverURL := track.CoverURL
+	if coverURL == "" {
+		coverURL, err = provider.FetchCover(ctx, track)
+		if err != nil {
+			fmt.Println("[Warning] Error fetching cover image:", err)
+		}
+	}
+	ext := filepath.Ext(coverURL)
+	if coverURL != "" {
+		err = downloadFile(ctx, filepath.Join(dirName, "cover"+ext), coverURL)
+		if err != nil {
+			fmt.Println("[Error] Error downloading cover image:", err)
+		}
+	}
+
+	// Fetch and write lyrics
+	lyricData := track.Lyric
+	if lyricData == "" {
+		lyricData, err = provider.FetchLyric(ctx, track)
+		if err != nil {
+			fmt.Println("[Warning] Error fetching lyric:", err)
+		}
+	}
+	err = writeLyricFile(ctx, filepath.Join(dirName, "lyric.lrc"), lyricData)
+	if err != nil {
+		fmt.Println("[Error] Error writing lyric file:", err)
+	}
+
+	// Compress and segment audio file
+	err = compressAndSegmentAudio(ctx, musicFilePath, dirName, progress)
+	if errors.Is(err, ErrQueueFull) {
+		return MusicItem{}, err
+	}
+	if err != nil {
+		fmt.Println("[Error] Error compressing and segmenting audio:", err)
+	}
+
+	// Create m3u8 playlist
+	err = createM3U8Playlist(ctx, dirName)
+	if err != nil {
+		fmt.Println("[Error] Error creating m3u8 playlist:", err)
+	}
+
+	// A failed cover or lyric download must not leave an empty file behind
+	for _, name := range []string{"cover" + ext, "lyric.lrc"} {
+		if filePath := filepath.Join(dirName, name); checkFileNotEmpty(filePath) != nil {
+			os.Remove(filePath)
+		}
+	}
+
+	// Move the completed files into place
+	err = publishStagingDir(dirName, finalDir)
+	if err != nil {
+		return MusicItem{}, fmt.Errorf("error publishing cache directory: %w", err)
+	}
+
+	baseURL := "/files/cache/music/" + url.QueryEscape(filepath.Base(finalDir))
+	musicItem := MusicItem{
+		Title:        track.Title,
+		Artist:       track.Artist,
+		Album:        track.Album,
+		CoverURL:     baseURL + "/cover" + ext,
+		LyricURL:     baseURL + "/lyric.lrc",
+		AudioFullURL: baseURL + "/music_full" + musicExt,
+		AudioURL:     baseURL + "/music.mp3",
+		M3U8URL:      baseURL + "/music.m3u8",
+		Duration:     duration,
+	}
+	// Only link the extras that were actually produced
+	if checkFileNotEmpty(filepath.Join(finalDir, "cover"+ext)) != nil {
+		musicItem.CoverURL = ""
+	}
+	if checkFileNotEmpty(filepath.Join(finalDir, "lyric.lrc")) != nil {
+		musicItem.LyricURL = ""
+	}
+	return musicItem, nil
+}
+
+// Helper function to check that a file exists and holds data
+func checkFileNotEmpty(filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", filepath.Base(filePath))
+	}
+	return nil
+}
+
+// Helper function to write lyrics, either downloading a lyric link or converting inline lyric text to LRC
+func writeLyricFile(ctx context.Context, lyricFilePath, lyricData string) error {
+	if lyricData == "" || lyricData == "获取歌词失败" {
+		// If there are no lyrics, do nothing
+		fmt.Println("[Warning] Lyric retrieval failed, skipping lyric file creation and download.")
+		return nil
+	}
+	if strings.HasPrefix(lyricData, "http://") || strings.HasPrefix(lyricData, "https://") {
+		// If it is in link format, download the lyrics file
+		return downloadFile(ctx, lyricFilePath, lyricData)
+	}
+
+	// If it is not in link format, write the lyrics to the file line by line
+	file, err := createAtomicFile(lyricFilePath, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	timeTagRegex := regexp.MustCompile(`^\[(\d+(?:\.\d+)?)\]`)
+	for _, line := range strings.Split(lyricData, "\n") {
+		// Check if the line starts with a time tag
+		match := timeTagRegex.FindStringSubmatch(line)
+		if match != nil {
+			// Convert the time tag to [mm:ss.ms] format
+			timeInSeconds, _ := strconv.ParseFloat(match[1], 64)
+			minutes := int(timeInSeconds / 60)
+			seconds := int(timeInSeconds) % 60
+			milliseconds := int((timeInSeconds-float64(seconds))*1000) / 100 % 100
+			formattedTimeTag := fmt.Sprintf("[%02d:%02d.%02d]", minutes, seconds, milliseconds)
+			line = timeTagRegex.ReplaceAllString(line, formattedTimeTag)
+		}
+		_, err := file.WriteString(line + "\r\n")
+		if err != nil {
+			return err
+		}
+	}
+	return file.Commit()
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// proxyConfig holds the /url/ proxy settings read from PROXY_CONNECT_TIMEOUT, PROXY_READ_TIMEOUT,
+// PROXY_MAX_REDIRECTS, PROXY_CACHE_DIR and PROXY_CACHE_MAX_SIZE_MB.
+type proxyConfig struct {
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	maxRedirects   int
+	cacheDir       string // Empty disables the disk cache
+	cacheMaxSize   int64  // Bytes, 0 disables the size cap
+}
+
+var (
+	proxyConf       proxyConfig
+	proxyClient     *http.Client
+	proxyClientOnce sync.Once
+	// proxyTrimMu makes sure only one pass trims the disk cache at a time
+	proxyTrimMu sync.Mutex
+	// proxyCacheAccess holds when disk cache files were last served since startup, older files count
+	// from their download. Touching the files instead would change their ETag.
+	proxyCacheAccess   = map[string]time.Time{}
+	proxyCacheAccessMu sync.Mutex
+)
+
+// proxyRelayedHeaders are the upstream response headers passed on to the device.
+var proxyRelayedHeaders = []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"}
+
+// Helper function to get the HTTP client used by the /url/ proxy and for downloads, which enforces the URL policy
+func getRemoteHTTPClient() (*http.Client, proxyConfig) {
+	proxyClientOnce.Do(func() {
+		proxyConf = proxyConfig{
+			connectTimeout: time.Duration(getEnvInt("PROXY_CONNECT_TIMEOUT", 10)) * time.Second,
+			readTimeout:    time.Duration(getEnvInt("PROXY_READ_TIMEOUT", 30)) * time.Second,
+			maxRedirects:   getEnvInt("PROXY_MAX_REDIRECTS", 5),
+			cacheDir:       os.Getenv("PROXY_CACHE_DIR"),
+			cacheMaxSize:   int64(getEnvInt("PROXY_CACHE_MAX_SIZE_MB", 1024)) * 1024 * 1024,
+		}
+		policy := getURLPolicy()
+		dialer := &net.Dialer{Timeout: proxyConf.connectTimeout, Control: policy.dialControl}
+		// No overall timeout, a song streams for minutes; stalled reads are cut off by the read timeout instead.
+		// No HTTP proxy either, the policy can only check addresses the server dials itself.
+		proxyClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   proxyConf.connectTimeout,
+				ResponseHeaderTimeout: proxyConf.readTimeout,
+				MaxIdleConnsPerHost:   4,
+				IdleConnTimeout:       90 * time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > proxyConf.maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", proxyConf.maxRedirects)
+				}
+				return policy.CheckURL(req.URL)
+			},
+		}
+		if proxyConf.cacheDir != "" {
+			fmt.Printf("[Info] Proxy disk cache enabled in %s, limited to %d MB\n", proxyConf.cacheDir, proxyConf.cacheMaxSize/1024/1024)
+			// Files left over from a run with a larger limit are trimmed right away
+			go trimProxyCache(proxyConf.cacheDir, proxyConf.cacheMaxSize)
+		}
+	})
+	return proxyClient, proxyConf
+}
+
+// idleTimeoutReader cancels the request when no data arrives within the timeout.
+type idleTimeoutReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	ir.timer.Reset(ir.timeout)
+	return n, err
+}
+
+// remoteBody is a policy-checked response body that releases the request when it is closed.
+type remoteBody struct {
+	io.Reader
+	close func()
+}
+
+func (rb *remoteBody) Close() error {
+	rb.close()
+	return nil
+}
+
+// Helper function to open a remote file through the URL policy, for consumers like ffmpeg that must not
+// fetch URLs themselves. Stalled reads are cut off after the read timeout.
+func openRemoteFile(ctx context.Context, remoteURL string) (io.ReadCloser, error) {
+	client, conf := getRemoteHTTPClient()
+	policy := getURLPolicy()
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, "GET", remoteURL, nil)
+	if err == nil {
+		err = policy.CheckURL(req.URL)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	timer := time.AfterFunc(conf.readTimeout, cancel)
+	resp, err := client.Do(req)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("remote file returned %s", resp.Status)
+	} else {
+		err = policy.CheckResponse(resp)
+	}
+	if err != nil {
+		resp.Body.Close()
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	return &remoteBody{
+		Reader: policy.LimitBody(&idleTimeoutReader{r: resp.Body, timer: timer, timeout: conf.readTimeout}),
+		close: func() {
+			timer.Stop()
+			cancel()
+			resp.Body.Close()
+		},
+	}, nil
+}
+
+// Helper function to get the disk cache file of a remote URL
+func getProxyCachePath(cacheDir, remoteURL string) string {
+	sum := sha256.Sum256([]byte(remoteURL))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:])+filepath.Ext(remoteURL))
+}
+
+// proxyHandler streams a remote file to the device, forwarding Range requests
+func proxyHandler(w http.ResponseWriter, r *http.Request, remoteURL string) {
+	client, conf := getRemoteHTTPClient()
+	policy := getURLPolicy()
+	contentType := getContentType(filepath.Ext(remoteURL))
+
+	parsedURL, err := url.Parse(remoteURL)
+	if err != nil {
+		NotFoundHandler(w, r)
+		return
+	}
+	err = policy.CheckURL(parsedURL)
+	if err != nil {
+		writeForbidden(w, r, err)
+		return
+	}
+
+	// A previously completed download is served locally
+	var cachePath string
+	if conf.cacheDir != "" {
+		cachePath = getProxyCachePath(conf.cacheDir, remoteURL)
+		if file, err := os.Open(cachePath); err == nil {
+			defer file.Close()
+			if fileInfo, err := file.Stat(); err == nil {
+				proxyCacheAccessMu.Lock()
+				proxyCacheAccess[cachePath] = time.Now()
+				proxyCacheAccessMu.Unlock()
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("ETag", buildFileETag(fileInfo))
+				http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), file)
+				return
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timer := time.AfterFunc(conf.readTimeout, cancel)
+	defer timer.Stop()
+
+	// Create a new HTTP request to the remote URL, only the range headers are copied
+	req, err := http.NewRequestWithContext(ctx, "GET", remoteURL, nil)
+	if err != nil {
+		NotFoundHandler(w, r)
+		return
+	}
+	for _, header := range []string{"Range", "If-Range"} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if errors.Is(err, ErrURLForbidden) {
+		writeForbidden(w, r, err)
+		return
+	}
+	if err != nil {
+		fmt.Println("[Error] Error fetching proxied URL:", err)
+		NotFoundHandler(w, r)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		fmt.Printf("[Warning] Proxied URL %s returned %s\n", remoteURL, resp.Status)
+		NotFoundHandler(w, r)
+		return
+	}
+	err = policy.CheckResponse(resp)
+	if err != nil {
+		writeForbidden(w, r, err)
+		return
+	}
+
+	// Prefer the type derived from the extension, upstream servers often send octet-stream for audio
+	if contentType == "application/octet-stream" && resp.Header.Get("Content-Type") != "" {
+		contentType = resp.Header.Get("Content-Type")
+	}
+	w.Header().Set("Content-Type", contentType)
+	for _, header := range proxyRelayedHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	body := policy.LimitBody(&idleTimeoutReader{r: resp.Body, timer: timer, timeout: conf.readTimeout})
+
+	// Only complete responses are worth keeping on disk, and only if they fit into the cache
+	if cachePath == "" || resp.StatusCode != http.StatusOK || conf.cacheMaxSize > 0 && resp.ContentLength > conf.cacheMaxSize {
+		io.Copy(w, body)
+		return
+	}
+	err = teeToProxyCache(w, body, cachePath, resp.ContentLength, conf.cacheMaxSize)
+	if err != nil {
+		fmt.Println("[Info] Proxied response not cached:", err)
+		return
+	}
+	trimProxyCache(conf.cacheDir, conf.cacheMaxSize)
+}
+
+// Helper function to delete the least recently served files of the proxy disk cache until it fits
+// into the size cap. Temporary files are left to cleanupTempFiles.
+func trimProxyCache(cacheDir string, maxSize int64) {
+	if maxSize <= 0 {
+		return
+	}
+	proxyTrimMu.Lock()
+	defer proxyTrimMu.Unlock()
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("[Error] Failed to read proxy cache directory:", err)
+		}
+		return
+	}
+	type cachedFile struct {
+		path       string
+		size       int64
+		lastAccess time.Time
+	}
+	var files []cachedFile
+	var total int64
+	proxyCacheAccessMu.Lock()
+	defer proxyCacheAccessMu.Unlock()
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isTempName(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(cacheDir, entry.Name())
+		lastAccess, ok := proxyCacheAccess[path]
+		if !ok {
+			lastAccess = info.ModTime()
+		}
+		files = append(files, cachedFile{path: path, size: info.Size(), lastAccess: lastAccess})
+		total += info.Size()
+	}
+	if total <= maxSize {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].lastAccess.Before(files[j].lastAccess) })
+	removed := 0
+	for _, file := range files {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			fmt.Println("[Error] Failed to remove proxy cache file:", err)
+			continue
+		}
+		delete(proxyCacheAccess, file.path)
+		total -= file.size
+		removed++
+	}
+	fmt.Printf("[Info] Trimmed %d proxy cache files, %.1f MB in use\n", removed, float64(total)/1024/1024)
+}
+
+// Helper function to copy a response to the device while saving it as a cache file, unless it turns out
+// larger than maxSize
+func teeToProxyCache(w io.Writer, body io.Reader, cachePath string, contentLength, maxSize int64) error {
+	err := os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err != nil {
+		io.Copy(w, body)
+		return err
+	}
+	tmpFile, err := createAtomicFile(cachePath, 0644)
+	if err != nil {
+		io.Copy(w, body)
+		return err
+	}
+	defer tmpFile.Abort()
+
+	// The device keeps receiving data even if writing the cache file fails
+	cacheWriter := &bestEffortWriter{w: tmpFile}
+	written, err := io.Copy(w, io.TeeReader(body, cacheWriter))
+	if err != nil {
+		return err
+	}
+	if cacheWriter.err != nil {
+		return cacheWriter.err
+	}
+	if contentLength >= 0 && written != contentLength {
+		return fmt.Errorf("incomplete response: got %d of %d bytes", written, contentLength)
+	}
+	if maxSize > 0 && written > maxSize {
+		return fmt.Errorf("%d bytes do not fit into the proxy cache", written)
+	}
+	return tmpFile.Commit()
+}
+
+// bestEffortWriter stops writing after the first error instead of failing the copy it is teed from.
+type bestEffortWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (bw *bestEffortWriter) Write(p []byte) (int, error) {
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrimProxyCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(name string, size int, age time.Duration) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(-age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	oldest := write("oldest.mp3", 400, 4*time.Hour)
+	served := write("served.mp3", 400, 3*time.Hour)
+	older := write("older.mp3", 400, 2*time.Hour)
+	newest := write("newest.mp3", 400, time.Hour)
+	temp := write(".tmp-download.mp3-1", 4000, 5*time.Hour)
+
+	// Serving a file makes it the most recently used one
+	proxyCacheAccessMu.Lock()
+	proxyCacheAccess[served] = now
+	proxyCacheAccessMu.Unlock()
+	t.Cleanup(func() {
+		proxyCacheAccessMu.Lock()
+		delete(proxyCacheAccess, served)
+		proxyCacheAccessMu.Unlock()
+	})
+
+	trimProxyCache(dir, 900)
+
+	for path, want := range map[string]bool{oldest: false, older: false, served: true, newest: true, temp: true} {
+		_, err := os.Stat(path)
+		if exists := err == nil; exists != want {
+			t.Errorf("%s exists: %v, want %v", filepath.Base(path), exists, want)
+		}
+	}
+
+	// Without a cap nothing is removed
+	trimProxyCache(dir, 0)
+	if _, err := os.Stat(newest); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTeeToProxyCacheSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("a"), 1000)
+
+	var device bytes.Buffer
+	cachePath := filepath.Join(dir, "large.mp3")
+	err := teeToProxyCache(&device, bytes.NewReader(data), cachePath, -1, 500)
+	if err == nil || !strings.Contains(err.Error(), "do not fit") {
+		t.Errorf("got %v, want a size error", err)
+	}
+	if device.Len() != len(data) {
+		t.Errorf("device got %d of %d bytes", device.Len(), len(data))
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Error("oversized response was cached")
+	}
+
+	device.Reset()
+	cachePath = filepath.Join(dir, "small.mp3")
+	if err := teeToProxyCache(&device, bytes.NewReader(data), cachePath, int64(len(data)), 2000); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := os.ReadFile(cachePath); err != nil || !bytes.Equal(cached, data) {
+		t.Errorf("cached %d bytes, %v", len(cached), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %d entries", len(entries))
+	}
+}
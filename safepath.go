@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafePath is returned for paths that would leave their root directory.
+var ErrUnsafePath = errors.New("path escapes its root directory")
+
+// safeRoot is a directory that served files are confined to.
+type safeRoot struct {
+	dir string
+}
+
+var (
+	filesRoot = safeRoot{dir: "./files"}
+	cacheRoot = safeRoot{dir: "./cache"}
+	themeRoot = safeRoot{dir: "theme"}
+)
+
+// Join turns a slash separated path relative to the root into a local path without requiring it
+// to exist. It rejects paths that climb out of the root, also through a symlinked parent directory.
+func (root safeRoot) Join(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", ErrUnsafePath
+	}
+	// Cleaning against "/" drops every ".." that would climb above the root
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	localName := filepath.FromSlash(cleaned)
+	if filepath.IsAbs(localName) || filepath.VolumeName(localName) != "" || (cleaned != "" && !filepath.IsLocal(localName)) {
+		return "", ErrUnsafePath
+	}
+	fullPath := filepath.Join(root.dir, localName)
+
+	if realDir, err := filepath.EvalSymlinks(filepath.Dir(fullPath)); err == nil {
+		err = root.checkInside(realDir)
+		if err != nil {
+			return "", err
+		}
+	}
+	return fullPath, nil
+}
+
+// Resolve is like Join for an existing file, and also rejects the file itself being a symlink
+// pointing outside of the root.
+func (root safeRoot) Resolve(name string) (string, error) {
+	fullPath, err := root.Join(name)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		return "", err
+	}
+	err = root.checkInside(realPath)
+	if err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
+
+// Helper function to turn an artist or title into a single file name component
+func safeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', 0:
+			return '_'
+		}
+		return r
+	}, name)
+	// Names made only of dots would climb directories
+	if strings.Trim(name, ".") == "" {
+		name = strings.ReplaceAll(name, ".", "_")
+	}
+	return name
+}
+
+// Helper function to check that a resolved path lies inside the real root directory
+func (root safeRoot) checkInside(realPath string) error {
+	realRoot, err := filepath.EvalSymlinks(root.dir)
+	if err != nil {
+		return err
+	}
+	realRoot, err = filepath.Abs(realRoot)
+	if err != nil {
+		return err
+	}
+	realPath, err = filepath.Abs(realPath)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || !filepath.IsLocal(rel) {
+		return ErrUnsafePath
+	}
+	return nil
+}
+
+// Helper function to find the regular file under ./files behind a URL path such as /music/<dir>/music.mp3
+// or /files/cache/music/<dir>/music.mp3, trying the '+'/space variants of the name
+func resolveFilesURLPath(urlPath string) (string, error) {
+	relPath := strings.TrimPrefix(urlPath, "/files/")
+	var lastErr error = os.ErrNotExist
+	for _, candidate := range []string{strings.ReplaceAll(relPath, "+", " "), relPath, strings.ReplaceAll(relPath, " ", "+")} {
+		localPath, err := filesRoot.Resolve(candidate)
+		if errors.Is(err, ErrUnsafePath) {
+			return "", err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		info, err := os.Stat(localPath)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if info.IsDir() {
+			lastErr = os.ErrNotExist
+			continue
+		}
+		return localPath, nil
+	}
+	return "", lastErr
+}
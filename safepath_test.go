@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Helper function to lay out ./files next to a secret file the server must never hand out
+func setupSafePathTree(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	for path, content := range map[string]string{
+		"secret.txt":                           "secret",
+		"files/music/Alice-Song/music.mp3":     "mp3",
+		"files/music/Bob+Song/music.mp3":       "plus",
+		"files/cache/music/Eve-Song/cover.jpg": "jpg",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside, err := filepath.Abs("outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "music.mp3"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A symlinked directory and a symlinked file both pointing out of ./files
+	if err := os.Symlink(outside, "files/music/escape"); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "music.mp3"), "files/music/Alice-Song/link.mp3"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSafeRootJoin(t *testing.T) {
+	setupSafePathTree(t)
+	tests := []struct {
+		name string
+		path string
+		want string // Empty when the path must be rejected
+	}{
+		{"plain", "music/Alice-Song/music.mp3", "files/music/Alice-Song/music.mp3"},
+		{"missing file", "music/Nobody/music.mp3", "files/music/Nobody/music.mp3"},
+		{"dot dot is clamped to the root", "../secret.txt", "files/secret.txt"},
+		{"dot dot inside", "music/../music/Alice-Song/music.mp3", "files/music/Alice-Song/music.mp3"},
+		{"deep dot dot", "music/../../../../etc/passwd", "files/etc/passwd"},
+		{"absolute path", "/etc/passwd", "files/etc/passwd"},
+		{"NUL byte", "music/Alice-Song/music.mp3\x00.txt", ""},
+		{"symlinked directory", "music/escape/music.mp3", ""},
+		{"through symlinked directory", "music/escape/new.mp3", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := filesRoot.Join(test.path)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("Join(%q) = %q, want an error", test.path, got)
+				}
+				return
+			}
+			if err != nil || got != filepath.FromSlash(test.want) {
+				t.Errorf("Join(%q) = %q, %v, want %q", test.path, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestSafeRootResolve(t *testing.T) {
+	setupSafePathTree(t)
+	if _, err := filesRoot.Resolve("music/Alice-Song/music.mp3"); err != nil {
+		t.Errorf("regular file rejected: %v", err)
+	}
+	if _, err := filesRoot.Resolve("music/Alice-Song/link.mp3"); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("symlink out of the root: got %v, want ErrUnsafePath", err)
+	}
+	if _, err := filesRoot.Resolve("music/escape/music.mp3"); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("file behind a symlinked directory: got %v, want ErrUnsafePath", err)
+	}
+	if _, err := filesRoot.Resolve("music/Nobody/music.mp3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v, want ErrNotExist", err)
+	}
+}
+
+func TestResolveFilesURLPath(t *testing.T) {
+	setupSafePathTree(t)
+	tests := []struct {
+		name    string
+		urlPath string
+		want    string
+		err     error
+	}{
+		{"music", "/files/music/Alice-Song/music.mp3", "files/music/Alice-Song/music.mp3", nil},
+		{"cache", "/files/cache/music/Eve-Song/cover.jpg", "files/cache/music/Eve-Song/cover.jpg", nil},
+		{"space for plus", "/files/music/Bob Song/music.mp3", "files/music/Bob+Song/music.mp3", nil},
+		{"directory", "/files/music/Alice-Song", "", os.ErrNotExist},
+		{"dot dot", "/files/../secret.txt", "", os.ErrNotExist},
+		{"NUL byte", "/files/music/Alice-Song/music.mp3\x00", "", ErrUnsafePath},
+		{"symlinked file", "/files/music/Alice-Song/link.mp3", "", ErrUnsafePath},
+		{"symlinked directory", "/files/music/escape/music.mp3", "", ErrUnsafePath},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := resolveFilesURLPath(test.urlPath)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Errorf("resolveFilesURLPath(%q) = %q, %v, want %v", test.urlPath, got, err, test.err)
+				}
+				return
+			}
+			if err != nil || got != filepath.FromSlash(test.want) {
+				t.Errorf("resolveFilesURLPath(%q) = %q, %v, want %q", test.urlPath, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestFileHandlerRejectsEscapes(t *testing.T) {
+	setupSafePathTree(t)
+	// The requests go straight to the handler, without the path cleaning of http.ServeMux
+	for _, target := range []string{
+		"/files/../secret.txt",
+		"/files/%2e%2e/secret.txt",
+		"/files/%2E%2E%2Fsecret.txt",
+		"/files/music%2f..%2f..%2fsecret.txt",
+		"/files/music/..%5c..%5csecret.txt",
+		"/files/music/Alice-Song/music.mp3%00",
+		"/files//etc/passwd",
+		"/files/music/Alice-Song/link.mp3",
+		"/files/music/escape/music.mp3",
+	} {
+		t.Run(target, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			fileHandler(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+			if recorder.Code == http.StatusOK {
+				t.Errorf("%s was served: %q", target, recorder.Body.String())
+			}
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	fileHandler(recorder, httptest.NewRequest(http.MethodGet, "/files/music/Alice-Song/music.mp3", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "mp3" {
+		t.Errorf("regular file: got %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestGetLocalPathFromURLRejectsEscapes(t *testing.T) {
+	setupSafePathTree(t)
+	request := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	for _, rawURL := range []string{
+		"/files/%2e%2e/secret.txt",
+		"http://localhost/files/..%2fsecret.txt",
+		"/files/music/Alice-Song/music.mp3%00",
+		"/files/music/Alice-Song/link.mp3",
+		"http://other.example/files/music/Alice-Song/music.mp3",
+	} {
+		if localPath, ok := getLocalPathFromURL(request, rawURL); ok {
+			t.Errorf("%s resolved to %s", rawURL, localPath)
+		}
+	}
+	if localPath, ok := getLocalPathFromURL(request, "http://localhost/files/music/Alice%2DSong/music.mp3"); !ok || localPath != filepath.FromSlash("files/music/Alice-Song/music.mp3") {
+		t.Errorf("regular file: got %q, %v", localPath, ok)
+	}
+}
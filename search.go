@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SearchHit is a single search result together with the tier it came from.
+type SearchHit struct {
+	MusicItem
+	Source   string  `json:"source"` // "sources", "local", "cache" or "provider:<name>"
+	Provider string  `json:"provider,omitempty"`
+	ID       string  `json:"id,omitempty"`
+	PlayURL  string  `json:"play_url"`
+	Score    float64 `json:"score"`
+	tier     int
+}
+
+// SearchResponse is the response of /api/search.
+type SearchResponse struct {
+	Query   string      `json:"query"`
+	Artist  string      `json:"artist"`
+	Page    int         `json:"page"`
+	Limit   int         `json:"limit"`
+	Total   int         `json:"total"`
+	Results []SearchHit `json:"results"`
+}
+
+const (
+	searchDefaultLimit = 10
+	searchMaxLimit     = 50
+)
+
+// Helper function to score how well a title and artist match the query, returning 0 for no match
+func scoreSearchMatch(query, artist, title, itemArtist string) float64 {
+	queryKey, titleKey, itemArtistKey := newMatchKey(query), newMatchKey(title), newMatchKey(itemArtist)
+	query, title = queryKey.Text, titleKey.Text
+	var score float64
+	switch {
+	case query == "":
+		return 0
+	case title == query:
+		score = 100
+	case title != "" && strings.HasPrefix(title, query):
+		score = 80
+	case strings.Contains(title, query):
+		score = 60
+	case title != "" && strings.Contains(query, title):
+		score = 40
+	case itemArtistKey.Text != "" && strings.Contains(itemArtistKey.Text, query):
+		// Searching by artist name only
+		score = 30
+	default:
+		// Pinyin, initials and typos rank below the plain matches
+		if fuzzy := matchScore(queryKey, titleKey); fuzzy >= matchThreshold {
+			score = 50 * fuzzy
+		} else if fuzzy := matchScore(queryKey, itemArtistKey); fuzzy >= matchThreshold {
+			score = 30 * fuzzy
+		} else {
+			return 0
+		}
+	}
+
+	if artist != "" {
+		artistKey := newMatchKey(artist)
+		switch {
+		case itemArtistKey.Text == artistKey.Text:
+			score += 30
+		case strings.Contains(itemArtistKey.Text, artistKey.Text):
+			score += 20
+		default:
+			fuzzy := matchScore(artistKey, itemArtistKey)
+			if fuzzy < matchThreshold {
+				return 0
+			}
+			score += 20 * fuzzy
+		}
+	}
+	return score
+}
+
+// Helper function to build the /stream_pcm link that plays a search hit
+func buildPlayURL(r *http.Request, hit SearchHit) string {
+	query := url.Values{"song": {hit.Title}}
+	if hit.Artist != "" {
+		query.Set("singer", hit.Artist)
+	}
+	if hit.Provider != "" && hit.ID != "" {
+		query.Set("provider", hit.Provider)
+		query.Set("id", hit.ID)
+	}
+	return getRequestScheme(r) + "://" + r.Host + "/stream_pcm?" + query.Encode()
+}
+
+// Helper function to search the upstream providers configured by API_SOURCES in parallel
+func searchProviders(ctx context.Context, query, artist string, limit int) []SearchHit {
+	names := getConfiguredProviders()
+	results := make([][]SearchHit, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		provider, ok := getProvider(name)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, provider Provider) {
+			defer wg.Done()
+			tracks, err := provider.Search(ctx, query, artist, limit)
+			if err != nil {
+				fmt.Printf("[Error] Error searching provider %s: %v\n", provider.Name(), err)
+				return
+			}
+			for _, track := range tracks {
+				results[i] = append(results[i], SearchHit{
+					MusicItem: MusicItem{
+						Title:    track.Title,
+						Artist:   track.Artist,
+						Album:    track.Album,
+						CoverURL: track.CoverURL,
+						Duration: track.Duration,
+					},
+					Source:   "provider:" + provider.Name(),
+					Provider: provider.Name(),
+					ID:       track.ID,
+					tier:     3 + i,
+				})
+			}
+		}(i, provider)
+	}
+	wg.Wait()
+
+	var hits []SearchHit
+	for _, result := range results {
+		hits = append(hits, result...)
+	}
+	return hits
+}
+
+// Helper function to search every tier and return the ranked hits
+func searchAllTiers(r *http.Request, query, artist string, limit int, upstream bool) []SearchHit {
+	var hits []SearchHit
+
+	for _, source := range getSourceMusicItems() {
+		if source.Title == "" {
+			continue
+		}
+		hits = append(hits, SearchHit{MusicItem: buildSourceMusicItem(r, source), Source: "sources", tier: 0})
+	}
+	for _, musicItem := range searchLocalMusicItems("", "", 0) {
+		hits = append(hits, SearchHit{MusicItem: absoluteMusicItemURLs(r, musicItem), Source: "local", tier: 1})
+	}
+	for _, musicItem := range searchCachedMusicItems("", "", 0) {
+		musicItem.FromCache = true
+		hits = append(hits, SearchHit{MusicItem: absoluteMusicItemURLs(r, musicItem), Source: "cache", tier: 2})
+	}
+	if upstream {
+		hits = append(hits, searchProviders(r.Context(), query, artist, limit)...)
+	}
+
+	// Keep only the hits that match and rank them, preferring the earlier tiers on a tie
+	ranked := hits[:0]
+	for _, hit := range hits {
+		hit.Score = scoreSearchMatch(query, artist, hit.Title, hit.Artist)
+		if hit.Score == 0 {
+			continue
+		}
+		hit.PlayURL = buildPlayURL(r, hit)
+		ranked = append(ranked, hit)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].tier < ranked[j].tier
+	})
+	return ranked
+}
+
+// searchHandler handles /api/search?q=&artist=&page=&limit= requests.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "MeowMusicEmbeddedServer")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	queryParams := r.URL.Query()
+	fmt.Printf("[Web Access] Handling request for %s?%s\n", r.URL.Path, queryParams.Encode())
+	query := strings.TrimSpace(queryParams.Get("q"))
+	artist := strings.TrimSpace(queryParams.Get("artist"))
+	if query == "" {
+		http.Error(w, "missing q parameter", http.StatusBadRequest)
+		return
+	}
+
+	page, err := strconv.Atoi(queryParams.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(queryParams.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = searchDefaultLimit
+	}
+	if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+	// Upstream providers can be skipped for a quick local search
+	upstream := queryParams.Get("upstream") != "false"
+
+	// Ask the providers for enough results to fill the requested page
+	hits := searchAllTiers(r, query, artist, searchProviderLimit(page, limit), upstream)
+
+	response := SearchResponse{
+		Query:   query,
+		Artist:  artist,
+		Page:    page,
+		Limit:   limit,
+		Total:   len(hits),
+		Results: searchResultPage(hits, page, limit),
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// Helper function to get the number of results to ask each provider for, enough to fill the page. Pages are
+// compared before multiplying, a huge page would overflow.
+func searchProviderLimit(page, limit int) int {
+	if page > searchMaxLimit/limit {
+		return searchMaxLimit
+	}
+	return min(page*limit, searchMaxLimit)
+}
+
+// Helper function to cut a page out of the ranked hits, pages past the last hit are empty
+func searchResultPage(hits []SearchHit, page, limit int) []SearchHit {
+	// The page number is checked against the page count so (page - 1) * limit stays within the hits
+	pages := (len(hits) + limit - 1) / limit
+	if page > pages {
+		return []SearchHit{}
+	}
+	start := (page - 1) * limit
+	return hits[start:min(start+limit, len(hits))]
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSearchResultPage(t *testing.T) {
+	hits := make([]SearchHit, 25)
+	for i := range hits {
+		hits[i].Title = string(rune('a' + i))
+	}
+	tests := []struct {
+		page, limit int
+		want        string
+	}{
+		{1, 10, "abcdefghij"},
+		{3, 10, "uvwxy"},
+		{4, 10, ""},
+		{1, 50, "abcdefghijklmnopqrstuvwxy"},
+		// (page - 1) * limit overflows to a negative start
+		{1844674407370955162, 10, ""},
+		{math.MaxInt, 50, ""},
+	}
+	for _, test := range tests {
+		got := ""
+		for _, hit := range searchResultPage(hits, test.page, test.limit) {
+			got += hit.Title
+		}
+		if got != test.want {
+			t.Errorf("page %d limit %d = %q, want %q", test.page, test.limit, got, test.want)
+		}
+	}
+	if got := searchResultPage(nil, 1, 10); got == nil || len(got) != 0 {
+		t.Errorf("empty search = %v, want an empty page", got)
+	}
+}
+
+func TestSearchProviderLimit(t *testing.T) {
+	tests := []struct{ page, limit, want int }{
+		{1, 10, 10},
+		{3, 10, 30},
+		{6, 10, searchMaxLimit},
+		{1844674407370955162, 10, searchMaxLimit},
+		{math.MaxInt, searchMaxLimit, searchMaxLimit},
+	}
+	for _, test := range tests {
+		if got := searchProviderLimit(test.page, test.limit); got != test.want {
+			t.Errorf("searchProviderLimit(%d, %d) = %d, want %d", test.page, test.limit, got, test.want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package main
 type MusicItem struct {
 	Title        string `json:"title"`
 	Artist       string `json:"artist"`
+	Album        string `json:"album,omitempty"`
 	AudioURL     string `json:"audio_url"`
 	AudioFullURL string `json:"audio_full_url"`
 	M3U8URL      string `json:"m3u8_url"`
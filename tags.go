@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// AudioTags is the metadata embedded in an audio file.
+type AudioTags struct {
+	Title     string
+	Artist    string
+	Album     string
+	Track     int
+	Year      int
+	Lyrics    string // Unsynchronised lyrics, or LRC text if the file embeds it
+	Cover     []byte
+	CoverMIME string
+}
+
+// ErrNoTags is returned for files without a supported tag format.
+var ErrNoTags = errors.New("no supported tags found")
+
+// maxTagSize bounds how much of a file is read for tags, covers included.
+const maxTagSize = 16 << 20
+
+// Helper function to read the embedded tags of an MP3, FLAC, OGG/Opus or MP4/M4A file
+func readAudioTags(filePath string) (AudioTags, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return AudioTags{}, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return AudioTags{}, ErrNoTags
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return AudioTags{}, err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return readID3v2Tags(file)
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return readFLACTags(file)
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return readOggTags(file)
+	case bytes.Equal(header[4:8], []byte("ftyp")):
+		return readMP4Tags(file)
+	}
+	return AudioTags{}, ErrNoTags
+}
+
+// Helper function to fill in the track number from its text form, e.g. "3/12"
+func (tags *AudioTags) setTrack(value string) {
+	value, _, _ = strings.Cut(strings.TrimSpace(value), "/")
+	if track, err := strconv.Atoi(value); err == nil && tags.Track == 0 {
+		tags.Track = track
+	}
+}
+
+// Helper function to fill in the year from a date such as "2004-05-01"
+func (tags *AudioTags) setYear(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) >= 4 {
+		if year, err := strconv.Atoi(value[:4]); err == nil && tags.Year == 0 {
+			tags.Year = year
+		}
+	}
+}
+
+// Helper function to keep the first non-empty value of a field
+func setFirst(field *string, value string) {
+	if *field == "" {
+		*field = strings.TrimSpace(value)
+	}
+}
+
+// Helper function to decode a synchsafe integer
+func synchsafe(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<7 | int(c&0x7f)
+	}
+	return n
+}
+
+// Helper function to undo ID3v2 unsynchronisation
+func removeUnsync(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte{0xff, 0x00}, []byte{0xff})
+}
+
+// Helper function to read an ID3v2.2, 2.3 or 2.4 tag at the start of a file
+func readID3v2Tags(r io.Reader) (AudioTags, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return AudioTags{}, err
+	}
+	version := header[3]
+	flags := header[5]
+	size := synchsafe(header[6:10])
+	if version < 2 || version > 4 || size > maxTagSize {
+		return AudioTags{}, fmt.Errorf("unsupported ID3v2 tag version %d or size %d", version, size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return AudioTags{}, err
+	}
+	if flags&0x80 != 0 && version < 4 {
+		data = removeUnsync(data)
+	}
+	// Skip the extended header
+	if flags&0x40 != 0 && version >= 3 && len(data) >= 4 {
+		var extSize int
+		var ok bool
+		if version == 4 {
+			// The size includes the size field itself
+			extSize = synchsafe(data[:4])
+			ok = extSize <= len(data)
+		} else {
+			extSize, ok = checkedLength(binary.BigEndian.Uint32(data[:4]), len(data)-4)
+			extSize += 4
+		}
+		if !ok {
+			return AudioTags{}, fmt.Errorf("invalid ID3v2 extended header")
+		}
+		data = data[extSize:]
+	}
+
+	var tags AudioTags
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(data) >= headerLen && data[0] != 0 {
+		id := string(data[:idLen])
+		var size uint32
+		var frameFlags uint16
+		switch version {
+		case 2:
+			size = uint32(data[3])<<16 | uint32(data[4])<<8 | uint32(data[5])
+		case 3:
+			size = binary.BigEndian.Uint32(data[4:8])
+			frameFlags = binary.BigEndian.Uint16(data[8:10])
+		case 4:
+			size = uint32(synchsafe(data[4:8]))
+			frameFlags = binary.BigEndian.Uint16(data[8:10])
+		}
+		frameSize, ok := checkedLength(size, len(data)-headerLen)
+		if !ok {
+			break
+		}
+		frame := data[headerLen : headerLen+frameSize]
+		data = data[headerLen+frameSize:]
+
+		// Compressed and encrypted frames are skipped
+		if version == 3 && frameFlags&0x00c0 != 0 || version == 4 && frameFlags&0x000c != 0 {
+			continue
+		}
+		if version == 4 {
+			if frameFlags&0x0002 != 0 {
+				frame = removeUnsync(frame)
+			}
+			// Skip the data length indicator
+			if frameFlags&0x0001 != 0 && len(frame) >= 4 {
+				frame = frame[4:]
+			}
+		}
+		applyID3Frame(&tags, id, frame)
+	}
+	return tags, nil
+}
+
+// Helper function to store the value of a single ID3v2 frame
+func applyID3Frame(tags *AudioTags, id string, frame []byte) {
+	if len(frame) == 0 {
+		return
+	}
+	switch id {
+	case "TIT2", "TT2":
+		setFirst(&tags.Title, decodeID3Text(frame[0], frame[1:]))
+	case "TPE1", "TP1":
+		setFirst(&tags.Artist, decodeID3Text(frame[0], frame[1:]))
+	case "TALB", "TAL":
+		setFirst(&tags.Album, decodeID3Text(frame[0], frame[1:]))
+	case "TRCK", "TRK":
+		tags.setTrack(decodeID3Text(frame[0], frame[1:]))
+	case "TYER", "TYE", "TDRC", "TDOR":
+		tags.setYear(decodeID3Text(frame[0], frame[1:]))
+	case "USLT", "ULT":
+		// Encoding, 3 byte language, description, text
+		if len(frame) < 4 || tags.Lyrics != "" {
+			return
+		}
+		_, text := splitID3String(frame[0], frame[4:])
+		tags.Lyrics = strings.TrimSpace(decodeID3Text(frame[0], text))
+	case "APIC":
+		// Encoding, MIME type, picture type, description, data
+		if tags.Cover != nil {
+			return
+		}
+		end := bytes.IndexByte(frame[1:], 0)
+		if end < 0 || len(frame) < end+3 {
+			return
+		}
+		mimeType := string(frame[1 : 1+end])
+		_, picture := splitID3String(frame[0], frame[end+3:])
+		tags.Cover, tags.CoverMIME = picture, mimeType
+	case "PIC":
+		// Encoding, 3 byte image format, picture type, description, data
+		if tags.Cover != nil || len(frame) < 5 {
+			return
+		}
+		mimeType := "image/" + strings.ToLower(strings.TrimSpace(string(frame[1:4])))
+		_, picture := splitID3String(frame[0], frame[5:])
+		tags.Cover, tags.CoverMIME = picture, mimeType
+	}
+}
+
+// Helper function to split a terminated string off the front of a frame
+func splitID3String(encoding byte, data []byte) ([]byte, []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return data[:i], data[i+2:]
+			}
+		}
+		return data, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return data[:i], data[i+1:]
+	}
+	return data, nil
+}
+
+// Helper function to decode ID3v2 text in one of its four encodings, keeping the first value of a list
+func decodeID3Text(encoding byte, data []byte) string {
+	var text string
+	switch encoding {
+	case 1, 2:
+		text = decodeUTF16(data, encoding == 2)
+	case 3:
+		text = string(data)
+	default:
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		text = string(runes)
+	}
+	text, _, _ = strings.Cut(text, "\x00")
+	return strings.TrimSpace(text)
+}
+
+// Helper function to decode UTF-16 text, honouring a byte order mark
+func decodeUTF16(data []byte, bigEndian bool) string {
+	if len(data) >= 2 {
+		if data[0] == 0xff && data[1] == 0xfe {
+			bigEndian, data = false, data[2:]
+		} else if data[0] == 0xfe && data[1] == 0xff {
+			bigEndian, data = true, data[2:]
+		}
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = binary.BigEndian.Uint16(data[2*i:])
+		} else {
+			units[i] = binary.LittleEndian.Uint16(data[2*i:])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// Helper function to check a 32-bit length against the n bytes left in a block. The comparison is made
+// before any conversion to int, so crafted lengths cannot turn negative on 32-bit builds.
+func checkedLength(length uint32, n int) (int, bool) {
+	if n < 0 || uint64(length) > uint64(n) {
+		return 0, false
+	}
+	return int(length), true
+}
+
+// Helper function to parse a Vorbis comment block without the framing bit
+func applyVorbisComments(tags *AudioTags, data []byte) {
+	if len(data) < 8 {
+		return
+	}
+	vendorLen, ok := checkedLength(binary.LittleEndian.Uint32(data), len(data)-8)
+	if !ok {
+		return
+	}
+	data = data[4+vendorLen:]
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < count && len(data) >= 4; i++ {
+		length, ok := checkedLength(binary.LittleEndian.Uint32(data), len(data)-4)
+		if !ok {
+			return
+		}
+		comment := string(data[4 : 4+length])
+		data = data[4+length:]
+
+		key, value, ok := strings.Cut(comment, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			setFirst(&tags.Title, value)
+		case "ARTIST":
+			setFirst(&tags.Artist, value)
+		case "ALBUM":
+			setFirst(&tags.Album, value)
+		case "TRACKNUMBER":
+			tags.setTrack(value)
+		case "DATE", "YEAR":
+			tags.setYear(value)
+		case "LYRICS", "UNSYNCEDLYRICS":
+			setFirst(&tags.Lyrics, value)
+		case "METADATA_BLOCK_PICTURE":
+			if tags.Cover == nil {
+				if picture, err := base64.StdEncoding.DecodeString(value); err == nil {
+					applyFLACPicture(tags, picture)
+				}
+			}
+		}
+	}
+}
+
+// Helper function to parse a FLAC picture block
+func applyFLACPicture(tags *AudioTags, data []byte) {
+	if tags.Cover != nil || len(data) < 12 {
+		return
+	}
+	mimeLen, ok := checkedLength(binary.BigEndian.Uint32(data[4:8]), len(data)-12)
+	if !ok {
+		return
+	}
+	mimeType := string(data[8 : 8+mimeLen])
+	data = data[8+mimeLen:]
+	// Description, then width, height, depth and colour count, then the data length
+	descLen, ok := checkedLength(binary.BigEndian.Uint32(data), len(data)-24)
+	if !ok {
+		return
+	}
+	data = data[4+descLen+16:]
+	pictureLen, ok := checkedLength(binary.BigEndian.Uint32(data), len(data)-4)
+	if !ok {
+		return
+	}
+	tags.Cover, tags.CoverMIME = data[4:4+pictureLen], mimeType
+}
+
+// Helper function to read the metadata blocks of a FLAC file
+func readFLACTags(r io.Reader) (AudioTags, error) {
+	var tags AudioTags
+	if _, err := io.CopyN(io.Discard, r, 4); err != nil {
+		return tags, err
+	}
+	header := make([]byte, 4)
+	total := 0
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return tags, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		total += length
+		if total > maxTagSize {
+			return tags, nil
+		}
+		if blockType == 4 || blockType == 6 {
+			block := make([]byte, length)
+			if _, err := io.ReadFull(r, block); err != nil {
+				return tags, err
+			}
+			if blockType == 4 {
+				applyVorbisComments(&tags, block)
+			} else {
+				applyFLACPicture(&tags, block)
+			}
+		} else if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return tags, err
+		}
+		if last {
+			return tags, nil
+		}
+	}
+}
+
+// Helper function to read the comment header of an Ogg Vorbis or Opus file
+func readOggTags(r io.Reader) (AudioTags, error) {
+	var tags AudioTags
+	var packet []byte
+	packets := 0
+	header := make([]byte, 27)
+	for read := 0; read < maxTagSize; {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return tags, err
+		}
+		if !bytes.Equal(header[:4], []byte("OggS")) {
+			return tags, fmt.Errorf("invalid Ogg page")
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(r, segments); err != nil {
+			return tags, err
+		}
+		for _, segmentLen := range segments {
+			segment := make([]byte, segmentLen)
+			if _, err := io.ReadFull(r, segment); err != nil {
+				return tags, err
+			}
+			read += int(segmentLen)
+			packet = append(packet, segment...)
+			if segmentLen == 255 {
+				continue // The packet continues in the next segment
+			}
+			// The second packet is the comment header
+			packets++
+			if packets == 2 {
+				switch {
+				case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+					applyVorbisComments(&tags, packet[7:])
+				case bytes.HasPrefix(packet, []byte("OpusTags")):
+					applyVorbisComments(&tags, packet[8:])
+				}
+				return tags, nil
+			}
+			packet = packet[:0]
+		}
+	}
+	return tags, nil
+}
+
+// Helper function to read the iTunes metadata atoms of an MP4 file
+func readMP4Tags(r io.ReadSeeker) (AudioTags, error) {
+	var tags AudioTags
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return tags, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return tags, err
+	}
+	err = walkMP4Atoms(r, end, []string{"moov", "udta", "meta", "ilst"}, func(name string, data []byte) {
+		value := mp4AtomData(data)
+		if value == nil {
+			return
+		}
+		switch name {
+		case "\xa9nam":
+			setFirst(&tags.Title, string(value))
+		case "\xa9ART", "aART":
+			setFirst(&tags.Artist, string(value))
+		case "\xa9alb":
+			setFirst(&tags.Album, string(value))
+		case "\xa9day":
+			tags.setYear(string(value))
+		case "\xa9lyr":
+			setFirst(&tags.Lyrics, string(value))
+		case "trkn":
+			if len(value) >= 4 && tags.Track == 0 {
+				tags.Track = int(binary.BigEndian.Uint16(value[2:4]))
+			}
+		case "covr":
+			if tags.Cover == nil {
+				tags.Cover = value
+				tags.CoverMIME = "image/jpeg"
+				if bytes.HasPrefix(value, []byte("\x89PNG")) {
+					tags.CoverMIME = "image/png"
+				}
+			}
+		}
+	})
+	return tags, err
+}
+
+// Helper function to descend the atom path and call fn with every atom inside the last one
+func walkMP4Atoms(r io.ReadSeeker, end int64, path []string, fn func(name string, data []byte)) error {
+	header := make([]byte, 8)
+	for {
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if offset+8 > end {
+			return nil
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		name := string(header[4:8])
+		headerSize := int64(8)
+		if size == 1 {
+			// 64 bit size follows the name
+			large := make([]byte, 8)
+			if _, err := io.ReadFull(r, large); err != nil {
+				return err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(large)), 16
+		} else if size == 0 {
+			size = end - offset
+		}
+		if size < headerSize || offset+size > end {
+			return fmt.Errorf("invalid MP4 atom %q", name)
+		}
+
+		switch {
+		case len(path) > 0 && name == path[0]:
+			// meta is a full atom with 4 bytes of version and flags before its children
+			if name == "meta" {
+				if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+					return err
+				}
+			}
+			return walkMP4Atoms(r, offset+size, path[1:], fn)
+		case len(path) == 0 && size-headerSize <= maxTagSize:
+			data := make([]byte, size-headerSize)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			fn(name, data)
+		}
+		if _, err := r.Seek(offset+size, io.SeekStart); err != nil {
+			return err
+		}
+	}
+}
+
+// Helper function to get the value of the data atom inside an ilst item
+func mp4AtomData(item []byte) []byte {
+	// size, "data", 4 bytes type, 4 bytes locale, value
+	if len(item) < 16 || string(item[4:8]) != "data" {
+		return nil
+	}
+	size := int(binary.BigEndian.Uint32(item[:4]))
+	if size < 16 || size > len(item) {
+		return nil
+	}
+	return item[16:size]
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+)
+
+// Helper function to build a Vorbis comment block
+func buildVorbisComments(vendor string, comments ...string) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(vendor)))
+	buf.WriteString(vendor)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(comments)))
+	for _, comment := range comments {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(comment)))
+		buf.WriteString(comment)
+	}
+	return buf.Bytes()
+}
+
+// Helper function to build a FLAC picture block
+func buildFLACPicture(mimeType, description string, picture []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(3)) // Front cover
+	binary.Write(&buf, binary.BigEndian, uint32(len(mimeType)))
+	buf.WriteString(mimeType)
+	binary.Write(&buf, binary.BigEndian, uint32(len(description)))
+	buf.WriteString(description)
+	buf.Write(make([]byte, 16)) // Width, height, depth and colour count
+	binary.Write(&buf, binary.BigEndian, uint32(len(picture)))
+	buf.Write(picture)
+	return buf.Bytes()
+}
+
+// Helper function to overwrite a 32-bit length inside a block
+func setLength(data []byte, offset int, length uint32, order binary.ByteOrder) []byte {
+	data = append([]byte{}, data...)
+	order.PutUint32(data[offset:], length)
+	return data
+}
+
+func TestApplyVorbisComments(t *testing.T) {
+	valid := buildVorbisComments("vendor", "TITLE=稻香", "ARTIST=周杰伦", "TRACKNUMBER=3/10")
+	commentOffset := 4 + len("vendor") + 4
+
+	tests := []struct {
+		name   string
+		data   []byte
+		title  string
+		artist string
+	}{
+		{"valid", valid, "稻香", "周杰伦"},
+		{"empty", nil, "", ""},
+		{"vendor length only", valid[:4], "", ""},
+		{"truncated vendor", valid[:8], "", ""},
+		{"truncated comment", valid[:len(valid)-3], "稻香", "周杰伦"},
+		{"oversized vendor length", setLength(valid, 0, 0xffffffff, binary.LittleEndian), "", ""},
+		{"vendor length wraps to negative", setLength(valid, 0, 0x80000000, binary.LittleEndian), "", ""},
+		{"vendor length one past the end", setLength(valid, 0, uint32(len(valid)-7), binary.LittleEndian), "", ""},
+		{"oversized comment length", setLength(valid, commentOffset, 0xfffffff0, binary.LittleEndian), "", ""},
+		{"huge comment count", setLength(valid, 4+len("vendor"), 0xffffffff, binary.LittleEndian), "稻香", "周杰伦"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tags AudioTags
+			applyVorbisComments(&tags, test.data)
+			if tags.Title != test.title || tags.Artist != test.artist {
+				t.Errorf("got title %q artist %q, want %q %q", tags.Title, tags.Artist, test.title, test.artist)
+			}
+		})
+	}
+}
+
+func TestApplyFLACPicture(t *testing.T) {
+	picture := []byte("\x89PNG data")
+	valid := buildFLACPicture("image/png", "cover", picture)
+	descOffset := 8 + len("image/png")
+	pictureOffset := descOffset + 4 + len("cover") + 16
+
+	tests := []struct {
+		name  string
+		data  []byte
+		cover []byte
+	}{
+		{"valid", valid, picture},
+		{"empty", nil, nil},
+		{"truncated header", valid[:10], nil},
+		{"truncated picture", valid[:len(valid)-1], nil},
+		{"oversized mime length", setLength(valid, 4, 0xffffffff, binary.BigEndian), nil},
+		{"mime length wraps to negative", setLength(valid, 4, 0x80000000, binary.BigEndian), nil},
+		{"oversized description length", setLength(valid, descOffset, 0xfffffffc, binary.BigEndian), nil},
+		{"oversized picture length", setLength(valid, pictureOffset, 0x80000001, binary.BigEndian), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tags AudioTags
+			applyFLACPicture(&tags, test.data)
+			if !bytes.Equal(tags.Cover, test.cover) {
+				t.Errorf("got cover %q, want %q", tags.Cover, test.cover)
+			}
+		})
+	}
+}
+
+func TestVorbisCommentPicture(t *testing.T) {
+	picture := []byte("jpeg data")
+	block := buildFLACPicture("image/jpeg", "", picture)
+	var tags AudioTags
+	applyVorbisComments(&tags, buildVorbisComments("", "METADATA_BLOCK_PICTURE="+base64.StdEncoding.EncodeToString(block)))
+	if !bytes.Equal(tags.Cover, picture) || tags.CoverMIME != "image/jpeg" {
+		t.Errorf("got cover %q of type %q", tags.Cover, tags.CoverMIME)
+	}
+}
+
+func FuzzAudioTagBlocks(f *testing.F) {
+	f.Add(buildVorbisComments("vendor", "TITLE=a", "ARTIST=b"))
+	f.Add(buildFLACPicture("image/png", "cover", []byte("png")))
+	f.Add(setLength(buildVorbisComments("v", "TITLE=a"), 0, 0x80000000, binary.LittleEndian))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var tags AudioTags
+		applyVorbisComments(&tags, data)
+		tags = AudioTags{}
+		applyFLACPicture(&tags, data)
+		readID3v2Tags(bytes.NewReader(append([]byte("ID3\x03\x00\x00\x00\x00\x01\x00"), data...)))
+		readFLACTags(bytes.NewReader(append([]byte("fLaC"), data...)))
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ErrURLForbidden is returned when a remote URL or its response is rejected by the URL policy.
+var ErrURLForbidden = errors.New("forbidden by URL policy")
+
+// urlPolicy decides which remote URLs the proxy and the downloader may fetch. It is configured by
+// URL_ALLOW_HOSTS, URL_DENY_HOSTS, URL_ALLOW_PRIVATE, URL_MAX_SIZE and URL_ALLOWED_CONTENT_TYPES.
+type urlPolicy struct {
+	allowHosts   []string // Empty allows every host that is not denied
+	denyHosts    []string
+	allowPrivate bool  // Allow loopback, private and link-local addresses
+	maxSize      int64 // Maximum response size in bytes, 0 for no limit
+	contentTypes []string
+}
+
+// defaultAllowedContentTypes covers audio, covers, lyrics and playlists.
+const defaultAllowedContentTypes = "audio/,image/,text/,application/octet-stream,application/ogg,application/json,application/x-mpegurl,application/vnd.apple.mpegurl"
+
+var (
+	remotePolicy     *urlPolicy
+	remotePolicyOnce sync.Once
+)
+
+// cgnatPrefix is the carrier-grade NAT range, which netip does not treat as private.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// Helper function to get the URL policy
+func getURLPolicy() *urlPolicy {
+	remotePolicyOnce.Do(func() {
+		contentTypes := os.Getenv("URL_ALLOWED_CONTENT_TYPES")
+		if contentTypes == "" {
+			contentTypes = defaultAllowedContentTypes
+		}
+		allowPrivate, _ := strconv.ParseBool(os.Getenv("URL_ALLOW_PRIVATE"))
+		remotePolicy = &urlPolicy{
+			allowHosts:   splitList(os.Getenv("URL_ALLOW_HOSTS")),
+			denyHosts:    splitList(os.Getenv("URL_DENY_HOSTS")),
+			allowPrivate: allowPrivate,
+			maxSize:      int64(getEnvInt("URL_MAX_SIZE", 200*1024*1024)),
+			contentTypes: splitList(contentTypes),
+		}
+	})
+	return remotePolicy
+}
+
+// Helper function to split a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Helper function to match a host against a list of host names, where "*.example.com"
+// or ".example.com" also match every subdomain
+func matchHostList(host string, list []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range list {
+		suffix := strings.TrimPrefix(pattern, "*")
+		if strings.HasPrefix(suffix, ".") {
+			if strings.HasSuffix(host, suffix) || host == suffix[1:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckURL rejects URLs with other schemes than http and https and hosts that are not allowed.
+func (p *urlPolicy) CheckURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %q", ErrURLForbidden, u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrURLForbidden)
+	}
+	if matchHostList(host, p.denyHosts) {
+		return fmt.Errorf("%w: host %s is denied", ErrURLForbidden, host)
+	}
+	if len(p.allowHosts) > 0 && !matchHostList(host, p.allowHosts) {
+		return fmt.Errorf("%w: host %s is not allowed", ErrURLForbidden, host)
+	}
+	return nil
+}
+
+// CheckIP rejects loopback, private, link-local and other non-public addresses.
+func (p *urlPolicy) CheckIP(addr netip.Addr) error {
+	if p.allowPrivate {
+		return nil
+	}
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() || cgnatPrefix.Contains(addr) {
+		return fmt.Errorf("%w: address %s is not public", ErrURLForbidden, addr)
+	}
+	return nil
+}
+
+// dialControl checks the resolved address of every connection, so DNS names pointing at
+// internal addresses are caught as well.
+func (p *urlPolicy) dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: unexpected address %s", ErrURLForbidden, address)
+	}
+	return p.CheckIP(addr)
+}
+
+// CheckResponse rejects responses that are too large or of a content type that is not allowed.
+func (p *urlPolicy) CheckResponse(resp *http.Response) error {
+	if p.maxSize > 0 && resp.ContentLength > p.maxSize {
+		return fmt.Errorf("%w: response of %d bytes exceeds %d", ErrURLForbidden, resp.ContentLength, p.maxSize)
+	}
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	if contentType == "" || len(p.contentTypes) == 0 {
+		return nil
+	}
+	for _, allowed := range p.contentTypes {
+		if strings.HasPrefix(contentType, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: content type %s", ErrURLForbidden, contentType)
+}
+
+// LimitBody wraps a response body so reading fails once it grows beyond the maximum size.
+func (p *urlPolicy) LimitBody(body io.Reader) io.Reader {
+	if p.maxSize <= 0 {
+		return body
+	}
+	return &sizeLimitReader{r: body, remaining: p.maxSize}
+}
+
+// sizeLimitReader fails with ErrURLForbidden instead of silently truncating like io.LimitReader.
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (lr *sizeLimitReader) Read(p []byte) (int, error) {
+	if lr.remaining < 0 {
+		return 0, fmt.Errorf("%w: response exceeds the size limit", ErrURLForbidden)
+	}
+	// Read one byte past the limit to tell a body of exactly the maximum size from a larger one
+	if int64(len(p)) > lr.remaining+1 {
+		p = p[:lr.remaining+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	if lr.remaining < 0 {
+		return n + int(lr.remaining), fmt.Errorf("%w: response exceeds the size limit", ErrURLForbidden)
+	}
+	return n, err
+}
+
+// Helper function to answer a request rejected by the URL policy with 403
+func writeForbidden(w http.ResponseWriter, r *http.Request, err error) {
+	fmt.Printf("[Warning] Blocked request from %s for %s: %v\n", r.RemoteAddr, r.URL.Path, err)
+	http.Error(w, "403 Forbidden", http.StatusForbidden)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Helper function to watch the local music folder, the cache and sources.json and refresh the
+// library index after a burst of changes settles. It is disabled by LIBRARY_WATCH=false and the
+// quiet period is set by LIBRARY_WATCH_DEBOUNCE in milliseconds.
+func watchLibrary(lib *libraryIndex) {
+	if enabled, err := strconv.ParseBool(os.Getenv("LIBRARY_WATCH")); err == nil && !enabled {
+		fmt.Println("[Info] Library watcher disabled")
+		return
+	}
+	debounce := time.Duration(getEnvInt("LIBRARY_WATCH_DEBOUNCE", 2000)) * time.Millisecond
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Println("[Error] Failed to start library watcher:", err)
+		return
+	}
+
+	musicDir := "./files/music"
+	addLibraryWatches(watcher, musicDir)
+	fmt.Println("[Info] Watching the music library for changes")
+
+	go func() {
+		defer watcher.Close()
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if handleLibraryEvent(watcher, event, musicDir) {
+					timer.Reset(debounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Println("[Error] Library watcher error:", err)
+			case <-timer.C:
+				if err := lib.Refresh(); err != nil {
+					fmt.Println("[Error] Failed to refresh library index:", err)
+				}
+			}
+		}
+	}()
+}
+
+// Helper function to watch the library folders that exist. The parents of the music folder and the cache are
+// watched as well, so folders created after startup are added when they appear.
+func addLibraryWatches(watcher *fsnotify.Watcher, musicDir string) {
+	// The directory holding sources.json is watched rather than the file, editors often replace it by renaming
+	for _, dir := range []string{".", filepath.Dir(musicDir), musicDir, "./cache"} {
+		if err := watcher.Add(dir); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[Warning] Failed to watch %s: %v\n", dir, err)
+		}
+	}
+	// Files are often copied into a track folder after the folder itself was created
+	for _, dirName := range listLocalMusicDirs(musicDir) {
+		watcher.Add(filepath.Join(musicDir, dirName))
+	}
+}
+
+// Helper function to watch the folders a library event created, reporting whether the index needs a refresh
+func handleLibraryEvent(watcher *fsnotify.Watcher, event fsnotify.Event, musicDir string) bool {
+	if !isLibraryEvent(event, musicDir) {
+		return false
+	}
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			if filepath.Dir(event.Name) == filepath.Clean(musicDir) {
+				// Watch new track folders as well
+				watcher.Add(event.Name)
+			} else {
+				// ./files, ./files/music or ./cache appeared after startup
+				addLibraryWatches(watcher, musicDir)
+			}
+		}
+	}
+	return true
+}
+
+// Helper function to tell whether a file system event can change the library index
+func isLibraryEvent(event fsnotify.Event, musicDir string) bool {
+	if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+		return false
+	}
+	name := filepath.Base(event.Name)
+	switch filepath.Clean(filepath.Dir(event.Name)) {
+	case ".":
+		return name == "sources.json" || name == filepath.Base(filepath.Dir(musicDir)) || name == "cache"
+	case filepath.Clean(filepath.Dir(musicDir)):
+		return name == filepath.Base(musicDir)
+	case filepath.Clean("./cache"):
+		return filepath.Ext(name) == ".json"
+	}
+	// Folders being produced by the server itself are ignored until they are published
+	return !isStagingPath(event.Name)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Helper function to handle the events of a watcher until the condition holds
+func handleLibraryEventsUntil(t *testing.T, watcher *fsnotify.Watcher, musicDir string, done func() bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for !done() {
+		select {
+		case event := <-watcher.Events:
+			handleLibraryEvent(watcher, event, musicDir)
+		case err := <-watcher.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("condition not met, watching %v", watcher.WatchList())
+		}
+	}
+}
+
+func TestLibraryWatcherAddsMissingMusicDir(t *testing.T) {
+	t.Chdir(t.TempDir())
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	// Neither ./files nor ./cache exist at startup
+	musicDir := "./files/music"
+	addLibraryWatches(watcher, musicDir)
+	watching := func(dir string) func() bool {
+		return func() bool { return slices.Contains(watcher.WatchList(), filepath.Clean(dir)) }
+	}
+
+	if err := os.Mkdir("files", 0755); err != nil {
+		t.Fatal(err)
+	}
+	handleLibraryEventsUntil(t, watcher, musicDir, watching("files"))
+	if err := os.Mkdir("files/music", 0755); err != nil {
+		t.Fatal(err)
+	}
+	handleLibraryEventsUntil(t, watcher, musicDir, watching("files/music"))
+	if err := os.Mkdir("files/music/Alice-Song", 0755); err != nil {
+		t.Fatal(err)
+	}
+	handleLibraryEventsUntil(t, watcher, musicDir, watching("files/music/Alice-Song"))
+
+	if err := os.Mkdir("cache", 0755); err != nil {
+		t.Fatal(err)
+	}
+	handleLibraryEventsUntil(t, watcher, musicDir, watching("cache"))
+	// Folders created in one go are found by the rescan of the new parent
+	if err := os.RemoveAll("files"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll("files/music/Bob-Song", 0755); err != nil {
+		t.Fatal(err)
+	}
+	handleLibraryEventsUntil(t, watcher, musicDir, watching("files/music/Bob-Song"))
+}
+
+func TestIsLibraryEvent(t *testing.T) {
+	musicDir := "./files/music"
+	tests := []struct {
+		event fsnotify.Event
+		want  bool
+	}{
+		{fsnotify.Event{Name: "sources.json", Op: fsnotify.Write}, true},
+		{fsnotify.Event{Name: "playlists.json", Op: fsnotify.Write}, false},
+		{fsnotify.Event{Name: "files", Op: fsnotify.Create}, true},
+		{fsnotify.Event{Name: "cache", Op: fsnotify.Create}, true},
+		{fsnotify.Event{Name: "files/music", Op: fsnotify.Create}, true},
+		{fsnotify.Event{Name: "files/cache", Op: fsnotify.Create}, false},
+		{fsnotify.Event{Name: "files/music/Alice-Song", Op: fsnotify.Create}, true},
+		{fsnotify.Event{Name: "files/music/.staging-1", Op: fsnotify.Create}, false},
+		{fsnotify.Event{Name: "files/music/Alice-Song/music.mp3", Op: fsnotify.Chmod}, false},
+		{fsnotify.Event{Name: "cache/Alice-Song.json", Op: fsnotify.Remove}, true},
+		{fsnotify.Event{Name: "cache/library.db", Op: fsnotify.Write}, false},
+	}
+	for _, test := range tests {
+		if got := isLibraryEvent(test.event, musicDir); got != test.want {
+			t.Errorf("isLibraryEvent(%v) = %v, want %v", test.event, got, test.want)
+		}
+	}
+}
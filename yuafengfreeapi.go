@@ -1,14 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 )
@@ -24,140 +22,165 @@ type YuafengAPIFreeResponse struct {
 	} `json:"data"`
 }
 
-// 枫雨API response handler.
-func YuafengAPIResponseHandler(sources, song, singer string) MusicItem {
-	fmt.Printf("[Info] Fetching music data from 枫林 free API for %s by %s\n", song, singer)
-	var APIurl string
-	switch sources {
-	case "kuwo":
-		APIurl = "https://api.yuafeng.cn/API/ly/kwmusic.php"
-	case "netease":
-		APIurl = "https://api.yuafeng.cn/API/ly/wymusic.php"
-	case "migu":
-		APIurl = "https://api.yuafeng.cn/API/ly/mgmusic.php"
-	case "baidu":
-		APIurl = "https://api.yuafeng.cn/API/ly/bdmusic.php"
-	default:
-		return MusicItem{}
-	}
-	resp, err := http.Get(APIurl + "?msg=" + song + "&n=1")
+// YuafengAPIFreeListResponse is returned by the 枫雨 free API when no index is given.
+type YuafengAPIFreeListResponse struct {
+	Data []struct {
+		Song      string `json:"song"`
+		Singer    string `json:"singer"`
+		Cover     string `json:"cover"`
+		AlbumName string `json:"album_name"`
+	} `json:"data"`
+}
+
+// YuafengProvider fetches music from one of the 枫雨 free API endpoints.
+type YuafengProvider struct {
+	name   string
+	apiURL string
+	client *http.Client
+}
+
+// NewYuafengProvider creates a 枫雨 provider for the given endpoint.
+func NewYuafengProvider(name, apiURL string, client *http.Client) *YuafengProvider {
+	return &YuafengProvider{name: name, apiURL: apiURL, client: client}
+}
+
+// Helper function to register the built-in 枫雨 free API providers
+func registerYuafengProviders() {
+	registerProvider(NewYuafengProvider("kuwo", "https://api.yuafeng.cn/API/ly/kwmusic.php", providerHTTPClient))
+	registerProvider(NewYuafengProvider("netease", "https://api.yuafeng.cn/API/ly/wymusic.php", providerHTTPClient))
+	registerProvider(NewYuafengProvider("migu", "https://api.yuafeng.cn/API/ly/mgmusic.php", providerHTTPClient))
+	registerProvider(NewYuafengProvider("baidu", "https://api.yuafeng.cn/API/ly/bdmusic.php", providerHTTPClient))
+}
+
+func (p *YuafengProvider) Name() string {
+	return p.name
+}
+
+// Helper function to request the 枫雨 free API and return the response body
+func (p *YuafengProvider) get(ctx context.Context, query url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.apiURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
 	if err != nil {
-		fmt.Println("[Error] Error fetching the data from Yuafeng free API:", err)
-		return MusicItem{}
+		return nil, fmt.Errorf("error fetching the data from Yuafeng free API: %w", err)
 	}
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Println("[Error] Error reading the response body from Yuafeng free API:", err)
-		return MusicItem{}
+		return nil, fmt.Errorf("error reading the response body from Yuafeng free API: %w", err)
+	}
+	return body, nil
+}
+
+// Helper function to fetch the n-th search result with its music, cover and lyric
+func (p *YuafengProvider) fetch(ctx context.Context, song string, n int) (Track, error) {
+	fmt.Printf("[Info] Fetching music data from 枫林 free API for %s (#%d)\n", song, n)
+	body, err := p.get(ctx, url.Values{"msg": {song}, "n": {strconv.Itoa(n)}})
+	if err != nil {
+		return Track{}, err
 	}
 	var response YuafengAPIFreeResponse
 	err = json.Unmarshal(body, &response)
 	if err != nil {
-		fmt.Println("[Error] Error unmarshalling the data from Yuafeng free API:", err)
-		return MusicItem{}
+		return Track{}, fmt.Errorf("error unmarshalling the data from Yuafeng free API: %w", err)
 	}
-
-	// Create directory
-	dirName := fmt.Sprintf("./files/cache/music/%s-%s", response.Data.Singer, response.Data.Song)
-	err = os.MkdirAll(dirName, 0755)
-	if err != nil {
-		fmt.Println("[Error] Error creating directory:", err)
-		return MusicItem{}
+	if response.Data.Song == "" {
+		return Track{}, fmt.Errorf("no result from Yuafeng free API for %s", song)
 	}
+	return Track{
+		Provider: p.name,
+		ID:       song + "#" + strconv.Itoa(n),
+		Title:    response.Data.Song,
+		Artist:   response.Data.Singer,
+		Album:    response.Data.AlbumName,
+		MusicURL: response.Data.Music,
+		CoverURL: response.Data.Cover,
+		Lyric:    response.Data.Lyric,
+	}, nil
+}
 
-	if response.Data.Music == "" {
-		fmt.Println("[Warning] Music URL is empty")
-		return MusicItem{}
+func (p *YuafengProvider) Search(ctx context.Context, song, singer string, limit int) ([]Track, error) {
+	fmt.Printf("[Info] Searching 枫林 free API for %s by %s\n", song, singer)
+	// A single result is fetched directly with its music URL
+	if limit <= 1 {
+		track, err := p.fetch(ctx, song, 1)
+		if err != nil {
+			return nil, err
+		}
+		return []Track{track}, nil
 	}
 
-	// Identify music file format
-	musicExt, err := getMusicFileExtension(response.Data.Music)
+	body, err := p.get(ctx, url.Values{"msg": {song}})
 	if err != nil {
-		fmt.Println("[Error] Error identifying music file format:", err)
-		return MusicItem{}
+		return nil, err
 	}
-
-	// Download music files
-	err = downloadFile(filepath.Join(dirName, "music_full"+musicExt), response.Data.Music)
+	var response YuafengAPIFreeListResponse
+	err = json.Unmarshal(body, &response)
 	if err != nil {
-		fmt.Println("[Error] Error downloading music file:", err)
+		return nil, fmt.Errorf("error unmarshalling the data from Yuafeng free API: %w", err)
 	}
 
-	// Retrieve music file duration
-	musicFilePath := filepath.Join(dirName, "music_full"+musicExt)
-	duration := getMusicDuration(musicFilePath)
-
-	// Download cover image
-	ext := filepath.Ext(response.Data.Cover)
-	err = downloadFile(filepath.Join(dirName, "cover"+ext), response.Data.Cover)
-	if err != nil {
-		fmt.Println("[Error] Error downloading cover image:", err)
-	}
-
-	// Check if the lyrics format is in link format
-	lyricData := response.Data.Lyric
-	if lyricData == "获取歌词失败" {
-		// If it is "获取歌词失败", do nothing
-		fmt.Println("[Warning] Lyric retrieval failed, skipping lyric file creation and download.")
-	} else if !strings.HasPrefix(lyricData, "http://") && !strings.HasPrefix(lyricData, "https://") {
-		// If it is not in link format, write the lyrics to the file line by line
-		lines := strings.Split(lyricData, "\n")
-		lyricFilePath := filepath.Join(dirName, "lyric.lrc")
-		file, err := os.Create(lyricFilePath)
-		if err != nil {
-			fmt.Println("[Error] Error creating lyric file:", err)
-			return MusicItem{}
+	var tracks []Track
+	for i, data := range response.Data {
+		if len(tracks) >= limit {
+			break
 		}
-		defer file.Close()
-
-		timeTagRegex := regexp.MustCompile(`^\[(\d+(?:\.\d+)?)\]`)
-		for _, line := range lines {
-			// Check if the line starts with a time tag
-			match := timeTagRegex.FindStringSubmatch(line)
-			if match != nil {
-				// Convert the time tag to [mm:ss.ms] format
-				timeInSeconds, _ := strconv.ParseFloat(match[1], 64)
-				minutes := int(timeInSeconds / 60)
-				seconds := int(timeInSeconds) % 60
-				milliseconds := int((timeInSeconds-float64(seconds))*1000) / 100 % 100
-				formattedTimeTag := fmt.Sprintf("[%02d:%02d.%02d]", minutes, seconds, milliseconds)
-				line = timeTagRegex.ReplaceAllString(line, formattedTimeTag)
-			}
-			_, err := file.WriteString(line + "\r\n")
-			if err != nil {
-				fmt.Println("[Error] Error writing to lyric file:", err)
-				return MusicItem{}
-			}
-		}
-	} else {
-		// If it is in link format, download the lyrics file
-		err = downloadFile(filepath.Join(dirName, "lyric.lrc"), lyricData)
-		if err != nil {
-			fmt.Println("[Error] Error downloading lyric file:", err)
+		tracks = append(tracks, Track{
+			Provider: p.name,
+			// The API addresses results by their 1-based position in the list
+			ID:       song + "#" + strconv.Itoa(i+1),
+			Title:    data.Song,
+			Artist:   data.Singer,
+			Album:    data.AlbumName,
+			CoverURL: data.Cover,
+		})
+	}
+	return tracks, nil
+}
+
+// Helper function to split a track ID into the search keyword and result index
+func (p *YuafengProvider) parseID(id string) (string, int, error) {
+	index := strings.LastIndex(id, "#")
+	if index >= 0 {
+		n, err := strconv.Atoi(id[index+1:])
+		if err == nil {
+			return id[:index], n, nil
 		}
 	}
+	return "", 0, fmt.Errorf("invalid Yuafeng track ID: %s", id)
+}
 
-	// Compress and segment audio file
-	err = compressAndSegmentAudio(filepath.Join(dirName, "music_full"+musicExt), dirName)
+func (p *YuafengProvider) ResolveTrack(ctx context.Context, track Track) (Track, error) {
+	if track.MusicURL != "" {
+		return track, nil
+	}
+	song, n, err := p.parseID(track.ID)
 	if err != nil {
-		fmt.Println("[Error] Error compressing and segmenting audio:", err)
+		return Track{}, err
 	}
+	return p.fetch(ctx, song, n)
+}
 
-	// Create m3u8 playlist
-	err = createM3U8Playlist(dirName)
+func (p *YuafengProvider) FetchLyric(ctx context.Context, track Track) (string, error) {
+	if track.Lyric != "" {
+		return track.Lyric, nil
+	}
+	resolved, err := p.ResolveTrack(ctx, track)
 	if err != nil {
-		fmt.Println("[Error] Error creating m3u8 playlist:", err)
+		return "", err
 	}
+	return resolved.Lyric, nil
+}
 
-	return MusicItem{
-		Title:        response.Data.Song,
-		Artist:       response.Data.Singer,
-		CoverURL:     "/files/cache/music/" + url.QueryEscape(response.Data.Singer+"-"+response.Data.Song) + "/cover" + ext,
-		LyricURL:     "/files/cache/music/" + url.QueryEscape(response.Data.Singer+"-"+response.Data.Song) + "/lyric.lrc",
-		AudioFullURL: "/files/cache/music/" + url.QueryEscape(response.Data.Singer+"-"+response.Data.Song) + "/music_full" + musicExt,
-		AudioURL:     "/files/cache/music/" + url.QueryEscape(response.Data.Singer+"-"+response.Data.Song) + "/music.mp3",
-		M3U8URL:      "/files/cache/music/" + url.QueryEscape(response.Data.Singer+"-"+response.Data.Song) + "/music.m3u8",
-		Duration:     duration,
+func (p *YuafengProvider) FetchCover(ctx context.Context, track Track) (string, error) {
+	if track.CoverURL != "" {
+		return track.CoverURL, nil
+	}
+	resolved, err := p.ResolveTrack(ctx, track)
+	if err != nil {
+		return "", err
 	}
+	return resolved.CoverURL, nil
 }